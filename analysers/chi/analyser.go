@@ -0,0 +1,169 @@
+package chi
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"reflect"
+
+	"github.com/gostaticanalysis/analysisutil"
+	"github.com/mazrean/isucon-go-tools/v2/pkg/suggest"
+	"golang.org/x/tools/go/analysis"
+)
+
+const (
+	chiPkgName         = "github.com/go-chi/chi/v5"
+	apiPkgName         = "github.com/mazrean/isucon-go-tools/v2/http"
+	apiPkgDefaultIdent = "isuhttp"
+	apiFuncName        = "ChiNew"
+)
+
+var (
+	chiFuncNames = []string{"NewRouter", "NewMux"}
+
+	importPkgs []*suggest.ImportInfo
+	Analyzer   = &analysis.Analyzer{
+		Name:       "chi",
+		Doc:        "automatically setup github.com/go-chi/chi/v5 package",
+		Run:        run,
+		ResultType: reflect.TypeOf(importPkgs),
+	}
+)
+
+func run(pass *analysis.Pass) (any, error) {
+	err := wrapNew(pass)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap chi.NewRouter: %w", err)
+	}
+
+	return importPkgs, nil
+}
+
+func wrapNew(pass *analysis.Pass) error {
+	var pkgIdent string
+	for _, pkg := range pass.Pkg.Imports() {
+		if analysisutil.RemoveVendor(pkg.Path()) == chiPkgName {
+			pkgIdent = pkg.Name()
+			break
+		}
+	}
+	if len(pkgIdent) == 0 {
+		return nil
+	}
+
+	funcInfoList := []*funcInfo{}
+	for _, funcName := range chiFuncNames {
+		funcInfoList = append(funcInfoList, &funcInfo{
+			pkgName:  chiPkgName,
+			pkgIdent: pkgIdent,
+			funcName: funcName,
+		})
+	}
+
+	callInfoList := []*callInfo{}
+	for _, f := range pass.Files {
+		v := visitor{
+			funcInfoList: funcInfoList,
+		}
+
+		ast.Walk(&v, f)
+
+		if len(v.callExprs) != 0 {
+			importPkgs = append(importPkgs, &suggest.ImportInfo{
+				File:  f,
+				Ident: apiPkgDefaultIdent,
+				Path:  apiPkgName,
+			})
+
+			callInfoList = append(callInfoList, v.callExprs...)
+		}
+	}
+
+	if len(callInfoList) == 0 {
+		return nil
+	}
+
+	for _, callInfo := range callInfoList {
+		buf := bytes.Buffer{}
+
+		err := format.Node(&buf, pass.Fset, &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   ast.NewIdent(apiPkgDefaultIdent),
+				Sel: ast.NewIdent(apiFuncName),
+			},
+			Args: []ast.Expr{callInfo.expr},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to format import declaration: %w", err)
+		}
+
+		pass.Report(analysis.Diagnostic{
+			Pos:     callInfo.expr.Pos(),
+			Message: fmt.Sprintf("should wrap (%s).%s with (%s).%s", callInfo.funcInfo.pkgName, callInfo.funcInfo.funcName, apiPkgName, apiFuncName),
+			SuggestedFixes: []analysis.SuggestedFix{{
+				Message: fmt.Sprintf("wrap (%s).%s with (%s).%s", callInfo.funcInfo.pkgName, callInfo.funcInfo.funcName, apiPkgName, apiFuncName),
+				TextEdits: []analysis.TextEdit{{
+					Pos:     callInfo.expr.Pos(),
+					End:     callInfo.expr.End(),
+					NewText: buf.Bytes(),
+				}},
+			}},
+		})
+	}
+
+	return nil
+}
+
+type funcInfo struct {
+	pkgName  string
+	pkgIdent string
+	funcName string
+}
+
+type callInfo struct {
+	funcInfo *funcInfo
+	expr     *ast.CallExpr
+}
+
+type visitor struct {
+	funcInfoList []*funcInfo
+	callExprs    []*callInfo
+}
+
+func (v *visitor) Visit(node ast.Node) ast.Visitor {
+	if node == nil {
+		return nil
+	}
+
+	switch expr := node.(type) {
+	case *ast.CallExpr:
+		calleeSelector, ok := expr.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return v
+		}
+
+		selName, ok := calleeSelector.X.(*ast.Ident)
+		if !ok {
+			return v
+		}
+
+		if selName.Name == apiPkgDefaultIdent && calleeSelector.Sel.Name == apiFuncName {
+			return nil
+		}
+
+		for _, funcInfo := range v.funcInfoList {
+			if selName.Name == funcInfo.pkgIdent && calleeSelector.Sel.Name == funcInfo.funcName {
+				v.callExprs = append(v.callExprs, &callInfo{
+					funcInfo: funcInfo,
+					expr:     expr,
+				})
+				break
+			}
+		}
+
+		return v
+	}
+
+	return v
+}
@@ -135,14 +135,14 @@ func (m *Map[K, V]) Load(key K) (V, bool) {
 
 	v, ok := m.m[key]
 	if ok {
-		if m.loadMetrics != nil {
+		if m.loadMetrics != nil && config.Measuring() {
 			m.loadMetrics.WithLabelValues("hit").Inc()
 		}
 
 		return v, true
 	}
 
-	if m.loadMetrics != nil {
+	if m.loadMetrics != nil && config.Measuring() {
 		m.loadMetrics.WithLabelValues("miss").Inc()
 	}
 
@@ -164,7 +164,7 @@ func (m *Map[K, V]) LoadOrStore(key K, value V) (V, bool) {
 }
 
 func (m *Map[K, V]) Store(key K, value V) {
-	if m.loadMetrics != nil {
+	if m.loadMetrics != nil && config.Measuring() {
 		func() {
 			m.locker.RLock()
 			defer m.locker.RUnlock()
@@ -216,7 +216,7 @@ func (m *Map[K, V]) RangeUpdate(f func(K, V) (V, bool)) {
 }
 
 func (m *Map[K, V]) Forget(key K) {
-	if m.storeMetrics != nil {
+	if m.storeMetrics != nil && config.Measuring() {
 		m.locker.RLock()
 		defer m.locker.RUnlock()
 		_, ok := m.m[key]
@@ -244,7 +244,7 @@ func (m *Map[K, V]) Range(f func(K, V) bool) {
 }
 
 func (m *Map[K, V]) Purge() {
-	if m.storeMetrics != nil {
+	if m.storeMetrics != nil && config.Measuring() {
 		m.storeMetrics.WithLabelValues("remove").Add(float64(len(m.m)))
 	}
 
@@ -336,14 +336,14 @@ func (m *AtomicMap[K, V, T]) Load(key K) (V, bool) {
 	if ok {
 		val := v.Load()
 
-		if m.loadMetrics != nil {
+		if m.loadMetrics != nil && config.Measuring() {
 			m.loadMetrics.WithLabelValues("hit").Inc()
 		}
 
 		return val, true
 	}
 
-	if m.loadMetrics != nil {
+	if m.loadMetrics != nil && config.Measuring() {
 		m.loadMetrics.WithLabelValues("miss").Inc()
 	}
 
@@ -379,7 +379,7 @@ func (m *AtomicMap[K, V, T]) Store(key K, value V) {
 	if ok {
 		v.Store((*T)(value))
 
-		if m.storeMetrics != nil {
+		if m.storeMetrics != nil && config.Measuring() {
 			m.storeMetrics.WithLabelValues("replace").Inc()
 		}
 
@@ -394,7 +394,7 @@ func (m *AtomicMap[K, V, T]) Store(key K, value V) {
 
 	m.m[key] = v
 
-	if m.loadMetrics != nil {
+	if m.loadMetrics != nil && config.Measuring() {
 		m.storeMetrics.WithLabelValues("new").Inc()
 	}
 }
@@ -434,7 +434,7 @@ func (m *AtomicMap[K, V, T]) RangeUpdate(f func(K, V) (V, bool)) {
 }
 
 func (m *AtomicMap[K, V, T]) Forget(key K) {
-	if m.storeMetrics != nil {
+	if m.storeMetrics != nil && config.Measuring() {
 		func() {
 			m.locker.RLock()
 			defer m.locker.RUnlock()
@@ -464,7 +464,7 @@ func (m *AtomicMap[K, V, T]) Range(f func(K, V) bool) {
 }
 
 func (m *AtomicMap[K, V, T]) Purge() {
-	if m.storeMetrics != nil {
+	if m.storeMetrics != nil && config.Measuring() {
 		m.storeMetrics.WithLabelValues("remove").Set(0)
 	}
 
@@ -566,7 +566,7 @@ func (s *Slice[T]) Set(index int, value T) {
 
 	s.s[index] = value
 
-	if s.lengthMetrics != nil {
+	if s.lengthMetrics != nil && config.Measuring() {
 		s.lengthMetrics.Set(float64(len(s.s)))
 	}
 }
@@ -579,7 +579,7 @@ func (s *Slice[T]) Slice(start, end int, f func([]T)) {
 }
 
 func (s *Slice[T]) Get(i int) (T, bool) {
-	if s.indexMetrics != nil {
+	if s.indexMetrics != nil && config.Measuring() {
 		s.indexMetrics.Observe(float64(i))
 	}
 
@@ -608,7 +608,7 @@ func (s *Slice[T]) Edit(f func([]T) []T) {
 		s.s = newS
 	}()
 
-	if s.lengthMetrics != nil {
+	if s.lengthMetrics != nil && config.Measuring() {
 		s.lengthMetrics.Set(float64(len(s.s)))
 	}
 }
@@ -619,7 +619,7 @@ func (s *Slice[T]) Append(values ...T) {
 
 	s.s = append(s.s, values...)
 
-	if s.lengthMetrics != nil {
+	if s.lengthMetrics != nil && config.Measuring() {
 		s.lengthMetrics.Set(float64(len(s.s)))
 	}
 }
@@ -633,7 +633,7 @@ func (s *Slice[T]) Range(f func(int, T) bool) {
 	defer s.locker.RUnlock()
 
 	for i, v := range s.s {
-		if s.indexMetrics != nil {
+		if s.indexMetrics != nil && config.Measuring() {
 			s.indexMetrics.Observe(float64(i))
 		}
 		if !f(i, v) {
@@ -643,7 +643,7 @@ func (s *Slice[T]) Range(f func(int, T) bool) {
 }
 
 func (s *Slice[T]) Purge() {
-	if s.lengthMetrics != nil {
+	if s.lengthMetrics != nil && config.Measuring() {
 		s.lengthMetrics.Set(0)
 	}
 
@@ -816,7 +816,7 @@ func (s *NoDeleteSlice[T]) Append(values ...T) {
 		}
 	}()
 
-	if s.lengthMetrics != nil {
+	if s.lengthMetrics != nil && config.Measuring() {
 		s.lengthMetrics.Set(float64(s.len()))
 	}
 }
@@ -869,7 +869,7 @@ func (s *NoDeleteSlice[T]) Range(f func(int, T) bool) {
 }
 
 func (s *NoDeleteSlice[T]) Purge() {
-	if s.lengthMetrics != nil {
+	if s.lengthMetrics != nil && config.Measuring() {
 		s.lengthMetrics.Set(0)
 	}
 
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"github.com/mazrean/isucon-go-tools/v2/analysers/chi"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/db"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/echo"
+	"github.com/mazrean/isucon-go-tools/v2/analysers/echov5"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/embed"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/fasthttp"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/fiber"
+	"github.com/mazrean/isucon-go-tools/v2/analysers/fiberv3"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/gin"
+	"github.com/mazrean/isucon-go-tools/v2/analysers/gorilla"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/http"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/importer"
 	"github.com/mazrean/isucon-go-tools/v2/analysers/initialize"
@@ -21,6 +25,10 @@ func main() {
 		http.Analyzer,
 		fiber.Analyzer,
 		fasthttp.Analyzer,
+		chi.Analyzer,
+		gorilla.Analyzer,
+		echov5.Analyzer,
+		fiberv3.Analyzer,
 		db.Analyzer,
 		initialize.Analyzer,
 		importer.Analyzer,
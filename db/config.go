@@ -1,19 +1,36 @@
 package isudb
 
+import (
+	"sync/atomic"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+)
+
 var (
-	enableRetry          = false
-	enableQueryTrace     = true
-	fixInterpolateParams = true
+	enableRetry          = atomic.Bool{}
+	enableQueryTrace     = atomic.Bool{}
+	fixInterpolateParams = atomic.Bool{}
 )
 
+func init() {
+	enableRetry.Store(false)
+	enableQueryTrace.Store(true)
+	fixInterpolateParams.Store(true)
+
+	config.RegisterToggle("db.query_trace", enableQueryTrace.Load, enableQueryTrace.Store)
+	// DBの接続時にのみ参照されるため、実行中には変更できない
+	config.RegisterReadOnly("db.retry", enableRetry.Load)
+	config.RegisterReadOnly("db.fix_interpolate_params", fixInterpolateParams.Load)
+}
+
 func SetRetry(enable bool) {
-	enableRetry = enable
+	enableRetry.Store(enable)
 }
 
 func SetQueryTrace(enable bool) {
-	enableQueryTrace = enable
+	enableQueryTrace.Store(enable)
 }
 
 func SetFixInterpolateParams(enable bool) {
-	fixInterpolateParams = enable
+	fixInterpolateParams.Store(enable)
 }
@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
 )
 
 type queryKey struct {
@@ -307,4 +309,7 @@ func Register(mux *http.ServeMux) {
 	mux.Handle("GET /queries", http.HandlerFunc(queryListHandler))
 	mux.Handle("GET /queries/{id}/explain", http.HandlerFunc(queryExplainHandler))
 	mux.Handle("GET /tables", http.HandlerFunc(tableListHandler))
+
+	// DBに対してSQLを実行するため、read-onlyモードでは無効化する
+	admin.MarkUnsafe("GET /queries/{id}/explain", "GET /tables")
 }
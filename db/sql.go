@@ -38,7 +38,7 @@ func DBMetricsSetup[T DB](fn func(string, string) (T, error)) func(string, strin
 		var addr string
 		switch driverName {
 		case "mysql":
-			if fixInterpolateParams {
+			if fixInterpolateParams.Load() && config.Tweak(config.TweakInterpolateParams) {
 				config, err := mysql.ParseDSN(dataSourceName)
 				if err != nil {
 					slog.Error("failed to parse DSN",
@@ -75,7 +75,7 @@ func DBMetricsSetup[T DB](fn func(string, string) (T, error)) func(string, strin
 			db  T
 			err error
 		)
-		if enableRetry {
+		if enableRetry.Load() {
 			var (
 				first = true
 				err   error
@@ -105,9 +105,11 @@ func DBMetricsSetup[T DB](fn func(string, string) (T, error)) func(string, strin
 			}
 		}
 
-		db.SetMaxIdleConns(1024)
-		db.SetConnMaxLifetime(0)
-		db.SetConnMaxIdleTime(0)
+		if config.Tweak(config.TweakDBConn) {
+			db.SetMaxIdleConns(1024)
+			db.SetConnMaxLifetime(0)
+			db.SetConnMaxIdleTime(0)
+		}
 
 		if config.Enable {
 			connID := connectionID.Add(1)
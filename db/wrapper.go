@@ -6,6 +6,8 @@ import (
 	"time"
 
 	isudbgen "github.com/mazrean/isucon-go-tools/v2/db/internal/generate"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
 )
 
 type wrappedDriver struct {
@@ -77,14 +79,14 @@ func (wc *wrappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driv
 }
 
 func (wc *wrappedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
-	return measureQuery(wc.segment, query, args, nil, func() (driver.Result, error) {
+	return measureQuery(context.Background(), wc.segment, query, args, nil, func() (driver.Result, error) {
 		//nolint:staticcheck
 		return wc.Conn.(driver.Execer).Exec(query, args)
 	})
 }
 
 func (wc *wrappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
-	return measureQuery(wc.segment, query, nil, args, func() (driver.Result, error) {
+	return measureQuery(ctx, wc.segment, query, nil, args, func() (driver.Result, error) {
 		return wc.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
 	})
 }
@@ -98,14 +100,14 @@ func (wc *wrappedConn) Ping(ctx context.Context) error {
 }
 
 func (wc *wrappedConn) Query(query string, args []driver.Value) (driver.Rows, error) {
-	return measureQuery(wc.segment, query, args, nil, func() (driver.Rows, error) {
+	return measureQuery(context.Background(), wc.segment, query, args, nil, func() (driver.Rows, error) {
 		//nolint:staticcheck
 		return wc.Conn.(driver.Queryer).Query(query, args)
 	})
 }
 
 func (wc *wrappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
-	return measureQuery(wc.segment, query, nil, args, func() (driver.Rows, error) {
+	return measureQuery(ctx, wc.segment, query, nil, args, func() (driver.Rows, error) {
 		return wc.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
 	})
 }
@@ -167,27 +169,27 @@ func (ws *wrappedStmt) CheckNamedValue(v *driver.NamedValue) error {
 }
 
 func (ws *wrappedStmt) Exec(args []driver.Value) (driver.Result, error) {
-	return measureQuery(ws.segment, ws.query, args, nil, func() (driver.Result, error) {
+	return measureQuery(context.Background(), ws.segment, ws.query, args, nil, func() (driver.Result, error) {
 		//nolint:staticcheck
 		return ws.Stmt.Exec(args)
 	})
 }
 
 func (ws *wrappedStmt) Query(args []driver.Value) (driver.Rows, error) {
-	return measureQuery(ws.segment, ws.query, args, nil, func() (driver.Rows, error) {
+	return measureQuery(context.Background(), ws.segment, ws.query, args, nil, func() (driver.Rows, error) {
 		//nolint:staticcheck
 		return ws.Stmt.Query(args)
 	})
 }
 
 func (ws *wrappedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
-	return measureQuery(ws.segment, ws.query, nil, args, func() (driver.Result, error) {
+	return measureQuery(ctx, ws.segment, ws.query, nil, args, func() (driver.Result, error) {
 		return ws.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
 	})
 }
 
 func (ws *wrappedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
-	return measureQuery(ws.segment, ws.query, nil, args, func() (driver.Rows, error) {
+	return measureQuery(ctx, ws.segment, ws.query, nil, args, func() (driver.Rows, error) {
 		return ws.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
 	})
 }
@@ -203,22 +205,32 @@ type segmentBuilder interface {
 	parseDSN(dsn string) *measureSegment
 }
 
-func (m *measureSegment) setQueryResult(query string, args []driver.Value, namedArgs []driver.NamedValue, queryDur float64) {
-	if enableQueryTrace {
-		normalizedQuery := m.normalizeQuery(query)
-
-		queryCountVec.WithLabelValues(m.driver, m.addr, normalizedQuery).Inc()
-		queryDurHistogramVec.WithLabelValues(m.driver, m.addr, normalizedQuery).Observe(queryDur)
-		queryExecHook(m.driver, normalizedQuery, query, args, namedArgs, queryDur)
+// setQueryResult ctxがリクエストの処理中のものであれば、リクエストごとの集計にも加える
+// クエリのトレースを無効にしている場合は、正規化の負荷を避けるためクエリごとには記録しない
+func (m *measureSegment) setQueryResult(ctx context.Context, query string, args []driver.Value, namedArgs []driver.NamedValue, elapsed time.Duration) {
+	if !enableQueryTrace.Load() {
+		reqstat.AddQuery(ctx, "", elapsed)
+		return
 	}
+
+	normalizedQuery := m.normalizeQuery(query)
+	queryDur := float64(elapsed) / float64(time.Second)
+
+	queryCountVec.WithLabelValues(m.driver, m.addr, normalizedQuery).Inc()
+	queryDurHistogramVec.WithLabelValues(m.driver, m.addr, normalizedQuery).Observe(queryDur)
+	queryExecHook(m.driver, normalizedQuery, query, args, namedArgs, queryDur)
+	reqstat.AddQuery(ctx, normalizedQuery, elapsed)
 }
 
-func measureQuery[T any](segment *measureSegment, query string, args []driver.Value, namedArgs []driver.NamedValue, f func() (T, error)) (T, error) {
+func measureQuery[T any](ctx context.Context, segment *measureSegment, query string, args []driver.Value, namedArgs []driver.NamedValue, f func() (T, error)) (T, error) {
+	if !config.Measuring() {
+		return f()
+	}
+
 	start := time.Now()
 	result, err := f()
-	queryDur := float64(time.Since(start)) / float64(time.Second)
 
-	segment.setQueryResult(query, args, namedArgs, queryDur)
+	segment.setQueryResult(ctx, query, args, namedArgs, time.Since(start))
 
 	return result, err
 }
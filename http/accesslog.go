@@ -0,0 +1,323 @@
+package isuhttp
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/hooks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+/*
+	nginxを経由しない場合でもalpで集計できるよう、アプリケーションでアクセスログを出力する
+	ACCESS_LOG: 出力先のファイル(未設定の場合は無効)
+	ACCESS_LOG_FORMAT: ltsvまたはjson(デフォルトltsv)
+	ACCESS_LOG_BUFFER: 書き込み待ちにできるログの数で、溢れた分は捨てる(デフォルト10000)
+	キーはalpのデフォルトに合わせているので、alp ltsv/alp jsonにそのまま渡せる
+	正規化済みのパスはrouteに入っているので、--uri-label routeなどで集計できる
+	BeforeInitializeの度に<ACCESS_LOG>.<時刻>へ移し、ベンチマークごとにファイルを分ける
+*/
+
+const (
+	accessLogFormatLTSV = "ltsv"
+	accessLogFormatJSON = "json"
+
+	accessLogFlushInterval = time.Second
+	accessLogRotateLayout  = "20060102-150405.000"
+)
+
+var (
+	accessLog *accessLogger
+
+	accessLogDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Subsystem: prometheusSubsystem,
+		Name:      "access_log_dropped_total",
+	})
+)
+
+func init() {
+	if !config.Enable {
+		return
+	}
+
+	var err error
+	accessLog, err = setupAccessLog()
+	if err != nil {
+		slog.Error("failed to setup access log",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if accessLog != nil {
+		hooks.SetBeforeInitialize(accessLog.rotate)
+	}
+}
+
+func setupAccessLog() (*accessLogger, error) {
+	path, ok := os.LookupEnv("ACCESS_LOG")
+	if !ok {
+		return nil, nil
+	}
+
+	format, ok := os.LookupEnv("ACCESS_LOG_FORMAT")
+	if !ok {
+		format = accessLogFormatLTSV
+	}
+	if format != accessLogFormatLTSV && format != accessLogFormatJSON {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT(%s)", format)
+	}
+
+	bufSize := 10000
+	strBufSize, ok := os.LookupEnv("ACCESS_LOG_BUFFER")
+	if ok {
+		var err error
+		bufSize, err = strconv.Atoi(strBufSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ACCESS_LOG_BUFFER(%s): %w", strBufSize, err)
+		}
+		if bufSize <= 0 {
+			return nil, fmt.Errorf("invalid ACCESS_LOG_BUFFER(%s): must be positive", strBufSize)
+		}
+	}
+
+	return newAccessLogger(path, format, bufSize)
+}
+
+type accessLogEntry struct {
+	time    time.Time
+	method  string
+	route   string
+	uri     string
+	status  int
+	reqSize float64
+	// resSize サイズがわからない場合は負の値
+	resSize float64
+	reqTime time.Duration
+	dbTime  time.Duration
+}
+
+func writeAccessLog(o *observation, statusCode int, resSize float64, elapsed time.Duration) {
+	if accessLog == nil {
+		return
+	}
+
+	accessLog.write(accessLogEntry{
+		time:    o.start,
+		method:  o.method,
+		route:   o.route,
+		uri:     o.uri,
+		status:  statusCode,
+		reqSize: o.reqSize,
+		resSize: resSize,
+		reqTime: elapsed,
+		dbTime:  o.stat.DBTime(),
+	})
+}
+
+// accessLogger ファイルへの書き込みは1つのgoroutineで行い、リクエストの処理を待たせない
+type accessLogger struct {
+	path    string
+	format  string
+	entries chan accessLogEntry
+	rotates chan chan struct{}
+}
+
+func newAccessLogger(path, format string, bufSize int) (*accessLogger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+
+	l := &accessLogger{
+		path:    path,
+		format:  format,
+		entries: make(chan accessLogEntry, bufSize),
+		rotates: make(chan chan struct{}),
+	}
+	go l.run(f)
+
+	return l, nil
+}
+
+// write バッファが溢れている場合は、待たずにログを捨てる
+func (l *accessLogger) write(entry accessLogEntry) {
+	select {
+	case l.entries <- entry:
+	default:
+		accessLogDroppedCounter.Inc()
+	}
+}
+
+// rotate 呼び出し前に書き込まれたログが移し終わるまで待つ
+func (l *accessLogger) rotate() {
+	done := make(chan struct{})
+	l.rotates <- done
+	<-done
+}
+
+func (l *accessLogger) run(f *os.File) {
+	w := bufio.NewWriter(f)
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+
+	var buf []byte
+	writeEntry := func(entry accessLogEntry) {
+		buf = l.appendEntry(buf[:0], entry)
+		_, err := w.Write(buf)
+		if err != nil {
+			slog.Error("failed to write access log",
+				slog.String("path", l.path),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	for {
+		select {
+		case entry := <-l.entries:
+			writeEntry(entry)
+		case <-ticker.C:
+			err := w.Flush()
+			if err != nil {
+				slog.Error("failed to flush access log",
+					slog.String("path", l.path),
+					slog.String("error", err.Error()),
+				)
+			}
+		case done := <-l.rotates:
+			for len(l.entries) > 0 {
+				writeEntry(<-l.entries)
+			}
+
+			newF, err := l.reopen(f, w)
+			if err != nil {
+				slog.Error("failed to rotate access log",
+					slog.String("path", l.path),
+					slog.String("error", err.Error()),
+				)
+			} else {
+				f = newF
+				w.Reset(f)
+			}
+
+			close(done)
+		}
+	}
+}
+
+// reopen 空のファイルは移さずにそのまま使う
+func (l *accessLogger) reopen(f *os.File, w *bufio.Writer) (*os.File, error) {
+	err := w.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to flush: %w", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat: %w", err)
+	}
+	if stat.Size() == 0 {
+		return f, nil
+	}
+
+	rotatedPath := l.path + "." + time.Now().Format(accessLogRotateLayout)
+	err = os.Rename(l.path, rotatedPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rename to %s: %w", rotatedPath, err)
+	}
+
+	newF, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		slog.Error("failed to close rotated access log",
+			slog.String("path", rotatedPath),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return newF, nil
+}
+
+type accessLogJSON struct {
+	Time         string  `json:"time"`
+	Method       string  `json:"method"`
+	Route        string  `json:"route"`
+	URI          string  `json:"uri"`
+	Status       int     `json:"status"`
+	RequestBytes float64 `json:"request_bytes"`
+	BodyBytes    float64 `json:"body_bytes"`
+	RequestTime  float64 `json:"request_time"`
+	ResponseTime float64 `json:"response_time"`
+	DBTime       float64 `json:"db_time"`
+}
+
+// appendEntry 1行分のログをbufに追加する
+// サイズがわからない場合、alpで読めるよう0を出力する
+func (l *accessLogger) appendEntry(buf []byte, entry accessLogEntry) []byte {
+	resSize := max(entry.resSize, 0)
+
+	if l.format == accessLogFormatJSON {
+		b, err := json.Marshal(accessLogJSON{
+			Time:         entry.time.Format(time.RFC3339),
+			Method:       entry.method,
+			Route:        entry.route,
+			URI:          entry.uri,
+			Status:       entry.status,
+			RequestBytes: entry.reqSize,
+			BodyBytes:    resSize,
+			RequestTime:  entry.reqTime.Seconds(),
+			ResponseTime: entry.reqTime.Seconds(),
+			DBTime:       entry.dbTime.Seconds(),
+		})
+		if err != nil {
+			return buf
+		}
+
+		buf = append(buf, b...)
+		return append(buf, '\n')
+	}
+
+	buf = append(buf, "time:"...)
+	buf = entry.time.AppendFormat(buf, time.RFC3339)
+	buf = append(buf, "\tmethod:"...)
+	buf = append(buf, ltsvValue(entry.method)...)
+	buf = append(buf, "\troute:"...)
+	buf = append(buf, ltsvValue(entry.route)...)
+	buf = append(buf, "\turi:"...)
+	buf = append(buf, ltsvValue(entry.uri)...)
+	buf = append(buf, "\tstatus:"...)
+	buf = strconv.AppendInt(buf, int64(entry.status), 10)
+	buf = append(buf, "\treqsize:"...)
+	buf = strconv.AppendFloat(buf, entry.reqSize, 'f', -1, 64)
+	buf = append(buf, "\tsize:"...)
+	buf = strconv.AppendFloat(buf, resSize, 'f', -1, 64)
+	buf = append(buf, "\treqtime:"...)
+	buf = strconv.AppendFloat(buf, entry.reqTime.Seconds(), 'f', 6, 64)
+	buf = append(buf, "\tapptime:"...)
+	buf = strconv.AppendFloat(buf, entry.reqTime.Seconds(), 'f', 6, 64)
+	buf = append(buf, "\tdbtime:"...)
+	buf = strconv.AppendFloat(buf, entry.dbTime.Seconds(), 'f', 6, 64)
+
+	return append(buf, '\n')
+}
+
+var ltsvReplacer = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// ltsvValue LTSVの区切り文字を値に含めない
+func ltsvValue(s string) string {
+	return ltsvReplacer.Replace(s)
+}
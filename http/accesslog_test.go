@@ -0,0 +1,189 @@
+package isuhttp
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+func TestAccessLogAppendEntry(t *testing.T) {
+	t.Parallel()
+
+	entryTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		format      string
+		entry       accessLogEntry
+		expected    string
+	}{
+		{
+			description: "ltsv",
+			format:      accessLogFormatLTSV,
+			entry: accessLogEntry{
+				time:    entryTime,
+				method:  "GET",
+				route:   "/users/:id",
+				uri:     "/users/1?q=a",
+				status:  200,
+				reqSize: 120,
+				resSize: 512,
+				reqTime: 12500 * time.Microsecond,
+				dbTime:  3 * time.Millisecond,
+			},
+			expected: "time:2024-01-02T03:04:05Z\tmethod:GET\troute:/users/:id\turi:/users/1?q=a\tstatus:200\treqsize:120\tsize:512\treqtime:0.012500\tapptime:0.012500\tdbtime:0.003000\n",
+		},
+		{
+			description: "ltsv unknown size and tab in uri",
+			format:      accessLogFormatLTSV,
+			entry: accessLogEntry{
+				time:    entryTime,
+				method:  "GET",
+				route:   "/stream",
+				uri:     "/stream?q=a\tb",
+				status:  200,
+				resSize: -1,
+			},
+			expected: "time:2024-01-02T03:04:05Z\tmethod:GET\troute:/stream\turi:/stream?q=a b\tstatus:200\treqsize:0\tsize:0\treqtime:0.000000\tapptime:0.000000\tdbtime:0.000000\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			l := &accessLogger{format: test.format}
+			actual := string(l.appendEntry(nil, test.entry))
+			if actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAccessLogAppendEntryJSON(t *testing.T) {
+	t.Parallel()
+
+	l := &accessLogger{format: accessLogFormatJSON}
+	line := l.appendEntry(nil, accessLogEntry{
+		time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		method:  "POST",
+		route:   "/users",
+		uri:     "/users",
+		status:  201,
+		resSize: 10,
+		reqTime: 500 * time.Millisecond,
+		dbTime:  100 * time.Millisecond,
+	})
+
+	if !strings.HasSuffix(string(line), "\n") {
+		t.Errorf("expected newline at the end, got %q", line)
+	}
+
+	var actual accessLogJSON
+	err := json.Unmarshal(line, &actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := accessLogJSON{
+		Time:         "2024-01-02T03:04:05Z",
+		Method:       "POST",
+		Route:        "/users",
+		URI:          "/users",
+		Status:       201,
+		BodyBytes:    10,
+		RequestTime:  0.5,
+		ResponseTime: 0.5,
+		DBTime:       0.1,
+	}
+	if actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLogger(path, accessLogFormatLTSV, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 空のファイルはローテートしない
+	l.rotate()
+
+	l.write(accessLogEntry{method: "GET", route: "/before", status: 200})
+	l.rotate()
+	// ローテート先のファイル名はミリ秒単位の時刻なので、重ならないようにする
+	time.Sleep(2 * time.Millisecond)
+	l.write(accessLogEntry{method: "GET", route: "/after", status: 200})
+	l.rotate()
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(rotated)
+
+	expected := []string{"route:/before", "route:/after"}
+	if len(rotated) != len(expected) {
+		t.Fatalf("expected %d rotated files, got %d", len(expected), len(rotated))
+	}
+
+	for i, name := range rotated {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lines := strings.Count(string(b), "\n"); lines != 1 {
+			t.Errorf("%s: expected 1 line, got %d", name, lines)
+		}
+		if !strings.Contains(string(b), expected[i]) {
+			t.Errorf("%s: expected %s, got %q", name, expected[i], b)
+		}
+	}
+}
+
+// TestSetupAccessLogBuffer 環境変数を書き換えるので、並行に実行しない
+func TestSetupAccessLogBuffer(t *testing.T) {
+	tests := []struct {
+		description string
+		buffer      string
+		isErr       bool
+	}{
+		{description: "valid", buffer: "100"},
+		{description: "zero", buffer: "0", isErr: true},
+		{description: "negative", buffer: "-1", isErr: true},
+		{description: "not a number", buffer: "many", isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Setenv("ACCESS_LOG", filepath.Join(t.TempDir(), "access.log"))
+			t.Setenv("ACCESS_LOG_BUFFER", test.buffer)
+
+			l, err := setupAccessLog()
+			if test.isErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cap(l.entries) != 100 {
+				t.Errorf("expected buffer 100, got %d", cap(l.entries))
+			}
+		})
+	}
+}
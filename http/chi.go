@@ -0,0 +1,48 @@
+package isuhttp
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+)
+
+func ChiNew(r *chi.Mux) *chi.Mux {
+	if config.Enable {
+		r.Use(ChiMetricsMiddleware(r))
+		measuredRouters.Store(r, struct{}{})
+	}
+
+	return r
+}
+
+// ChiMetricsMiddleware r.Useで登録するミドルウェア
+// rにはミドルウェアを登録するルーターを渡す
+func ChiMetricsMiddleware(r *chi.Mux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return routeMetricsMiddleware(next, func(req *http.Request) string {
+			return chiRoutePattern(r, req)
+		})
+	}
+}
+
+func chiRoutePattern(r *chi.Mux, req *http.Request) string {
+	if path := req.Header.Get(pathHeader); path != "" {
+		return path
+	}
+
+	// ルーティング済みであれば、マッチしたルートのテンプレートを使う
+	if rctx := chi.RouteContext(req.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+
+	// r.Useのミドルウェアはルーティング前に呼ばれるので、ルーティングツリーから探す
+	pattern := r.Find(chi.NewRouteContext(), req.Method, req.URL.Path)
+	if pattern != "" {
+		return pattern
+	}
+
+	return FilterFunc(req.URL.Path)
+}
@@ -4,6 +4,9 @@ import (
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
 )
 
 const (
@@ -14,9 +17,16 @@ const (
 
 var (
 	newTransport *http.Transport
+	// measuredNewTransport http.DefaultTransportを*http.Transportとして扱うコードがあるため、
+	// DefaultTransportは置き換えず、http.DefaultClientとClientSettingで設定したクライアントで使う
+	measuredNewTransport http.RoundTripper
 )
 
 func init() {
+	if !config.Tweak(config.TweakHTTPTransport) {
+		return
+	}
+
 	defaultTransport, ok := http.DefaultTransport.(*http.Transport)
 	if !ok {
 		return
@@ -31,12 +41,35 @@ func init() {
 	}).DialContext
 
 	http.DefaultTransport = newTransport
+
+	measuredNewTransport = &measuredTransport{Transport: newTransport}
+	if http.DefaultClient.Transport == nil {
+		http.DefaultClient.Transport = measuredNewTransport
+	}
+}
+
+// measuredTransport リクエストの処理中に外部へ送ったHTTPリクエストの時間を、元のリクエストの集計に加える
+// 時間はレスポンスヘッダーを受け取るまでで、ボディの読み込みは含まない
+// 計測されるのはhttp.DefaultClientとClientSettingを通したクライアントのみで、
+// Transportが未設定の&http.Client{}やhttp.DefaultTransportを直接使うリクエストは計測されない
+type measuredTransport struct {
+	*http.Transport
+}
+
+func (t *measuredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.Transport.RoundTrip(req)
+	reqstat.AddHTTP(req.Context(), time.Since(start))
+
+	return res, err
 }
 
+// ClientSetting clientのTransportを外部へのリクエストの時間を計測するものに置き換える
+// http.DefaultClient以外のクライアントで計測する場合は、このクライアントを使う
 func ClientSetting(client *http.Client) {
 	if newTransport == nil {
 		return
 	}
 
-	client.Transport = newTransport
+	client.Transport = measuredNewTransport
 }
@@ -0,0 +1,57 @@
+package isuhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
+)
+
+func TestMeasuredTransport(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{
+		Transport: &measuredTransport{Transport: http.DefaultTransport.(*http.Transport)},
+	}
+
+	tests := []struct {
+		description string
+		inRequest   bool
+		calls       int64
+	}{
+		{description: "in request", inRequest: true, calls: 1},
+		{description: "outside request", inRequest: false, calls: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			s := &reqstat.Stat{}
+			req := httptest.NewRequest(http.MethodGet, server.URL, nil)
+			req.RequestURI = ""
+			if test.inRequest {
+				req = req.WithContext(reqstat.NewContext(req.Context(), s))
+			}
+
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if actual := s.HTTPCalls(); actual != test.calls {
+				t.Errorf("expected %d calls, got %d", test.calls, actual)
+			}
+			if test.inRequest && s.HTTPTime() <= 0 {
+				t.Errorf("expected positive http time, got %s", s.HTTPTime())
+			}
+		})
+	}
+}
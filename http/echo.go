@@ -1,18 +1,16 @@
 package isuhttp
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/labstack/echo/v4"
-	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 )
 
@@ -21,6 +19,11 @@ var (
 )
 
 func init() {
+	if !config.Tweak(config.TweakGoJSON) {
+		enableGoJson = false
+		return
+	}
+
 	strEnableGoJson, ok := os.LookupEnv("GO_JSON")
 	if !ok {
 		return
@@ -39,7 +42,9 @@ func init() {
 }
 
 func EchoSetting(e *echo.Echo) *echo.Echo {
-	e.Use(EchoMetricsMiddleware)
+	if config.Enable {
+		e.Use(EchoMetricsMiddleware)
+	}
 
 	if enableGoJson {
 		e.JSONSerializer = JSONSerializer{}
@@ -81,75 +86,40 @@ func (JSONSerializer) Deserialize(c echo.Context, i any) error {
 
 func EchoMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if !config.Enable {
+		req := c.Request()
+		o, ok := beginRequest(req.Method, req.Host, req.URL.RequestURI(), reqSize(req))
+		if !ok {
 			return next(c)
 		}
-
-		benchmark.Continue()
-
-		path := c.Path()
-		host := c.Request().Host
-		method := c.Request().Method
-
-		reqSz := reqSize(c.Request())
+		o.setRoute(c.Path())
 
 		// シナリオ解析用メトリクス
-		flowCookie, err := c.Cookie("isutools_flow")
+		var prevFlow string
+		flowCookie, err := c.Cookie(flowCookieName)
 		if err == nil {
-			flowMethod, flowPath, ok := strings.Cut(flowCookie.Value, ",")
-			if ok {
-				flowCounterVec.WithLabelValues(flowMethod, flowPath, method, path).Inc()
-			}
-		} else {
-			flowCookie = new(http.Cookie)
-			flowCookie.Name = "isutools_flow"
+			prevFlow = flowCookie.Value
 		}
-		flowCookie.Value = fmt.Sprintf("%s,%s", method, path)
-		flowCookie.Expires = time.Now().Add(1 * time.Hour)
-		c.SetCookie(flowCookie)
-
-		start := time.Now()
-		err = next(c)
-		reqDur := float64(time.Since(start)) / float64(time.Second)
-
-		// error handlerがDefaultHTTPErrorHandlerでない場合、正しくない可能性あり
-		var (
-			statusCode   int
-			validResSize = true
-			resSize      float64
-		)
-		if c.Response().Committed || err == nil {
-			statusCode = c.Response().Status
-			resSize = float64(c.Response().Size)
-		} else {
-			var httpError *echo.HTTPError
-			if errors.As(err, &httpError) {
-				statusCode = httpError.Code
-			} else {
-				statusCode = http.StatusInternalServerError
-			}
-
-			if method == http.MethodHead {
-				resSize = 0
-			} else {
-				/*
-					実際には*echo.HTTPErrorがjson encodeされたものになるが、
-					速度低下が許容量を超えるので妥協する
-					ErrorHandlerをいい感じにいじれば解決しそう
-				*/
-				validResSize = false
-			}
+		c.SetCookie(&http.Cookie{
+			Name:     flowCookieName,
+			Value:    o.flow(prevFlow),
+			Path:     "/",
+			Expires:  time.Now().Add(flowCookieMaxAge),
+			HttpOnly: true,
+		})
+
+		o.serve(req.Context(), func(ctx context.Context) {
+			c.SetRequest(c.Request().WithContext(ctx))
+			err = next(c)
+		})
+		// 実際に返したステータスコード、サイズを記録するため、ここでエラーハンドラーを呼んでレスポンスを確定させる
+		// 外側のミドルウェアでもエラーを扱えるよう、エラーはそのまま返す
+		// (DefaultHTTPErrorHandlerはレスポンスが確定済みの場合は何もしない)
+		if err != nil {
+			c.Error(err)
 		}
-		strStatusCode := strconv.Itoa(statusCode)
 
-		reqSizeHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(reqSz)
-		reqDurHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(reqDur)
-		reqCounterVec.WithLabelValues(strStatusCode, method, host, path).Inc()
-
-		if validResSize {
-			resSizeHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(resSize)
-		}
+		o.finish(c.Response().Status, float64(c.Response().Size))
 
-		return nil
+		return err
 	}
 }
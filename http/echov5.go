@@ -0,0 +1,117 @@
+package isuhttp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/goccy/go-json"
+	echov5 "github.com/labstack/echo/v5"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+)
+
+func EchoV5Setting(e *echov5.Echo) *echov5.Echo {
+	if config.Enable {
+		e.Use(EchoV5MetricsMiddleware)
+	}
+
+	if enableGoJson {
+		e.JSONSerializer = EchoV5JSONSerializer{}
+	}
+
+	return e
+}
+
+// EchoV5Start echo v5ではEchoにListenerを設定できないので、e.Startを置き換えてListenerを渡す
+func EchoV5Start(e *echov5.Echo, address string) error {
+	sc := echov5.StartConfig{Address: address}
+
+	listener, ok, err := newUnixDomainSockListener()
+	if err != nil {
+		slog.Error("failed to create unix domain socket listener",
+			slog.String("error", err.Error()),
+		)
+	}
+
+	if ok {
+		sc.Listener = listener
+	}
+
+	// e.Startと同様に、SIGINT, SIGTERMでgraceful shutdownする
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return sc.Start(ctx, e)
+}
+
+type EchoV5JSONSerializer struct{}
+
+func (EchoV5JSONSerializer) Serialize(c *echov5.Context, i any, indent string) error {
+	enc := json.NewEncoder(c.Response())
+	return enc.Encode(i)
+}
+
+func (EchoV5JSONSerializer) Deserialize(c *echov5.Context, i any) error {
+	err := json.NewDecoder(c.Request().Body).Decode(i)
+
+	switch err := err.(type) {
+	case *json.UnmarshalTypeError:
+		return echov5.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unmarshal type error: expected=%v, got=%v, field=%v, offset=%v", err.Type, err.Value, err.Field, err.Offset)).Wrap(err)
+	case *json.SyntaxError:
+		return echov5.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Syntax error: offset=%v, error=%v", err.Offset, err.Error())).Wrap(err)
+	}
+
+	return err
+}
+
+func EchoV5MetricsMiddleware(next echov5.HandlerFunc) echov5.HandlerFunc {
+	return func(c *echov5.Context) error {
+		req := c.Request()
+		o, ok := beginRequest(req.Method, req.Host, req.URL.RequestURI(), reqSize(req))
+		if !ok {
+			return next(c)
+		}
+		o.setRoute(c.Path())
+
+		// シナリオ解析用メトリクス
+		var prevFlow string
+		flowCookie, err := c.Cookie(flowCookieName)
+		if err == nil {
+			prevFlow = flowCookie.Value
+		}
+		c.SetCookie(&http.Cookie{
+			Name:     flowCookieName,
+			Value:    o.flow(prevFlow),
+			Path:     "/",
+			Expires:  time.Now().Add(flowCookieMaxAge),
+			HttpOnly: true,
+		})
+
+		o.serve(req.Context(), func(ctx context.Context) {
+			c.SetRequest(c.Request().WithContext(ctx))
+			err = next(c)
+		})
+		// 実際に返したステータスコード、サイズを記録するため、ここでエラーハンドラーを呼ぶ
+		if err != nil {
+			c.Echo().HTTPErrorHandler(c, err)
+		}
+
+		// echo v5のc.Response()はhttp.ResponseWriterなので、echoのResponseを取り出す
+		res, err := echov5.UnwrapResponse(c.Response())
+		if err != nil {
+			slog.Error("failed to unwrap echo response",
+				slog.String("error", err.Error()),
+			)
+			return nil
+		}
+
+		o.finish(res.Status, float64(res.Size))
+
+		return nil
+	}
+}
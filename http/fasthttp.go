@@ -1,13 +1,11 @@
 package isuhttp
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
+	"context"
 	"time"
 
-	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
 	"github.com/valyala/fasthttp"
 )
 
@@ -91,42 +89,28 @@ func FastServerListenAndServeTLSEmbed(server *fasthttp.Server, addr string, cert
 
 func FastMetricsMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
-		if !config.Enable {
+		o, ok := beginRequest(string(ctx.Method()), string(ctx.Host()), string(ctx.RequestURI()), fastHTTPReqSize(&ctx.Request))
+		if !ok {
 			next(ctx)
 			return
 		}
-
-		benchmark.Continue()
-
-		path := FilterFunc(string(ctx.Path()))
-		host := string(ctx.Host())
-		method := string(ctx.Method())
-
-		reqSz := fastHTTPReqSize(&ctx.Request)
+		o.setRoute(FilterFunc(string(ctx.Path())))
 
 		// シナリオ解析用メトリクス
-		flowCookieValue := ctx.Request.Header.Cookie("isutools_flow")
-		if flowCookieValue != nil {
-			flowMethod, flowPath, ok := strings.Cut(string(flowCookieValue), ",")
-			if ok {
-				flowCounterVec.WithLabelValues(flowMethod, flowPath, method, path).Inc()
-			}
-		}
 		flowCookie := new(fasthttp.Cookie)
-		flowCookie.SetKey("isutools_flow")
-		flowCookie.SetValue(fmt.Sprintf("%s,%s", method, path))
-		flowCookie.SetExpire(time.Now().Add(1 * time.Hour))
+		flowCookie.SetKey(flowCookieName)
+		flowCookie.SetValue(o.flow(string(ctx.Request.Header.Cookie(flowCookieName))))
+		flowCookie.SetPath("/")
+		flowCookie.SetExpire(time.Now().Add(flowCookieMaxAge))
+		flowCookie.SetHTTPOnly(true)
 		ctx.Response.Header.SetCookie(flowCookie)
 
-		start := time.Now()
-		next(ctx)
-		reqDur := float64(time.Since(start)) / float64(time.Second)
-
-		statusCode := strconv.Itoa(ctx.Response.StatusCode())
+		// ハンドラーはRequestCtxをcontextとして使うので、UserValueに設定する
+		ctx.SetUserValue(reqstat.Key, o.stat)
+		o.serve(context.Background(), func(context.Context) {
+			next(ctx)
+		})
 
-		reqSizeHistogramVec.WithLabelValues(statusCode, method, path).Observe(reqSz)
-		reqDurHistogramVec.WithLabelValues(statusCode, method, path).Observe(reqDur)
-		reqCounterVec.WithLabelValues(statusCode, method, host, path).Inc()
-		resSizeHistogramVec.WithLabelValues(statusCode, method, path).Observe(float64(ctx.Response.Header.ContentLength()))
+		o.finish(ctx.Response.StatusCode(), fastHTTPResSize(&ctx.Response))
 	})
 }
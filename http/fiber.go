@@ -1,18 +1,14 @@
 package isuhttp
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"log/slog"
-	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
-	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
 )
 
 func FiberNew(conf ...fiber.Config) *fiber.App {
@@ -31,7 +27,9 @@ func FiberNew(conf ...fiber.Config) *fiber.App {
 	}
 
 	app := fiber.New(conf...)
-	app.Use(FiberMetricsMiddleware)
+	if config.Enable {
+		app.Use(FiberMetricsMiddleware(fiberNext))
+	}
 
 	listener, ok, err := newUnixDomainSockListener()
 	if err != nil {
@@ -52,67 +50,53 @@ func FiberNew(conf ...fiber.Config) *fiber.App {
 	return app
 }
 
+// FiberMetricsMiddleware nextを計測するハンドラーを返す
+// app.Useで全体に登録する場合は、c.Nextを呼ぶハンドラーをnextとして渡す
 func FiberMetricsMiddleware(next fiber.Handler) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		if !config.Enable {
+		o, ok := beginRequest(c.Method(), c.Hostname(), c.OriginalURL(), fastHTTPReqSize(c.Request()))
+		if !ok {
 			return next(c)
 		}
+		// app.Useのミドルウェアでのc.Route()はミドルウェア自体のルートなので、
+		// ハンドラーの実行前はパスで代用し、実行後にルートで置き換える
+		o.setRoute(FilterFunc(c.Path()))
 
-		benchmark.Continue()
-
-		path := c.Route().Path
-		host := c.Hostname()
-		method := c.Method()
+		// c.Context()のRequestCtxをcontextとして使った場合にも集計できるよう、UserValueにも設定する
+		c.Context().SetUserValue(reqstat.Key, o.stat)
 
-		reqSz := fastHTTPReqSize(c.Request())
+		var err error
+		o.serve(c.UserContext(), func(ctx context.Context) {
+			c.SetUserContext(ctx)
+			err = next(c)
+		})
+		o.setRoute(c.Route().Path)
 
 		// シナリオ解析用メトリクス
-		flowCookieValue := c.Cookies("isutools_flow")
-		if flowCookieValue != "" {
-			flowMethod, flowPath, ok := strings.Cut(flowCookieValue, ",")
-			if ok {
-				flowCounterVec.WithLabelValues(flowMethod, flowPath, method, path).Inc()
-			}
-		}
-		flowCookie := new(fiber.Cookie)
-		flowCookie.Name = "isutools_flow"
-		flowCookie.Value = fmt.Sprintf("%s,%s", method, path)
-		flowCookie.Expires = time.Now().Add(1 * time.Hour)
-		c.Cookie(flowCookie)
-
-		start := time.Now()
-		err := next(c)
-		reqDur := float64(time.Since(start)) / float64(time.Second)
-
-		// error handlerがDefaultHTTPErrorHandlerでない場合、正しくない可能性あり
-		var (
-			statusCode int
-			resSize    float64
-		)
-		if err == nil {
-			statusCode = c.Response().StatusCode()
-			resSize = float64(c.Response().Header.ContentLength())
-		} else {
-			var httpError *fiber.Error
-			if errors.As(err, &httpError) {
-				statusCode = httpError.Code
-			} else {
-				statusCode = fiber.StatusInternalServerError
-			}
-
-			if method == http.MethodHead {
-				resSize = 0
-			} else {
-				resSize = float64(len(err.Error()))
+		// fasthttpはハンドラーの終了後にレスポンスを書き込むので、ここで設定しても間に合う
+		c.Cookie(&fiber.Cookie{
+			Name:     flowCookieName,
+			Value:    o.flow(c.Cookies(flowCookieName)),
+			Path:     "/",
+			Expires:  time.Now().Add(flowCookieMaxAge),
+			HTTPOnly: true,
+		})
+
+		// 実際に返したステータスコード、サイズを記録するため、ここでエラーハンドラーを呼ぶ
+		if err != nil {
+			err = c.App().ErrorHandler(c, err)
+			if err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
 			}
 		}
-		strStatusCode := strconv.Itoa(statusCode)
 
-		reqSizeHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(reqSz)
-		reqDurHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(reqDur)
-		reqCounterVec.WithLabelValues(strStatusCode, method, host, path).Inc()
-		resSizeHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(resSize)
+		o.finish(c.Response().StatusCode(), fastHTTPResSize(c.Response()))
 
 		return nil
 	}
 }
+
+// fiberNext app.Useで登録したFiberMetricsMiddlewareから後続のハンドラーを呼ぶ
+func fiberNext(c *fiber.Ctx) error {
+	return c.Next()
+}
@@ -0,0 +1,93 @@
+package isuhttp
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/goccy/go-json"
+	fiberv3 "github.com/gofiber/fiber/v3"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
+)
+
+func FiberV3New(conf ...fiberv3.Config) *fiberv3.App {
+	if enableGoJson {
+		if len(conf) == 0 {
+			conf = []fiberv3.Config{
+				{
+					JSONEncoder: json.Marshal,
+					JSONDecoder: json.Unmarshal,
+				},
+			}
+		} else {
+			conf[0].JSONEncoder = json.Marshal
+			conf[0].JSONDecoder = json.Unmarshal
+		}
+	}
+
+	app := fiberv3.New(conf...)
+	if config.Enable {
+		app.Use(FiberV3MetricsMiddleware)
+	}
+
+	return app
+}
+
+// FiberV3Listen fiber v3のapp.Listenはサーバーの起動まで行うので、app.Listenを置き換えてListenerを渡す
+func FiberV3Listen(app *fiberv3.App, addr string, conf ...fiberv3.ListenConfig) error {
+	listener, ok, err := newUnixDomainSockListener()
+	if err != nil {
+		slog.Error("failed to create unix domain socket listener",
+			slog.String("error", err.Error()),
+		)
+	}
+
+	if ok {
+		return app.Listener(listener, conf...)
+	}
+
+	return app.Listen(addr, conf...)
+}
+
+// FiberV3MetricsMiddleware app.Useで登録するミドルウェア
+func FiberV3MetricsMiddleware(c fiberv3.Ctx) error {
+	o, ok := beginRequest(c.Method(), c.Hostname(), c.OriginalURL(), fastHTTPReqSize(c.Request()))
+	if !ok {
+		return c.Next()
+	}
+	// app.Useのミドルウェアでのc.Route()はミドルウェア自体のルートなので、
+	// ハンドラーの実行前はパスで代用し、実行後にルートで置き換える
+	o.setRoute(FilterFunc(c.Path()))
+
+	// cをそのままcontextとして使った場合にも集計できるよう、UserValueにも設定する
+	c.RequestCtx().SetUserValue(reqstat.Key, o.stat)
+
+	var err error
+	o.serve(c.Context(), func(ctx context.Context) {
+		c.SetContext(ctx)
+		err = c.Next()
+	})
+	o.setRoute(c.Route().Path)
+
+	// シナリオ解析用メトリクス
+	c.Cookie(&fiberv3.Cookie{
+		Name:     flowCookieName,
+		Value:    o.flow(c.Cookies(flowCookieName)),
+		Path:     "/",
+		Expires:  time.Now().Add(flowCookieMaxAge),
+		HTTPOnly: true,
+	})
+
+	// 実際に返したステータスコード、サイズを記録するため、ここでエラーハンドラーを呼ぶ
+	if err != nil {
+		err = c.App().ErrorHandler(c, err)
+		if err != nil {
+			_ = c.SendStatus(fiberv3.StatusInternalServerError)
+		}
+	}
+
+	o.finish(c.Response().StatusCode(), fastHTTPResSize(c.Response()))
+
+	return nil
+}
@@ -1,19 +1,18 @@
 package isuhttp
 
 import (
-	"fmt"
+	"context"
 	"log/slog"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 )
 
 func GinNew(engine *gin.Engine) *gin.Engine {
-	engine.Use(GinMetricsMiddleware)
+	if config.Enable {
+		engine.Use(GinMetricsMiddleware)
+	}
 
 	return engine
 }
@@ -50,40 +49,22 @@ func GinRunTLS(engine *gin.Engine, addr, certFile, keyFile string) error {
 }
 
 func GinMetricsMiddleware(c *gin.Context) {
-	if !config.Enable {
+	o, ok := beginRequest(c.Request.Method, c.Request.Host, c.Request.URL.RequestURI(), reqSize(c.Request))
+	if !ok {
 		c.Next()
 		return
 	}
-
-	benchmark.Continue()
-
-	path := c.FullPath()
-	host := c.Request.Host
-	method := c.Request.Method
-
-	reqSz := reqSize(c.Request)
+	o.setRoute(c.FullPath())
 
 	// シナリオ解析用メトリクス
-	flowCookieValue, err := c.Cookie("isutools_flow")
-	if err == nil {
-		flowMethod, flowPath, ok := strings.Cut(flowCookieValue, ",")
-		if ok {
-			flowCounterVec.WithLabelValues(flowMethod, flowPath, method, path).Inc()
-		}
-	}
-	c.SetCookie("isutools_flow", fmt.Sprintf("%s,%s", method, path), int(1*time.Hour), "", "", false, true)
-
-	start := time.Now()
-	c.Next()
-	reqDur := float64(time.Since(start)) / float64(time.Second)
+	prevFlow, _ := c.Cookie(flowCookieName)
+	c.SetCookie(flowCookieName, o.flow(prevFlow), int(flowCookieMaxAge/time.Second), "/", "", false, true)
 
-	statusCode := c.Writer.Status()
-	resSize := c.Writer.Size()
-
-	strStatusCode := strconv.Itoa(statusCode)
+	o.serve(c.Request.Context(), func(ctx context.Context) {
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	})
 
-	reqSizeHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(reqSz)
-	reqDurHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(reqDur)
-	reqCounterVec.WithLabelValues(strStatusCode, method, host, path).Inc()
-	resSizeHistogramVec.WithLabelValues(strStatusCode, method, path).Observe(float64(resSize))
+	// 何も書き込まれていない場合、Sizeは-1になる
+	o.finish(c.Writer.Status(), float64(max(c.Writer.Size(), 0)))
 }
@@ -0,0 +1,39 @@
+package isuhttp
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+)
+
+// GorillaNew gorilla/muxのミドルウェアはルートにマッチした場合のみ呼ばれるので、
+// 404などルートにマッチしなかったリクエストは計測されない
+func GorillaNew(r *mux.Router) *mux.Router {
+	if config.Enable {
+		r.Use(GorillaMetricsMiddleware)
+		measuredRouters.Store(r, struct{}{})
+	}
+
+	return r
+}
+
+// GorillaMetricsMiddleware r.Useで登録するミドルウェア
+func GorillaMetricsMiddleware(next http.Handler) http.Handler {
+	return routeMetricsMiddleware(next, gorillaRoutePattern)
+}
+
+func gorillaRoutePattern(req *http.Request) string {
+	if path := req.Header.Get(pathHeader); path != "" {
+		return path
+	}
+
+	if route := mux.CurrentRoute(req); route != nil {
+		pattern, err := route.GetPathTemplate()
+		if err == nil {
+			return pattern
+		}
+	}
+
+	return FilterFunc(req.URL.Path)
+}
@@ -2,17 +2,19 @@ package isuhttp
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/mux"
 	isuhttpgen "github.com/mazrean/isucon-go-tools/v2/http/internal/generate"
-	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 )
 
@@ -138,11 +140,26 @@ func (r *responseWriterWithMetrics) ReadFrom(src io.Reader) (int64, error) {
 }
 
 func StdMetricsMiddleware(next http.Handler) http.Handler {
+	switch next.(type) {
 	// ServeMuxの場合はラップ済みなのでそのまま返す
-	if _, ok := next.(*http.ServeMux); ok {
+	case *http.ServeMux:
 		return next
+	// ChiNew, GorillaNewでミドルウェアを登録済みのルーターは二重に計測しない
+	case *chi.Mux, *mux.Router:
+		if _, ok := measuredRouters.Load(next); ok {
+			return next
+		}
 	}
 
+	return routeMetricsMiddleware(next, getPath)
+}
+
+// measuredRouters ミドルウェアを登録済みのルーター
+var measuredRouters = sync.Map{}
+
+// routeMetricsMiddleware net/http互換のルーター向けのミドルウェア
+// routeはハンドラーの実行前後に呼ばれ、実行後の値でメトリクスを記録する
+func routeMetricsMiddleware(next http.Handler, route func(req *http.Request) string) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		defer func() {
 			err := recover()
@@ -157,12 +174,26 @@ func StdMetricsMiddleware(next http.Handler) http.Handler {
 			}
 		}()
 
-		if !config.Enable {
+		o, ok := beginRequest(req.Method, req.Host, req.URL.RequestURI(), reqSize(req))
+		if !ok {
 			next.ServeHTTP(res, req)
 			return
 		}
+		o.setRoute(route(req))
 
-		benchmark.Continue()
+		// シナリオ解析用メトリクス
+		var prevFlow string
+		flowCookie, err := req.Cookie(flowCookieName)
+		if err == nil {
+			prevFlow = flowCookie.Value
+		}
+		http.SetCookie(res, &http.Cookie{
+			Name:     flowCookieName,
+			Value:    o.flow(prevFlow),
+			Path:     "/",
+			Expires:  time.Now().Add(flowCookieMaxAge),
+			HttpOnly: true,
+		})
 
 		var metrics *responseWriterMetrics
 		wrappedRes := isuhttpgen.ResponseWriterWrapper(res, func(w http.ResponseWriter) isuhttpgen.ResponseWriter {
@@ -171,43 +202,23 @@ func StdMetricsMiddleware(next http.Handler) http.Handler {
 			return rw
 		})
 
-		start := time.Now()
-		next.ServeHTTP(wrappedRes, req)
-		reqDur := float64(time.Since(start)) / float64(time.Second)
-
-		path := getPath(req)
-		host := req.Host
-		method := req.Method
-
-		reqSz := reqSize(req)
-
-		// シナリオ解析用メトリクス
-		flowCookie, err := req.Cookie("isutools_flow")
-		if err == nil {
-			flowMethod, flowPath, ok := strings.Cut(flowCookie.Value, ",")
-			if ok {
-				flowCounterVec.WithLabelValues(flowMethod, flowPath, method, path).Inc()
-			}
-		} else {
-			flowCookie = new(http.Cookie)
-			flowCookie.Name = "isutools_flow"
-		}
-		flowCookie.Value = fmt.Sprintf("%s,%s", method, path)
-		flowCookie.Expires = time.Now().Add(1 * time.Hour)
-		http.SetCookie(res, flowCookie)
-
-		statusCode := strconv.Itoa(metrics.statusCode)
+		// ハンドラー内でSetPathされた場合のパスは、ラベルとシナリオ解析には反映されない
+		o.serve(req.Context(), func(ctx context.Context) {
+			next.ServeHTTP(wrappedRes, req.WithContext(ctx))
+		})
+		o.setRoute(route(req))
 
-		reqSizeHistogramVec.WithLabelValues(statusCode, method, path).Observe(reqSz)
-		reqDurHistogramVec.WithLabelValues(statusCode, method, path).Observe(reqDur)
-		reqCounterVec.WithLabelValues(statusCode, method, host, path).Inc()
-		resSizeHistogramVec.WithLabelValues(statusCode, method, path).Observe(metrics.resSize)
+		o.finish(metrics.statusCode, metrics.resSize)
 	})
 }
 
 const pathHeader = "X-Isu-Tools-Path-12e9e167-75f7-45e8-b0c7-5e76fd2f8a09"
 
 func SetPath(req *http.Request, path string) {
+	if !config.Enable {
+		return
+	}
+
 	// ヘッダー経由でパスを渡す
 	req.Header.Set(pathHeader, path)
 }
@@ -0,0 +1,30 @@
+package isuhttp
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+)
+
+const (
+	profileLabelMethod = "method"
+	profileLabelRoute  = "route"
+	profileLabelRunID  = "run_id"
+)
+
+/*
+withProfileLabels リクエストの処理をpprofのラベル(method, route)付きで実行する
+CPUプロファイルをエンドポイントごとに絞り込めるようにするためのもの
+pyroscope-goはpprofのラベルをそのままタグとして送るため、Pyroscope上でも絞り込める
+ベンチマーク走行中はrun_idも付け、Pyroscopeから1回分のプロファイルを取り出せるようにする
+*/
+func withProfileLabels(ctx context.Context, method, route string, f func(context.Context)) {
+	labels := []string{profileLabelMethod, method, profileLabelRoute, route}
+	if id, ok := benchmark.CurrentID(); ok {
+		labels = append(labels, profileLabelRunID, strconv.Itoa(id))
+	}
+
+	pprof.Do(ctx, pprof.Labels(labels...), f)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 )
 
 var (
@@ -22,7 +24,7 @@ func SetUnix(path string) {
 }
 
 func newUnixDomainSockListener() (net.Listener, bool, error) {
-	if len(unixDomainSockPath) == 0 {
+	if len(unixDomainSockPath) == 0 || !config.Tweak(config.TweakUnixSocket) {
 		return nil, false, nil
 	}
 
@@ -0,0 +1,104 @@
+package isuhttp
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/hooks"
+	"github.com/mazrean/isucon-go-tools/v2/internal/ranking"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
+)
+
+/*
+	各フレームワークのミドルウェアで共通の計測処理
+	ミドルウェアはbeginRequest → setRoute → serve → finishの順に呼ぶ
+	フレームワークごとに異なるのは、リクエスト・レスポンスからの値の取り出し方とCookieの読み書きのみにする
+*/
+
+const (
+	flowCookieName   = "isutools_flow"
+	flowCookieMaxAge = 1 * time.Hour
+)
+
+type observation struct {
+	method  string
+	host    string
+	uri     string
+	route   string
+	reqSize float64
+	start   time.Time
+	stat    *reqstat.Stat
+}
+
+// beginRequest 計測を止めている場合はfalseを返すので、そのままハンドラーを呼ぶ
+// uriはアクセスログ用のクエリ文字列を含むURI
+func beginRequest(method, host, uri string, reqSize float64) (*observation, bool) {
+	// 計測を止めている間もベンチマークの終了時刻は記録する
+	benchmark.Continue()
+
+	if !config.Measuring() {
+		return nil, false
+	}
+
+	return &observation{
+		method:  method,
+		host:    host,
+		uri:     uri,
+		reqSize: reqSize,
+		stat:    &reqstat.Stat{},
+	}, true
+}
+
+// setRoute ルーティング後に決まるパスのテンプレートを設定する
+func (o *observation) setRoute(route string) {
+	o.route = route
+}
+
+// flow シナリオ解析用に、前回のリクエスト(Cookieの値)から今回のリクエストへの遷移を記録する
+// 返り値はレスポンスで設定するCookieの値
+func (o *observation) flow(prev string) string {
+	flowMethod, flowPath, ok := strings.Cut(prev, ",")
+	if ok {
+		flowCounterVec.WithLabelValues(flowMethod, flowPath, o.method, o.route).Inc()
+	}
+
+	return fmt.Sprintf("%s,%s", o.method, o.route)
+}
+
+// serve ハンドラーをpprofのラベル付きで実行し、処理時間を計測する
+// fに渡すcontextには、DBの処理時間などを集計するreqstat.Statが入っている
+func (o *observation) serve(ctx context.Context, f func(ctx context.Context)) {
+	o.start = time.Now()
+	withProfileLabels(reqstat.NewContext(ctx, o.stat), o.method, o.route, f)
+}
+
+// finish resSizeにはレスポンスボディの実際のサイズを渡す
+// ストリーミングなどでサイズがわからない場合は負の値を渡し、サイズのメトリクスには記録しない
+func (o *observation) finish(statusCode int, resSize float64) {
+	elapsed := time.Since(o.start)
+
+	benchmark.Observe(statusCode)
+	strStatusCode := strconv.Itoa(statusCode)
+
+	reqSizeHistogramVec.WithLabelValues(strStatusCode, o.method, o.route).Observe(o.reqSize)
+	reqDurHistogramVec.WithLabelValues(strStatusCode, o.method, o.route).Observe(elapsed.Seconds())
+	reqCounterVec.WithLabelValues(strStatusCode, o.method, o.host, o.route).Inc()
+	if resSize >= 0 {
+		resSizeHistogramVec.WithLabelValues(strStatusCode, o.method, o.route).Observe(resSize)
+	}
+
+	// リクエスト中に発行したクエリ、外部へのHTTPリクエストの内訳
+	reqQueriesHistogramVec.WithLabelValues(o.method, o.route).Observe(float64(o.stat.Queries()))
+	reqDBDurHistogramVec.WithLabelValues(o.method, o.route).Observe(o.stat.DBTime().Seconds())
+	reqExternalDurHistogramVec.WithLabelValues(o.method, o.route).Observe(o.stat.HTTPTime().Seconds())
+	reqstat.Record(o.method, o.route, o.stat)
+
+	hooks.SlowRequest(o.method, o.route, elapsed)
+	ranking.Observe(o.method, o.route, statusCode, elapsed, resSize)
+	writeAccessLog(o, statusCode, resSize, elapsed)
+}
@@ -0,0 +1,480 @@
+package isuhttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofiber/fiber/v2"
+	fiberv3 "github.com/gofiber/fiber/v3"
+	"github.com/gorilla/mux"
+	"github.com/labstack/echo/v4"
+	echov5 "github.com/labstack/echo/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/valyala/fasthttp"
+)
+
+/*
+	全フレームワークのミドルウェアに同じシナリオを実行し、記録されるメトリクスが揃っていることを確認する
+	各アダプターは/<name>/users/:idに?kind=ok|error|streamで挙動を切り替えるハンドラーを登録する
+*/
+
+const (
+	kindOK     = "ok"
+	kindError  = "error"
+	kindStream = "stream"
+
+	okBody    = "hello"
+	errorBody = "not found"
+)
+
+var streamChunks = []string{"chunk1", "chunk2", "chunk3"}
+
+type response struct {
+	status  int
+	body    []byte
+	cookies []*http.Cookie
+}
+
+type adapter struct {
+	name  string
+	route string
+	// newServer リクエストを処理してレスポンスを返す関数を作る
+	newServer func(t *testing.T) func(req *http.Request) response
+}
+
+func recorderResponse(rec *httptest.ResponseRecorder) response {
+	res := rec.Result()
+	body, _ := io.ReadAll(res.Body)
+
+	return response{
+		status:  res.StatusCode,
+		body:    body,
+		cookies: res.Cookies(),
+	}
+}
+
+// stdHandler net/http互換のルーターで共通のハンドラー
+func stdHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("kind") {
+	case kindOK:
+		_, _ = w.Write([]byte(okBody))
+	case kindError:
+		http.Error(w, errorBody, http.StatusNotFound)
+	case kindStream:
+		for _, chunk := range streamChunks {
+			_, _ = w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+var adapters = []adapter{
+	{
+		name:  "std",
+		route: "/std/users/{id}",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			serveMux := http.NewServeMux()
+			ServerMuxHandleFunc(serveMux, "GET /std/users/{id}", stdHandler)
+
+			return func(req *http.Request) response {
+				rec := httptest.NewRecorder()
+				serveMux.ServeHTTP(rec, req)
+				return recorderResponse(rec)
+			}
+		},
+	},
+	{
+		name:  "gin",
+		route: "/gin/users/:id",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			gin.SetMode(gin.TestMode)
+			engine := GinNew(gin.New())
+			engine.GET("/gin/users/:id", func(c *gin.Context) {
+				switch c.Query("kind") {
+				case kindOK:
+					c.String(http.StatusOK, okBody)
+				case kindError:
+					c.String(http.StatusNotFound, errorBody)
+				case kindStream:
+					for _, chunk := range streamChunks {
+						_, _ = c.Writer.WriteString(chunk)
+						c.Writer.Flush()
+					}
+				}
+			})
+
+			return func(req *http.Request) response {
+				rec := httptest.NewRecorder()
+				engine.ServeHTTP(rec, req)
+				return recorderResponse(rec)
+			}
+		},
+	},
+	{
+		name:  "echo",
+		route: "/echo/users/:id",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			e := EchoSetting(echo.New())
+			e.GET("/echo/users/:id", func(c echo.Context) error {
+				switch c.QueryParam("kind") {
+				case kindOK:
+					return c.String(http.StatusOK, okBody)
+				case kindError:
+					return echo.NewHTTPError(http.StatusNotFound, errorBody)
+				case kindStream:
+					for _, chunk := range streamChunks {
+						_, err := c.Response().Write([]byte(chunk))
+						if err != nil {
+							return err
+						}
+						c.Response().Flush()
+					}
+				}
+
+				return nil
+			})
+
+			return func(req *http.Request) response {
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				return recorderResponse(rec)
+			}
+		},
+	},
+	{
+		name:  "fiber",
+		route: "/fiber/users/:id",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			app := FiberNew()
+			app.Get("/fiber/users/:id", func(c *fiber.Ctx) error {
+				switch c.Query("kind") {
+				case kindOK:
+					return c.SendString(okBody)
+				case kindError:
+					return fiber.NewError(http.StatusNotFound, errorBody)
+				case kindStream:
+					return c.SendStream(bytes.NewReader([]byte(streamChunks[0]+streamChunks[1]+streamChunks[2])), -1)
+				}
+
+				return nil
+			})
+
+			return func(req *http.Request) response {
+				res, err := app.Test(req, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+
+				body, _ := io.ReadAll(res.Body)
+
+				return response{
+					status:  res.StatusCode,
+					body:    body,
+					cookies: res.Cookies(),
+				}
+			}
+		},
+	},
+	{
+		name:  "chi",
+		route: "/chi/users/{id}",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			r := ChiNew(chi.NewRouter())
+			r.Get("/chi/users/{id}", stdHandler)
+
+			return func(req *http.Request) response {
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				return recorderResponse(rec)
+			}
+		},
+	},
+	{
+		name:  "gorilla",
+		route: "/gorilla/users/{id}",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			r := GorillaNew(mux.NewRouter())
+			r.HandleFunc("/gorilla/users/{id}", stdHandler).Methods(http.MethodGet)
+
+			return func(req *http.Request) response {
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				return recorderResponse(rec)
+			}
+		},
+	},
+	{
+		name:  "echov5",
+		route: "/echov5/users/:id",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			e := EchoV5Setting(echov5.New())
+			e.GET("/echov5/users/:id", func(c *echov5.Context) error {
+				switch c.QueryParam("kind") {
+				case kindOK:
+					return c.String(http.StatusOK, okBody)
+				case kindError:
+					return echov5.NewHTTPError(http.StatusNotFound, errorBody)
+				case kindStream:
+					for _, chunk := range streamChunks {
+						_, err := c.Response().Write([]byte(chunk))
+						if err != nil {
+							return err
+						}
+						c.Response().(http.Flusher).Flush()
+					}
+				}
+
+				return nil
+			})
+
+			return func(req *http.Request) response {
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				return recorderResponse(rec)
+			}
+		},
+	},
+	{
+		name:  "fiberv3",
+		route: "/fiberv3/users/:id",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			app := FiberV3New()
+			app.Get("/fiberv3/users/:id", func(c fiberv3.Ctx) error {
+				switch c.Query("kind") {
+				case kindOK:
+					return c.SendString(okBody)
+				case kindError:
+					return fiberv3.NewError(http.StatusNotFound, errorBody)
+				case kindStream:
+					return c.SendStream(bytes.NewReader([]byte(streamChunks[0]+streamChunks[1]+streamChunks[2])), -1)
+				}
+
+				return nil
+			})
+
+			return func(req *http.Request) response {
+				res, err := app.Test(req, fiberv3.TestConfig{Timeout: 0})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+
+				body, _ := io.ReadAll(res.Body)
+
+				return response{
+					status:  res.StatusCode,
+					body:    body,
+					cookies: res.Cookies(),
+				}
+			}
+		},
+	},
+	{
+		name:  "fasthttp",
+		route: "/fasthttp/users/<number>",
+		newServer: func(t *testing.T) func(req *http.Request) response {
+			handler := FastMetricsMiddleware(func(ctx *fasthttp.RequestCtx) {
+				switch string(ctx.QueryArgs().Peek("kind")) {
+				case kindOK:
+					ctx.SetBodyString(okBody)
+				case kindError:
+					ctx.Error(errorBody, http.StatusNotFound)
+				case kindStream:
+					ctx.SetBodyStream(bytes.NewReader([]byte(streamChunks[0]+streamChunks[1]+streamChunks[2])), -1)
+				}
+			})
+
+			return func(req *http.Request) response {
+				fastReq := &fasthttp.Request{}
+				fastReq.Header.SetMethod(req.Method)
+				fastReq.Header.SetHost(req.Host)
+				fastReq.SetRequestURI(req.URL.String())
+				for _, cookie := range req.Cookies() {
+					fastReq.Header.SetCookie(cookie.Name, cookie.Value)
+				}
+
+				ctx := &fasthttp.RequestCtx{}
+				ctx.Init(fastReq, nil, nil)
+				handler(ctx)
+
+				var cookies []*http.Cookie
+				ctx.Response.Header.VisitAllCookie(func(_, value []byte) {
+					cookie, err := http.ParseSetCookie(string(value))
+					if err == nil {
+						cookies = append(cookies, cookie)
+					}
+				})
+
+				return response{
+					status:  ctx.Response.StatusCode(),
+					body:    ctx.Response.Body(),
+					cookies: cookies,
+				}
+			}
+		},
+	},
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	err := c.Write(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+func histogramValue(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	t.Helper()
+
+	m := &dto.Metric{}
+	err := o.(prometheus.Histogram).Write(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+func TestMiddlewareObservation(t *testing.T) {
+	t.Parallel()
+
+	for _, a := range adapters {
+		t.Run(a.name, func(t *testing.T) {
+			t.Parallel()
+
+			serve := a.newServer(t)
+			path := "/" + a.name + "/users/1"
+
+			// 同じルートのメトリクスを使うため、各シナリオは順番に実行する
+			tests := []struct {
+				description string
+				kind        string
+				status      int
+				// sizeKnown falseの場合、サイズが記録されないことも許容する
+				sizeKnown bool
+			}{
+				{description: "ok", kind: kindOK, status: http.StatusOK, sizeKnown: true},
+				{description: "error", kind: kindError, status: http.StatusNotFound, sizeKnown: true},
+				{description: "stream", kind: kindStream, status: http.StatusOK},
+			}
+
+			for _, test := range tests {
+				strStatus := strconv.Itoa(test.status)
+				reqCounter := reqCounterVec.WithLabelValues(strStatus, http.MethodGet, "example.com", a.route)
+				durHistogram := reqDurHistogramVec.WithLabelValues(strStatus, http.MethodGet, a.route)
+				sizeHistogram := resSizeHistogramVec.WithLabelValues(strStatus, http.MethodGet, a.route)
+				queriesHistogram := reqQueriesHistogramVec.WithLabelValues(http.MethodGet, a.route)
+
+				beforeCount := counterValue(t, reqCounter)
+				beforeDurCount, _ := histogramValue(t, durHistogram)
+				beforeSizeCount, beforeSizeSum := histogramValue(t, sizeHistogram)
+				beforeQueriesCount, _ := histogramValue(t, queriesHistogram)
+
+				req := httptest.NewRequest(http.MethodGet, path+"?kind="+test.kind, nil)
+				res := serve(req)
+
+				if res.status != test.status {
+					t.Errorf("%s: expected status %d, got %d", test.description, test.status, res.status)
+				}
+
+				if actual := counterValue(t, reqCounter) - beforeCount; actual != 1 {
+					t.Errorf("%s: expected 1 request, got %f", test.description, actual)
+				}
+
+				if durCount, _ := histogramValue(t, durHistogram); durCount-beforeDurCount != 1 {
+					t.Errorf("%s: expected 1 duration sample, got %d", test.description, durCount-beforeDurCount)
+				}
+
+				if queriesCount, _ := histogramValue(t, queriesHistogram); queriesCount-beforeQueriesCount != 1 {
+					t.Errorf("%s: expected 1 queries sample, got %d", test.description, queriesCount-beforeQueriesCount)
+				}
+
+				sizeCount, sizeSum := histogramValue(t, sizeHistogram)
+				switch {
+				case sizeCount-beforeSizeCount == 1:
+					if actual := sizeSum - beforeSizeSum; actual != float64(len(res.body)) {
+						t.Errorf("%s: expected response size %d, got %f", test.description, len(res.body), actual)
+					}
+				case sizeCount == beforeSizeCount && !test.sizeKnown:
+				default:
+					t.Errorf("%s: expected 1 response size sample, got %d", test.description, sizeCount-beforeSizeCount)
+				}
+			}
+
+			t.Run("flow", func(t *testing.T) {
+				flowCounter := flowCounterVec.WithLabelValues(http.MethodGet, a.route, http.MethodGet, a.route)
+				before := counterValue(t, flowCounter)
+
+				res := serve(httptest.NewRequest(http.MethodGet, path+"?kind="+kindOK, nil))
+				cookie := findCookie(res.cookies, flowCookieName)
+				if cookie == nil {
+					t.Fatal("flow cookie is not set")
+				}
+				if cookie.Path != "/" {
+					t.Errorf("expected flow cookie path /, got %s", cookie.Path)
+				}
+
+				req := httptest.NewRequest(http.MethodGet, path+"?kind="+kindOK, nil)
+				req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+				serve(req)
+
+				if actual := counterValue(t, flowCounter) - before; actual != 1 {
+					t.Errorf("expected 1 flow, got %f", actual)
+				}
+			})
+		})
+	}
+}
+
+func TestEchoMetricsMiddlewareError(t *testing.T) {
+	t.Parallel()
+
+	var outerErr error
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			outerErr = next(c)
+			return outerErr
+		}
+	})
+	e.Use(EchoMetricsMiddleware)
+	e.GET("/echo-error", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound, errorBody)
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo-error", nil))
+
+	if outerErr == nil {
+		t.Error("expected error to be returned to the outer middleware")
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	// エラーハンドラーが2回呼ばれても、レスポンスは1回だけ書き込まれる
+	if expected := "{\"message\":\"" + errorBody + "\"}\n"; rec.Body.String() != expected {
+		t.Errorf("expected body %q, got %q", expected, rec.Body.String())
+	}
+}
@@ -55,6 +55,30 @@ var reqSizeHistogramVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Buckets:   reqSzBuckets,
 }, []string{"code", "method", "url"})
 
+var reqQueriesBuckets = []float64{0, 1, 2, 3, 5, 10, 20, 50, 100, 200}
+
+// reqQueriesHistogramVec 1リクエストで発行したクエリ数で、大きい値が多いルートはN+1の可能性がある
+var reqQueriesHistogramVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: prometheusNamespace,
+	Subsystem: prometheusSubsystem,
+	Name:      "request_queries",
+	Buckets:   reqQueriesBuckets,
+}, []string{"method", "url"})
+
+var reqDBDurHistogramVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: prometheusNamespace,
+	Subsystem: prometheusSubsystem,
+	Name:      "request_db_duration_seconds",
+	Buckets:   reqDurBuckets,
+}, []string{"method", "url"})
+
+var reqExternalDurHistogramVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: prometheusNamespace,
+	Subsystem: prometheusSubsystem,
+	Name:      "request_external_duration_seconds",
+	Buckets:   reqDurBuckets,
+}, []string{"method", "url"})
+
 var flowCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: prometheusNamespace,
 	Subsystem: prometheusSubsystem,
@@ -101,6 +125,16 @@ func fastHTTPReqSize(req *fasthttp.Request) float64 {
 	return size
 }
 
+// fastHTTPResSize レスポンスボディのサイズ
+// ストリーミングで長さがわからない場合は-1を返す
+func fastHTTPResSize(res *fasthttp.Response) float64 {
+	if res.IsBodyStream() {
+		return float64(max(res.Header.ContentLength(), -1))
+	}
+
+	return float64(len(res.Body()))
+}
+
 var (
 	filterCacheLocker = &sync.RWMutex{}
 	filterCache       = make(map[string]string, 50)
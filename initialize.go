@@ -3,10 +3,13 @@ package isutools
 import (
 	isucache "github.com/mazrean/isucon-go-tools/v2/cache"
 	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/hooks"
 )
 
 func BeforeInitialize() {
 	isucache.AllPurge()
+	benchmark.Prepare()
+	hooks.BeforeInitialize()
 }
 
 func AfterInitialize() {
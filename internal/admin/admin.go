@@ -0,0 +1,213 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	adminサーバーのアクセス制御
+	ISUTOOLS_TOKEN: Bearer token(Basic認証の場合はパスワード)として要求するトークン
+	ISUTOOLS_ALLOW_IPS: 接続を許可するIPアドレス・CIDRのカンマ区切りのリスト
+	ISUTOOLS_READ_ONLY: trueの場合、SQLを実行するエンドポイントを無効化する
+	値が不正な場合は、意図せず公開しないよう全てのリクエストを拒否する
+*/
+
+var (
+	policy       *Policy
+	unsafeLocker = &sync.RWMutex{}
+	unsafeRoutes = map[string]struct{}{}
+)
+
+type Policy struct {
+	Token string
+	// AllowPrefixes 空の場合は全てのIPアドレスを許可する
+	AllowPrefixes []netip.Prefix
+	ReadOnly      bool
+	// DenyAll 設定の誤りで制限が外れないよう、全てのリクエストを拒否する
+	DenyAll bool
+}
+
+func init() {
+	policy = loadPolicy()
+}
+
+func loadPolicy() *Policy {
+	p := &Policy{}
+
+	token, ok := os.LookupEnv("ISUTOOLS_TOKEN")
+	if ok {
+		p.Token = strings.TrimSpace(token)
+	}
+
+	strAllowIPs, ok := os.LookupEnv("ISUTOOLS_ALLOW_IPS")
+	if ok {
+		for _, strIP := range strings.Split(strAllowIPs, ",") {
+			strIP = strings.TrimSpace(strIP)
+			if strIP == "" {
+				continue
+			}
+
+			prefix, err := parsePrefix(strIP)
+			if err != nil {
+				// 全て不正な場合に全てのIPアドレスを許可することにならないよう、無視せずに拒否する
+				slog.Error("failed to parse ISUTOOLS_ALLOW_IPS, deny all requests",
+					slog.String("ISUTOOLS_ALLOW_IPS", strAllowIPs),
+					slog.String("error", err.Error()),
+				)
+				p.DenyAll = true
+				continue
+			}
+
+			p.AllowPrefixes = append(p.AllowPrefixes, prefix)
+		}
+	}
+
+	strReadOnly, ok := os.LookupEnv("ISUTOOLS_READ_ONLY")
+	if ok {
+		readOnly, err := strconv.ParseBool(strings.TrimSpace(strReadOnly))
+		if err != nil {
+			slog.Error("failed to parse ISUTOOLS_READ_ONLY, deny all requests",
+				slog.String("ISUTOOLS_READ_ONLY", strReadOnly),
+				slog.String("error", err.Error()),
+			)
+			p.DenyAll = true
+		} else {
+			p.ReadOnly = readOnly
+		}
+	}
+
+	if p.DenyAll {
+		p.ReadOnly = true
+	}
+
+	return p
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// MarkUnsafe SQLの実行などの副作用を持つルートを登録する
+// patternはmuxに登録したものと同じ文字列を指定する
+// read-onlyモードではこれらのルートへのリクエストを拒否する
+func MarkUnsafe(patterns ...string) {
+	unsafeLocker.Lock()
+	defer unsafeLocker.Unlock()
+
+	for _, pattern := range patterns {
+		unsafeRoutes[pattern] = struct{}{}
+	}
+}
+
+func isUnsafe(pattern string) bool {
+	unsafeLocker.RLock()
+	defer unsafeLocker.RUnlock()
+
+	_, ok := unsafeRoutes[pattern]
+	return ok
+}
+
+// Middleware 環境変数の設定に従ってmux全体にアクセス制御をかける
+func Middleware(mux *http.ServeMux) http.Handler {
+	return policy.Middleware(mux)
+}
+
+func (p *Policy) Middleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.DenyAll {
+			http.Error(w, "denied by invalid admin server configuration", http.StatusForbidden)
+			return
+		}
+
+		if !p.allowAddr(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if !p.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="isutools"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if p.ReadOnly {
+			_, pattern := mux.Handler(r)
+			if isUnsafe(pattern) {
+				http.Error(w, "disabled in read-only mode", http.StatusForbidden)
+				return
+			}
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (p *Policy) allowAddr(remoteAddr string) bool {
+	if len(p.AllowPrefixes) == 0 {
+		return true
+	}
+
+	// X-Forwarded-Forなどのヘッダーは偽装できるため、接続元のアドレスのみを見る
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range p.AllowPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Policy) authorized(r *http.Request) bool {
+	if p.Token == "" {
+		return true
+	}
+
+	var token string
+	if _, password, ok := r.BasicAuth(); ok {
+		// ブラウザからダッシュボードを開けるよう、Basic認証のパスワードとしても受け付ける
+		token = password
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	} else {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) == 1
+}
+
+// Authorize 他ホストのadminサーバーへのリクエストに、自ホストと同じトークンを付与する
+func Authorize(r *http.Request) {
+	if policy.Token == "" {
+		return
+	}
+
+	r.Header.Set("Authorization", "Bearer "+policy.Token)
+}
@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	MarkUnsafe("GET /test/{id}/explain")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /test/{id}/explain", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	p := &Policy{
+		Token:         "secret",
+		AllowPrefixes: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/24"), netip.MustParsePrefix("::1/128")},
+		ReadOnly:      true,
+	}
+	handler := p.Middleware(mux)
+
+	tests := []struct {
+		description string
+		remoteAddr  string
+		path        string
+		setAuth     func(*http.Request)
+		expected    int
+	}{
+		{
+			description: "bearer token",
+			remoteAddr:  "192.168.0.10:12345",
+			path:        "/test",
+			setAuth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			expected:    http.StatusOK,
+		},
+		{
+			description: "basic auth",
+			remoteAddr:  "[::1]:12345",
+			path:        "/test",
+			setAuth:     func(r *http.Request) { r.SetBasicAuth("isucon", "secret") },
+			expected:    http.StatusOK,
+		},
+		{
+			description: "ipv4-mapped ipv6 address",
+			remoteAddr:  "[::ffff:192.168.0.10]:12345",
+			path:        "/test",
+			setAuth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			expected:    http.StatusOK,
+		},
+		{
+			description: "no token",
+			remoteAddr:  "192.168.0.10:12345",
+			path:        "/test",
+			setAuth:     func(r *http.Request) {},
+			expected:    http.StatusUnauthorized,
+		},
+		{
+			description: "wrong token",
+			remoteAddr:  "192.168.0.10:12345",
+			path:        "/test",
+			setAuth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer secre") },
+			expected:    http.StatusUnauthorized,
+		},
+		{
+			description: "not allowed address",
+			remoteAddr:  "10.0.0.1:12345",
+			path:        "/test",
+			setAuth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			expected:    http.StatusForbidden,
+		},
+		{
+			description: "unsafe route in read-only mode",
+			remoteAddr:  "192.168.0.10:12345",
+			path:        "/test/1/explain",
+			setAuth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			expected:    http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			r.RemoteAddr = test.remoteAddr
+			test.setAuth(r)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, w.Code)
+			}
+		})
+	}
+}
+
+// TestLoadPolicy 環境変数を書き換えるので、並行に実行しない
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		description string
+		allowIPs    string
+		readOnly    string
+		denyAll     bool
+		isReadOnly  bool
+		prefixes    int
+	}{
+		{description: "valid", allowIPs: "192.168.0.1, 10.0.0.0/8", readOnly: "false", prefixes: 2},
+		{description: "read-only", allowIPs: "", readOnly: "true", isReadOnly: true},
+		{description: "all ips invalid", allowIPs: "isu1,isu2", readOnly: "false", denyAll: true, isReadOnly: true},
+		{description: "some ips invalid", allowIPs: "192.168.0.1,isu2", readOnly: "false", denyAll: true, isReadOnly: true, prefixes: 1},
+		{description: "invalid read-only", allowIPs: "", readOnly: "yes", denyAll: true, isReadOnly: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Setenv("ISUTOOLS_ALLOW_IPS", test.allowIPs)
+			t.Setenv("ISUTOOLS_READ_ONLY", test.readOnly)
+
+			p := loadPolicy()
+			if p.DenyAll != test.denyAll {
+				t.Errorf("unexpected deny all: expected %t, actual %t", test.denyAll, p.DenyAll)
+			}
+			if p.ReadOnly != test.isReadOnly {
+				t.Errorf("unexpected read-only: expected %t, actual %t", test.isReadOnly, p.ReadOnly)
+			}
+			if len(p.AllowPrefixes) != test.prefixes {
+				t.Errorf("unexpected prefixes: expected %d, actual %d", test.prefixes, len(p.AllowPrefixes))
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.168.0.1:12345"
+			w := httptest.NewRecorder()
+			p.Middleware(http.NewServeMux()).ServeHTTP(w, r)
+
+			if test.denyAll && w.Code != http.StatusForbidden {
+				t.Errorf("expected %d, got %d", http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package benchmark
+
+import (
+	"cmp"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	predictInterval = 5 * time.Second
+	// ridgeFactor 過学習を抑えるための正則化の強さ
+	// ベンチマークの回数がエンドポイント数より少ないことが多いため、必須
+	ridgeFactor = 1e-3
+)
+
+var (
+	predictedScoreGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "isutools",
+		Subsystem: "benchmark",
+		Name:      "predicted_score",
+	})
+	scoreModel = atomic.Pointer[model]{}
+)
+
+// model エンドポイントごとの成功リクエスト数からスコアを予測する線形モデル
+type model struct {
+	intercept float64
+	weights   map[metrics.EndpointKey]float64
+	// duration 学習に使ったベンチマークの平均走行時間
+	duration time.Duration
+	runs     int
+}
+
+type trainingRun struct {
+	counts   map[metrics.EndpointKey]float64
+	score    float64
+	duration time.Duration
+}
+
+func successCounts(summary *metrics.Summary) map[metrics.EndpointKey]float64 {
+	counts := make(map[metrics.EndpointKey]float64, len(summary.Endpoints))
+	for _, e := range summary.Endpoints {
+		counts[metrics.EndpointKey{Method: e.Method, URL: e.URL}] = float64(e.Success)
+	}
+
+	return counts
+}
+
+func fitModel() {
+	var runs []trainingRun
+	func() {
+		snapshotLocker.RLock()
+		defer snapshotLocker.RUnlock()
+
+		for _, snapshot := range snapshots {
+			if snapshot.Benchmark.Unscored || snapshot.Metrics == nil {
+				continue
+			}
+
+			runs = append(runs, trainingRun{
+				counts:   successCounts(snapshot.Metrics),
+				score:    float64(snapshot.Benchmark.Score),
+				duration: snapshot.Benchmark.End.Sub(snapshot.Benchmark.Start),
+			})
+		}
+	}()
+
+	m := train(runs)
+	if m == nil {
+		return
+	}
+
+	scoreModel.Store(m)
+}
+
+/*
+train リッジ回帰でモデルを学習する
+特徴量(エンドポイント)の数に比べてベンチマークの回数が少ないため、
+w = Xᵀ(XXᵀ + λI)⁻¹y の双対形式で解き、回数×回数の連立方程式に帰着させる
+*/
+func train(runs []trainingRun) *model {
+	if len(runs) < 2 {
+		return nil
+	}
+
+	keySet := map[metrics.EndpointKey]struct{}{}
+	for _, run := range runs {
+		for key := range run.counts {
+			keySet[key] = struct{}{}
+		}
+	}
+	keys := make([]metrics.EndpointKey, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+
+	n := len(runs)
+	means := make([]float64, len(keys))
+	var (
+		meanScore    float64
+		meanDuration time.Duration
+	)
+	for _, run := range runs {
+		for j, key := range keys {
+			means[j] += run.counts[key] / float64(n)
+		}
+		meanScore += run.score / float64(n)
+		meanDuration += run.duration / time.Duration(n)
+	}
+
+	// 切片に正則化がかからないよう中心化する
+	x := make([][]float64, n)
+	y := make([]float64, n)
+	for i, run := range runs {
+		x[i] = make([]float64, len(keys))
+		for j, key := range keys {
+			x[i][j] = run.counts[key] - means[j]
+		}
+		y[i] = run.score - meanScore
+	}
+
+	gram := make([][]float64, n)
+	var trace float64
+	for i := range n {
+		gram[i] = make([]float64, n)
+		for j := range n {
+			for k := range keys {
+				gram[i][j] += x[i][k] * x[j][k]
+			}
+		}
+		trace += gram[i][i]
+	}
+
+	lambda := ridgeFactor * trace / float64(n)
+	if lambda == 0 {
+		lambda = 1
+	}
+	for i := range n {
+		gram[i][i] += lambda
+	}
+
+	alpha, ok := solve(gram, y)
+	if !ok {
+		return nil
+	}
+
+	m := &model{
+		intercept: meanScore,
+		weights:   make(map[metrics.EndpointKey]float64, len(keys)),
+		duration:  meanDuration,
+		runs:      n,
+	}
+	for j, key := range keys {
+		var w float64
+		for i := range n {
+			w += x[i][j] * alpha[i]
+		}
+
+		m.weights[key] = w
+		m.intercept -= w * means[j]
+	}
+
+	return m
+}
+
+// solve ガウスの消去法で連立方程式 ax = b を解く
+func solve(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+	a = slices.Clone(a)
+	for i := range a {
+		a[i] = slices.Clone(a[i])
+	}
+	b = slices.Clone(b)
+
+	for col := range n {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+
+	return x, true
+}
+
+type Contribution struct {
+	Method       string  `json:"method"`
+	URL          string  `json:"url"`
+	Weight       float64 `json:"weight"`
+	Count        float64 `json:"count"`
+	Contribution float64 `json:"contribution"`
+}
+
+type Prediction struct {
+	Score     float64 `json:"score"`
+	Intercept float64 `json:"intercept"`
+	// Scale 走行途中のリクエスト数を、過去の平均走行時間分に引き伸ばす倍率
+	Scale         float64        `json:"scale"`
+	Elapsed       float64        `json:"elapsed"`
+	Runs          int            `json:"runs"`
+	Contributions []Contribution `json:"contributions"`
+}
+
+// predict 走行中のリクエスト数から最終的なスコアを予測する
+func (m *model) predict(counts map[metrics.EndpointKey]float64, elapsed time.Duration) *Prediction {
+	scale := 1.0
+	if elapsed > 0 && elapsed < m.duration {
+		scale = float64(m.duration) / float64(elapsed)
+	}
+
+	p := &Prediction{
+		Score:         m.intercept,
+		Intercept:     m.intercept,
+		Scale:         scale,
+		Elapsed:       elapsed.Seconds(),
+		Runs:          m.runs,
+		Contributions: make([]Contribution, 0, len(m.weights)),
+	}
+	for key, w := range m.weights {
+		count := counts[key] * scale
+		p.Score += w * count
+		p.Contributions = append(p.Contributions, Contribution{
+			Method:       key.Method,
+			URL:          key.URL,
+			Weight:       w,
+			Count:        count,
+			Contribution: w * count,
+		})
+	}
+	slices.SortFunc(p.Contributions, func(a, b Contribution) int {
+		return cmp.Compare(math.Abs(b.Contribution), math.Abs(a.Contribution))
+	})
+
+	return p
+}
+
+func currentPrediction() *Prediction {
+	m := scoreModel.Load()
+	if m == nil {
+		return nil
+	}
+
+	counts := map[metrics.EndpointKey]float64{}
+	var elapsed time.Duration
+	if r := current.Load(); r != nil {
+		sample, err := metrics.Gather()
+		if err != nil {
+			slog.Error("failed to gather metrics for prediction",
+				slog.String("error", err.Error()),
+			)
+			return nil
+		}
+
+		counts = successCounts(sample.Sub(baseSample.Load()).Summary())
+
+		elapsed = time.Since(r.start)
+		if e := end.Load(); r.finished.Load() && e != nil {
+			elapsed = e.Sub(r.start)
+		}
+	}
+
+	return m.predict(counts, elapsed)
+}
+
+func watchPrediction(r *run) {
+	ticker := time.NewTicker(predictInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if current.Load() != r || r.finished.Load() {
+			return
+		}
+
+		p := currentPrediction()
+		if p == nil {
+			continue
+		}
+
+		predictedScoreGauge.Set(p.Score)
+	}
+}
+
+func predictionHandler(w http.ResponseWriter, r *http.Request) {
+	p := currentPrediction()
+	if p == nil {
+		http.Error(w, "not enough scored benchmarks to predict", http.StatusNotFound)
+		return
+	}
+
+	response.JSON(w, p)
+}
@@ -0,0 +1,42 @@
+package benchmark
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrainAndPredict(t *testing.T) {
+	users := metrics.EndpointKey{Method: "GET", URL: "/api/user/<number>"}
+	posts := metrics.EndpointKey{Method: "POST", URL: "/api/post"}
+
+	// score = 1*users + 5*posts
+	runs := []trainingRun{
+		{counts: map[metrics.EndpointKey]float64{users: 1000, posts: 100}, score: 1500, duration: 60 * time.Second},
+		{counts: map[metrics.EndpointKey]float64{users: 2000, posts: 150}, score: 2750, duration: 60 * time.Second},
+		{counts: map[metrics.EndpointKey]float64{users: 1500, posts: 300}, score: 3000, duration: 60 * time.Second},
+	}
+
+	assert.Nil(t, train(runs[:1]))
+
+	m := train(runs)
+	if !assert.NotNil(t, m) {
+		return
+	}
+	assert.Equal(t, 3, m.runs)
+	assert.Equal(t, 60*time.Second, m.duration)
+
+	p := m.predict(map[metrics.EndpointKey]float64{users: 1800, posts: 200}, 60*time.Second)
+	assert.InDelta(t, 2800, p.Score, 50)
+	if assert.Len(t, p.Contributions, 2) {
+		// 寄与の大きい順に並ぶ
+		assert.Equal(t, users, metrics.EndpointKey{Method: p.Contributions[0].Method, URL: p.Contributions[0].URL})
+	}
+
+	// 走行途中の値は平均走行時間分に引き伸ばす
+	half := m.predict(map[metrics.EndpointKey]float64{users: 900, posts: 100}, 30*time.Second)
+	assert.InDelta(t, 2.0, half.Scale, 1e-9)
+	assert.InDelta(t, p.Score, half.Score, 1e-6)
+}
@@ -0,0 +1,131 @@
+package benchmark
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+)
+
+/*
+	追記専用のレコードファイル
+	各レコードは [payload長(4byte LE)][payloadのCRC32(4byte LE)][payload(JSON)] の形式で書き込む
+	書き込み途中でクラッシュした場合でも、末尾の壊れたレコードを捨てるだけで読み戻せる
+*/
+
+const (
+	recordHeaderSize = 8
+	// maxRecordSize これより大きいpayload長はヘッダーが壊れているものとして扱う
+	maxRecordSize = 64 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// errNotRecordFile 先頭のレコードから読めない場合に返す
+	// 旧形式のファイルなどを切り詰めて消さないよう、呼び出し側で追記を止める
+	errNotRecordFile = errors.New("not a record file")
+)
+
+// readRecords 壊れていないレコードを全て読み込む
+// 末尾に壊れたレコードがある場合は、次の追記が正しく読めるようにファイルを切り詰める
+// 先頭のレコードから読めない場合は、ファイルを変更せずにerrNotRecordFileを返す
+func readRecords[T any](path string) ([]T, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to open record file: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		records []T
+		offset  int64
+		header  [recordHeaderSize]byte
+		r       = bufio.NewReader(f)
+	)
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			break
+		}
+
+		size := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if size > maxRecordSize {
+			break
+		}
+
+		payload := make([]byte, size)
+		_, err = io.ReadFull(r, payload)
+		if err != nil || crc32.Checksum(payload, crcTable) != sum {
+			break
+		}
+
+		var record T
+		err = json.Unmarshal(payload, &record)
+		if err != nil {
+			break
+		}
+
+		records = append(records, record)
+		offset += recordHeaderSize + int64(size)
+	}
+
+	if offset == 0 {
+		return nil, fmt.Errorf("%w: %s", errNotRecordFile, path)
+	}
+
+	slog.Warn("truncate broken record",
+		slog.String("file", path),
+		slog.Int64("offset", offset),
+	)
+
+	err = f.Truncate(offset)
+	if err != nil {
+		return records, fmt.Errorf("failed to truncate broken record: %w", err)
+	}
+
+	return records, nil
+}
+
+func appendRecord[T any](path string, record T) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	buf = append(buf, payload...)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open record file: %w", err)
+	}
+	defer f.Close()
+
+	// 1回のwriteで書き込み、部分的な書き込みは読み込み時に検出する
+	_, err = f.Write(buf)
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync record file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package benchmark
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAppendAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.history")
+
+	records, err := readRecords[*Benchmark](path)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, appendRecord(path, &Benchmark{ID: i, Score: int64(i * 100)}))
+	}
+
+	records, err = readRecords[*Benchmark](path)
+	require.NoError(t, err)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, 3, records[2].ID)
+		assert.Equal(t, int64(300), records[2].Score)
+	}
+}
+
+func TestRecordTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.history")
+
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 1, Score: 100}))
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 2, Score: 200}))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	validSize := info.Size()
+
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 3, Score: 300}))
+
+	// 3件目の書き込み途中でクラッシュした状態を再現する
+	require.NoError(t, os.Truncate(path, validSize+recordHeaderSize+3))
+
+	records, err := readRecords[*Benchmark](path)
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, validSize, info.Size())
+
+	// 切り詰めた後は追記したレコードも読める
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 3, Score: 300}))
+
+	records, err = readRecords[*Benchmark](path)
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+}
+
+func TestRecordCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.history")
+
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 1, Score: 100}))
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 2, Score: 200}))
+
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	buf[len(buf)-2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+
+	records, err := readRecords[*Benchmark](path)
+	require.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, 1, records[0].ID)
+	}
+}
+
+func TestRecordOversizedHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.history")
+
+	require.NoError(t, appendRecord(path, &Benchmark{ID: 1, Score: 100}))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	validSize := info.Size()
+
+	// payload長が壊れたヘッダーを追記する
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	records, err := readRecords[*Benchmark](path)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, validSize, info.Size())
+}
+
+func TestRecordNotRecordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.history")
+
+	content := []byte("this is not a record file")
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	_, err := readRecords[*Benchmark](path)
+	assert.ErrorIs(t, err, errNotRecordFile)
+
+	// 別の形式のファイルは切り詰めない
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, buf)
+}
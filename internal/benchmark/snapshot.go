@@ -0,0 +1,271 @@
+package benchmark
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+// snapshotWritable スナップショットのファイルが読めなかった場合は、上書きしないよう追記を止める
+var snapshotWritable = false
+
+var (
+	snapshotFile   string
+	snapshotLocker = &sync.RWMutex{}
+	snapshots      []*Snapshot
+	baseSample     = atomic.Pointer[metrics.Sample]{}
+)
+
+// Snapshot ベンチマーク1回分の[Start, End]でのメトリクスの増分
+type Snapshot struct {
+	ID        int              `json:"id"`
+	Benchmark Benchmark        `json:"benchmark"`
+	Metrics   *metrics.Summary `json:"metrics"`
+}
+
+type snapshotInfo struct {
+	ID       int       `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Score    int64     `json:"score"`
+	Unscored bool      `json:"unscored,omitempty"`
+}
+
+func newSnapshotInfo(s *Snapshot) snapshotInfo {
+	return snapshotInfo{
+		ID:       s.ID,
+		Start:    s.Benchmark.Start,
+		End:      s.Benchmark.End,
+		Score:    s.Benchmark.Score,
+		Unscored: s.Benchmark.Unscored,
+	}
+}
+
+func init() {
+	if !config.Enable {
+		return
+	}
+
+	var ok bool
+	snapshotFile, ok = os.LookupEnv("BENCHMARK_SNAPSHOT_FILE")
+	if !ok {
+		snapshotFile = "bench.snapshots"
+	}
+
+	records, err := readRecords[*Snapshot](snapshotFile)
+	snapshotWritable = !errors.Is(err, errNotRecordFile)
+	if err != nil {
+		slog.Error("failed to read snapshot file",
+			slog.String("file", snapshotFile),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	for _, snapshot := range records {
+		addSnapshot(snapshot)
+	}
+
+	fitModel()
+}
+
+// addSnapshot 同じIDのスナップショットは後から追加されたもので置き換える
+func addSnapshot(snapshot *Snapshot) {
+	snapshotLocker.Lock()
+	defer snapshotLocker.Unlock()
+
+	for i, s := range snapshots {
+		if s.ID == snapshot.ID {
+			snapshots[i] = snapshot
+			return
+		}
+	}
+
+	snapshots = append(snapshots, snapshot)
+}
+
+func takeBaseSample() {
+	sample, err := metrics.Gather()
+	if err != nil {
+		slog.Error("failed to gather base sample",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	baseSample.Store(sample)
+}
+
+type endSample struct {
+	id     int
+	end    time.Time
+	sample *metrics.Sample
+}
+
+var lastEndSample = atomic.Pointer[endSample]{}
+
+// takeEndSample ベンチマークのEndの時点のメトリクスを取得する
+func takeEndSample(id int, end time.Time) {
+	sample, err := metrics.Gather()
+	if err != nil {
+		slog.Error("failed to gather end sample",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	lastEndSample.Store(&endSample{
+		id:     id,
+		end:    end,
+		sample: sample,
+	})
+}
+
+func saveSnapshot(b *Benchmark) {
+	s := lastEndSample.Load()
+	if s == nil || s.id != b.ID || !s.end.Equal(b.End) {
+		slog.Error("no metrics sample at the end of benchmark",
+			slog.Int("id", b.ID),
+			slog.Time("end", b.End),
+		)
+		return
+	}
+	sample := s.sample
+
+	snapshot := &Snapshot{
+		ID:        b.ID,
+		Benchmark: *b,
+		Metrics:   sample.Sub(baseSample.Load()).Summary(),
+	}
+	addSnapshot(snapshot)
+
+	if !snapshotWritable {
+		return
+	}
+
+	err := appendRecord(snapshotFile, snapshot)
+	if err != nil {
+		slog.Error("failed to append snapshot",
+			slog.String("file", snapshotFile),
+			slog.Int("id", snapshot.ID),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// updateSnapshotBenchmark 後から付与されたスコアをスナップショットにも反映する
+func updateSnapshotBenchmark(b *Benchmark) {
+	snapshot := findSnapshot(b.ID)
+	if snapshot == nil {
+		return
+	}
+
+	newSnapshot := *snapshot
+	newSnapshot.Benchmark = *b
+	addSnapshot(&newSnapshot)
+
+	if !snapshotWritable {
+		return
+	}
+
+	err := appendRecord(snapshotFile, &newSnapshot)
+	if err != nil {
+		slog.Error("failed to append snapshot",
+			slog.String("file", snapshotFile),
+			slog.Int("id", newSnapshot.ID),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func findSnapshot(id int) *Snapshot {
+	snapshotLocker.RLock()
+	defer snapshotLocker.RUnlock()
+
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot
+		}
+	}
+
+	return nil
+}
+
+func snapshotListHandler(w http.ResponseWriter, r *http.Request) {
+	infos := func() []snapshotInfo {
+		snapshotLocker.RLock()
+		defer snapshotLocker.RUnlock()
+
+		infos := make([]snapshotInfo, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			infos = append(infos, newSnapshotInfo(snapshot))
+		}
+
+		return infos
+	}()
+
+	response.JSON(w, infos)
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	snapshot := findSnapshot(id)
+	if snapshot == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	response.JSON(w, snapshot)
+}
+
+func snapshotDiffHandler(w http.ResponseWriter, r *http.Request) {
+	strFrom := r.URL.Query().Get("from")
+	fromID, err := strconv.Atoi(strFrom)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from(%s): %s", strFrom, err), http.StatusBadRequest)
+		return
+	}
+
+	strTo := r.URL.Query().Get("to")
+	toID, err := strconv.Atoi(strTo)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to(%s): %s", strTo, err), http.StatusBadRequest)
+		return
+	}
+
+	from := findSnapshot(fromID)
+	if from == nil {
+		http.Error(w, fmt.Sprintf("snapshot %d not found", fromID), http.StatusNotFound)
+		return
+	}
+
+	to := findSnapshot(toID)
+	if to == nil {
+		http.Error(w, fmt.Sprintf("snapshot %d not found", toID), http.StatusNotFound)
+		return
+	}
+
+	response.JSON(w, struct {
+		From snapshotInfo         `json:"from"`
+		To   snapshotInfo         `json:"to"`
+		Diff *metrics.SummaryDiff `json:"diff"`
+	}{
+		From: newSnapshotInfo(from),
+		To:   newSnapshotInfo(to),
+		Diff: metrics.Diff(from.Metrics, to.Metrics),
+	})
+}
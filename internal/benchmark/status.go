@@ -3,24 +3,40 @@ package benchmark
 import (
 	"context"
 	"encoding/gob"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"runtime/debug"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+/*
+	BENCHMARK_FILE: ベンチマークの履歴の保存先(デフォルトbench.history)
+	以前のバージョンのgob形式のファイル(bench.gob)は、起動時にレコード形式へ変換する
+*/
+
+const legacyHistoryFile = "bench.gob"
+
+// historyWritable 履歴のファイルが読めなかった場合は、上書きしないよう追記を止める
+var historyWritable = false
+
 var (
-	gobFile    string
-	latest     = &Benchmark{}
-	scoreGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	historyFile   string
+	commit        string
+	historyLocker = &sync.RWMutex{}
+	history       []*Benchmark
+	scoreGauge    = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "isutools",
 		Subsystem: "benchmark",
 		Name:      "score",
@@ -33,114 +49,458 @@ var (
 )
 
 type Benchmark struct {
-	Start time.Time `json:"start"`
-	End   time.Time `json:"end"`
-	Score int64     `json:"score"`
+	ID     int       `json:"id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Score  int64     `json:"score"`
+	Commit string    `json:"commit,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Note   string    `json:"note,omitempty"`
+	// Unscored 終了検知で自動的に終了し、スコアがまだ付与されていない
+	Unscored bool       `json:"unscored,omitempty"`
+	GC       *GCSummary `json:"gc,omitempty"`
+}
+
+// GCSummary ベンチマーク中のGCの状況
+// GOGC, GOMEMLIMITのチューニングの判断材料にする
+type GCSummary struct {
+	Cycles uint64 `json:"cycles"`
+	// CPUFraction GCに使われたCPU時間の割合
+	CPUFraction float64 `json:"cpu_fraction"`
+	// MaxPause GCによる停止時間の最大値(秒)
+	MaxPause    float64 `json:"max_pause"`
+	GOGC        uint64  `json:"gogc"`
+	MemoryLimit uint64  `json:"memory_limit"`
 }
 
 func init() {
+	commit = readCommit()
+
 	if !config.Enable {
 		return
 	}
 
 	var ok bool
-	gobFile, ok = os.LookupEnv("BENCHMARK_FILE")
+	historyFile, ok = os.LookupEnv("BENCHMARK_FILE")
 	if !ok {
-		gobFile = "bench.gob"
+		historyFile = "bench.history"
+
+		err := migrateLegacyHistory(legacyHistoryFile, historyFile)
+		if err != nil {
+			slog.Error("failed to migrate legacy benchmark history",
+				slog.String("file", legacyHistoryFile),
+				slog.String("error", err.Error()),
+			)
+		}
 	}
 
-	f, err := os.Open(gobFile)
+	records, err := readHistory(historyFile)
+	historyWritable = !errors.Is(err, errNotRecordFile)
 	if err != nil {
+		slog.Error("failed to read benchmark history",
+			slog.String("file", historyFile),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	for _, b := range records {
+		addHistory(b)
+	}
+
+	if b := Latest(); b != nil {
+		lastID.Store(int64(b.ID))
+		if !b.Unscored {
+			scoreGauge.Set(float64(b.Score))
+		}
+		durationGauge.Set(b.End.Sub(b.Start).Seconds())
+	}
+}
+
+// readHistory BENCHMARK_FILEにgob形式のファイルが指定されている場合は、その場で変換する
+func readHistory(path string) ([]*Benchmark, error) {
+	records, err := readRecords[*Benchmark](path)
+	if errors.Is(err, errNotRecordFile) {
+		migrateErr := migrateLegacyHistory(path, path)
+		if migrateErr != nil {
+			return nil, fmt.Errorf("%w(failed to migrate as gob: %w)", err, migrateErr)
+		}
+
+		return readRecords[*Benchmark](path)
+	}
+
+	return records, err
+}
+
+// migrateLegacyHistory gob形式の最後のベンチマークを、レコード形式でdstに書き込む
+// dstが既に存在する場合(src==dstの場合を除く)やsrcが存在しない場合は何もしない
+// src==dstの場合は、元のファイルを<src>.bakに残す
+func migrateLegacyHistory(src, dst string) error {
+	if src != dst {
+		_, err := os.Stat(dst)
+		if err == nil {
+			return nil
+		}
 		if !os.IsNotExist(err) {
-			slog.Error("failed to open gob file",
-				slog.String("file", gobFile),
-				slog.String("error", err.Error()),
-			)
+			return fmt.Errorf("failed to stat %s: %w", dst, err)
 		}
+	}
 
-		return
+	f, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to open gob file: %w", err)
 	}
 	defer f.Close()
 
-	err = gob.NewDecoder(f).Decode(latest)
+	// 旧形式のBenchmarkはStart, End, Scoreのみを持ち、gobはフィールド名で対応付ける
+	b := &Benchmark{}
+	err = gob.NewDecoder(f).Decode(b)
 	if err != nil {
-		slog.Error("failed to decode gob file",
-			slog.String("file", gobFile),
-			slog.String("error", err.Error()),
-		)
+		return fmt.Errorf("failed to decode gob file: %w", err)
+	}
+	b.ID = 1
+
+	tmp := dst + ".tmp"
+	err = os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", tmp, err)
+	}
+
+	err = appendRecord(tmp, b)
+	if err != nil {
+		return err
+	}
+
+	if src == dst {
+		err = os.Rename(src, src+".bak")
+		if err != nil {
+			return fmt.Errorf("failed to back up gob file: %w", err)
+		}
+	}
+
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmp, err)
+	}
+
+	slog.Info("migrated legacy benchmark history",
+		slog.String("from", src),
+		slog.String("to", dst),
+		slog.Int64("score", b.Score),
+	)
+
+	return nil
+}
+
+func HistoryFile() string {
+	return historyFile
+}
+
+func readCommit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	var (
+		revision string
+		modified bool
+	)
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+
+	if revision != "" && modified {
+		revision += "-dirty"
+	}
+
+	return revision
+}
+
+// addHistory 同じIDのレコードは後から追加されたもので置き換える
+func addHistory(b *Benchmark) {
+	historyLocker.Lock()
+	defer historyLocker.Unlock()
+
+	for i, h := range history {
+		if h.ID == b.ID {
+			history[i] = b
+			return
+		}
+	}
+
+	history = append(history, b)
+}
+
+func Latest() *Benchmark {
+	historyLocker.RLock()
+	defer historyLocker.RUnlock()
+
+	if len(history) == 0 {
+		return nil
+	}
+
+	return history[len(history)-1]
+}
+
+func History() []*Benchmark {
+	historyLocker.RLock()
+	defer historyLocker.RUnlock()
+
+	return append([]*Benchmark(nil), history...)
+}
+
+func Best() *Benchmark {
+	historyLocker.RLock()
+	defer historyLocker.RUnlock()
+
+	var best *Benchmark
+	for _, b := range history {
+		if b.Unscored {
+			continue
+		}
+
+		if best == nil || b.Score > best.Score {
+			best = b
+		}
 	}
 
-	scoreGauge.Set(float64(latest.Score))
-	durationGauge.Set(latest.End.Sub(latest.Start).Seconds())
+	return best
 }
 
+type run struct {
+	id       int
+	start    time.Time
+	finished atomic.Bool
+}
+
+var (
+	lastID  = atomic.Int64{}
+	current = atomic.Pointer[run]{}
+	end     = atomic.Pointer[time.Time]{}
+)
+
 var (
-	start time.Time
-	end   = atomic.Pointer[time.Time]{}
+	ErrNotStarted = errors.New("benchmark is not started")
+	ErrNoEnd      = errors.New("end time is not set")
+	ErrNotFound   = errors.New("benchmark not found")
 )
 
 func Start() {
-	start = time.Now()
+	if !config.Enable {
+		return
+	}
+
+	r := &run{
+		id:    int(lastID.Add(1)),
+		start: time.Now(),
+	}
+
+	end.Store(nil)
+	current.Store(r)
+	startTimeline(r.start)
+	takeBaseSample()
+
+	for _, f := range startHooks {
+		f(context.Background(), &Benchmark{
+			ID:     r.id,
+			Start:  r.start,
+			Commit: commit,
+			Host:   config.Host,
+		})
+	}
+
+	go watch(r)
+	go watchPrediction(r)
+}
+
+// CurrentID 走行中のベンチマークのIDを返す
+func CurrentID() (int, bool) {
+	r := current.Load()
+	if r == nil || r.finished.Load() {
+		return 0, false
+	}
+
+	return r.id, true
 }
 
 func Continue() {
+	if !config.Enable {
+		return
+	}
+
 	v := time.Now().Add(2 * time.Second)
 	end.Store(&v)
 }
 
 var (
-	endHooks []func(context.Context, *Benchmark)
+	startHooks   []func(context.Context, *Benchmark)
+	endHooks     []func(context.Context, *Benchmark)
+	endSamplers  []func(context.Context, *Benchmark)
+	sampleLocker = &sync.Mutex{}
+	// sampledID, sampledEnd 最後にendSamplersを呼んだベンチマークのIDとEnd
+	sampledID  int
+	sampledEnd time.Time
 )
 
+// SetStartHook ベンチマーク開始時に呼ばれる関数を登録する
+// 渡されるBenchmarkにはID, Startのみが設定されている
+func SetStartHook(f func(context.Context, *Benchmark)) {
+	startHooks = append(startHooks, f)
+}
+
 func SetEndHook(f func(context.Context, *Benchmark)) {
 	endHooks = append(endHooks, f)
 }
 
-func setScore(ctx context.Context, score int64) {
+// SetEndSampler ベンチマークのEndの時点の値を取得する関数を登録する
+// 終了フックはスコアの送信時などEndより後に呼ばれるため、[Start, End]の値を集計する場合はこちらで取得しておく
+// 最後のリクエストからEndが過ぎた時点で呼ばれ、その後にリクエストがあった場合は再度呼ばれる
+// 渡されるBenchmarkにはID, Start, Endのみが設定されている
+func SetEndSampler(f func(context.Context, *Benchmark)) {
+	endSamplers = append(endSamplers, f)
+}
+
+// sampleEnd 同じIDとEndに対しては1度だけendSamplersを呼ぶ
+func sampleEnd(ctx context.Context, id int, start, end time.Time) {
+	sampleLocker.Lock()
+	defer sampleLocker.Unlock()
+
+	if sampledID == id && sampledEnd.Equal(end) {
+		return
+	}
+	sampledID = id
+	sampledEnd = end
+
+	takeEndSample(id, end)
+	for _, f := range endSamplers {
+		f(ctx, &Benchmark{
+			ID:    id,
+			Start: start,
+			End:   end,
+		})
+	}
+}
+
+func setScore(ctx context.Context, score int64, note string) error {
+	r := current.Load()
+	if r == nil {
+		return ErrNotStarted
+	}
+
+	if !r.finished.CompareAndSwap(false, true) {
+		// 終了検知で既に終了している場合、スコアを後から付与する
+		return attachScore(r.id, score, note)
+	}
+
 	end := end.Load()
 	if end == nil {
-		slog.Error("end time is not set",
-			slog.Time("start", start),
-			slog.Int64("score", score),
-		)
-		return
+		r.finished.Store(false)
+		return ErrNoEnd
 	}
 
-	latest = &Benchmark{
-		Start: start,
-		End:   *end,
-		Score: score,
+	finish(ctx, &Benchmark{
+		ID:     r.id,
+		Start:  r.start,
+		End:    *end,
+		Score:  score,
+		Commit: commit,
+		Host:   config.Host,
+		Note:   note,
+	})
+
+	return nil
+}
+
+func finish(ctx context.Context, b *Benchmark) {
+	if !b.Unscored {
+		scoreGauge.Set(float64(b.Score))
 	}
-	scoreGauge.Set(float64(score))
-	durationGauge.Set(latest.End.Sub(latest.Start).Seconds())
+	durationGauge.Set(b.End.Sub(b.Start).Seconds())
+	endTimeline(b.End)
+	// 終了フックの処理時間やその後のリクエストが含まれないよう、先にEndの時点の値を取得しておく
+	sampleEnd(ctx, b.ID, b.Start, b.End)
 
 	for _, f := range endHooks {
-		f(ctx, latest)
+		f(ctx, b)
 	}
 
-	f, err := os.Create(gobFile)
-	if err != nil {
-		slog.Error("failed to create gob file",
-			slog.String("file", gobFile),
-			slog.String("error", err.Error()),
-		)
+	saveBenchmark(b)
+	saveSnapshot(b)
+	fitModel()
+}
+
+func attachScore(id int, score int64, note string) error {
+	var b *Benchmark
+	for _, h := range History() {
+		if h.ID == id {
+			// 履歴のレコードは書き換えず、コピーを追記する
+			newB := *h
+			b = &newB
+		}
 	}
-	defer f.Close()
+	if b == nil {
+		return ErrNotFound
+	}
+
+	b.Score = score
+	b.Unscored = false
+	if note != "" {
+		b.Note = note
+	}
+
+	if latest := Latest(); latest != nil && latest.ID == id {
+		scoreGauge.Set(float64(score))
+	}
+
+	saveBenchmark(b)
+	updateSnapshotBenchmark(b)
+	fitModel()
+
+	return nil
+}
 
-	err = gob.NewEncoder(f).Encode(latest)
+func saveBenchmark(b *Benchmark) {
+	addHistory(b)
+
+	if !historyWritable {
+		return
+	}
+
+	err := appendRecord(historyFile, b)
 	if err != nil {
-		slog.Error("failed to encode gob file",
-			slog.String("file", gobFile),
-			slog.Group("latest",
-				slog.Time("start", latest.Start),
-				slog.Time("end", latest.End),
-				slog.Int64("score", latest.Score),
+		slog.Error("failed to append benchmark history",
+			slog.String("file", historyFile),
+			slog.Group("benchmark",
+				slog.Int("id", b.ID),
+				slog.Time("start", b.Start),
+				slog.Time("end", b.End),
+				slog.Int64("score", b.Score),
 			),
 			slog.String("error", err.Error()),
 		)
 	}
 }
 
+func scoreErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotStarted), errors.Is(err, ErrNoEnd):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func Register(mux *http.ServeMux) {
 	mux.HandleFunc("POST /benchmark/score", func(w http.ResponseWriter, r *http.Request) {
 		strScore := r.FormValue("score")
@@ -150,21 +510,63 @@ func Register(mux *http.ServeMux) {
 			return
 		}
 
-		setScore(r.Context(), score)
+		err = setScore(r.Context(), score, r.FormValue("note"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to set score: %s", err), scoreErrorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /benchmark/{id}/score", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+
+		strScore := r.FormValue("score")
+		score, err := strconv.ParseInt(strScore, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse score(%s): %s", strScore, err), http.StatusBadRequest)
+			return
+		}
+
+		err = attachScore(id, score, r.FormValue("note"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to attach score: %s", err), scoreErrorStatus(err))
+			return
+		}
 
 		w.WriteHeader(http.StatusNoContent)
 	})
 	mux.HandleFunc("GET /benchmark/latest", func(w http.ResponseWriter, r *http.Request) {
+		latest := Latest()
 		if latest == nil {
 			http.Error(w, "no latest benchmark", http.StatusNotFound)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		err := json.NewEncoder(w).Encode(latest)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to encode latest benchmark: %s", err), http.StatusInternalServerError)
+		response.JSON(w, latest)
+	})
+	mux.HandleFunc("GET /benchmark/history", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, History())
+	})
+	mux.HandleFunc("GET /benchmark/best", func(w http.ResponseWriter, r *http.Request) {
+		best := Best()
+		if best == nil {
+			http.Error(w, "no benchmark", http.StatusNotFound)
+			return
 		}
+
+		response.JSON(w, best)
 	})
+	mux.HandleFunc("GET /benchmark/timeline", timelineHandler)
+	mux.HandleFunc("GET /benchmark/prediction", predictionHandler)
+	mux.HandleFunc("GET /benchmark/snapshots", snapshotListHandler)
+	mux.HandleFunc("GET /benchmark/snapshots/{id}", snapshotHandler)
+	mux.HandleFunc("GET /benchmark/snapshots/diff", snapshotDiffHandler)
+
+	// 過去のベンチマークの記録を書き換えるため、read-onlyモードでは無効化する
+	admin.MarkUnsafe("POST /benchmark/{id}/score")
 }
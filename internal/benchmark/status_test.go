@@ -0,0 +1,211 @@
+package benchmark
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyBenchmark 以前のバージョンでbench.gobに保存していた形式
+type legacyBenchmark struct {
+	Start time.Time
+	End   time.Time
+	Score int64
+}
+
+func writeLegacyHistory(t *testing.T, path string, b legacyBenchmark) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, gob.NewEncoder(f).Encode(b))
+}
+
+func TestMigrateLegacyHistory(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	legacy := legacyBenchmark{Start: start, End: start.Add(time.Minute), Score: 12345}
+
+	t.Run("default file", func(t *testing.T) {
+		dir := t.TempDir()
+		src := filepath.Join(dir, "bench.gob")
+		dst := filepath.Join(dir, "bench.history")
+		writeLegacyHistory(t, src, legacy)
+
+		require.NoError(t, migrateLegacyHistory(src, dst))
+
+		records, err := readHistory(dst)
+		require.NoError(t, err)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, 1, records[0].ID)
+			assert.Equal(t, legacy.Score, records[0].Score)
+			assert.True(t, legacy.End.Equal(records[0].End))
+		}
+
+		// 変換済みの場合は上書きしない
+		require.NoError(t, appendRecord(dst, &Benchmark{ID: 2, Score: 200}))
+		require.NoError(t, migrateLegacyHistory(src, dst))
+
+		records, err = readHistory(dst)
+		require.NoError(t, err)
+		assert.Len(t, records, 2)
+	})
+
+	t.Run("BENCHMARK_FILE is gob", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "bench.gob")
+		writeLegacyHistory(t, path, legacy)
+
+		records, err := readHistory(path)
+		require.NoError(t, err)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, legacy.Score, records[0].Score)
+		}
+
+		_, err = os.Stat(path + ".bak")
+		assert.NoError(t, err, "original gob file must be kept")
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "bench.history")
+		content := []byte("this is not a record file")
+		require.NoError(t, os.WriteFile(path, content, 0644))
+
+		_, err := readHistory(path)
+		assert.ErrorIs(t, err, errNotRecordFile)
+
+		buf, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, buf)
+	})
+}
+
+// TestHistoryHandler 履歴を書き換えるので、並行に実行しない
+func TestHistoryHandler(t *testing.T) {
+	historyLocker.Lock()
+	prevHistory := history
+	history = nil
+	historyLocker.Unlock()
+	t.Cleanup(func() {
+		historyLocker.Lock()
+		history = prevHistory
+		historyLocker.Unlock()
+	})
+
+	mux := http.NewServeMux()
+	Register(mux)
+
+	get := func(t *testing.T, path string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		w := get(t, "/benchmark/history")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var res []*Benchmark
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		assert.Empty(t, res)
+
+		assert.Equal(t, http.StatusNotFound, get(t, "/benchmark/best").Code)
+	})
+
+	addHistory(&Benchmark{ID: 1, Score: 100})
+	addHistory(&Benchmark{ID: 2, Score: 300})
+	addHistory(&Benchmark{ID: 3, Unscored: true})
+	// 後から付与されたスコアで置き換わる
+	addHistory(&Benchmark{ID: 1, Score: 200})
+
+	t.Run("history", func(t *testing.T) {
+		w := get(t, "/benchmark/history")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var res []*Benchmark
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		if assert.Len(t, res, 3) {
+			assert.Equal(t, []int{1, 2, 3}, []int{res[0].ID, res[1].ID, res[2].ID})
+			assert.Equal(t, int64(200), res[0].Score)
+		}
+	})
+
+	t.Run("best skips unscored", func(t *testing.T) {
+		addHistory(&Benchmark{ID: 4, Unscored: true, Score: 1000})
+
+		w := get(t, "/benchmark/best")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var res Benchmark
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		assert.Equal(t, 2, res.ID)
+		assert.Equal(t, int64(300), res.Score)
+	})
+}
+
+// TestFinishSamplesAtEnd 終了フック中のメトリクスの変化はスナップショットに含めない
+// 終了フックやスナップショットを書き換えるので、並行に実行しない
+func TestFinishSamplesAtEnd(t *testing.T) {
+	queryHistogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "isutools",
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+	}, []string{"driver", "query"})
+	require.NoError(t, prometheus.Register(queryHistogram))
+
+	historyLocker.Lock()
+	prevHistory := history
+	historyLocker.Unlock()
+	snapshotLocker.Lock()
+	prevSnapshots := snapshots
+	snapshotLocker.Unlock()
+	prevEndHooks, prevHistoryWritable, prevSnapshotWritable := endHooks, historyWritable, snapshotWritable
+	t.Cleanup(func() {
+		prometheus.Unregister(queryHistogram)
+
+		historyLocker.Lock()
+		history = prevHistory
+		historyLocker.Unlock()
+		snapshotLocker.Lock()
+		snapshots = prevSnapshots
+		snapshotLocker.Unlock()
+		endHooks, historyWritable, snapshotWritable = prevEndHooks, prevHistoryWritable, prevSnapshotWritable
+	})
+	historyWritable, snapshotWritable = false, false
+
+	observe := func() {
+		queryHistogram.WithLabelValues("mysql", "SELECT 1").Observe(0.1)
+	}
+
+	takeBaseSample()
+	observe()
+
+	endHooks = []func(context.Context, *Benchmark){
+		func(context.Context, *Benchmark) {
+			// プロファイルの取得などで終了後にもクエリが発行される
+			observe()
+		},
+	}
+
+	start := time.Now()
+	finish(context.Background(), &Benchmark{ID: 1 << 20, Start: start, End: start.Add(time.Second)})
+
+	snapshot := findSnapshot(1 << 20)
+	require.NotNil(t, snapshot)
+	if assert.Len(t, snapshot.Metrics.Queries, 1) {
+		assert.Equal(t, uint64(1), snapshot.Metrics.Queries[0].Count)
+	}
+}
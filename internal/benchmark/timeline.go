@@ -0,0 +1,279 @@
+package benchmark
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxTimelineSeconds 記録する時系列の最大長
+	maxTimelineSeconds = 30 * 60
+	// loadThreshold ピーク時のリクエストレートに対してこの割合以上の区間を負荷走行とみなす
+	loadThreshold = 0.5
+)
+
+const (
+	PhaseInitialize      = "initialize"
+	PhasePreValidation   = "pre_validation"
+	PhaseLoad            = "load"
+	PhaseFinalValidation = "final_validation"
+)
+
+type timelineBucket struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64
+}
+
+var (
+	// timelineOrigin 時系列の原点(UnixNano)
+	// BeforeInitializeで呼ばれるPrepareの時刻、呼ばれていない場合はStartの時刻になる
+	timelineOrigin = atomic.Int64{}
+	// timelineStart originからStartまでの秒数
+	timelineStart = atomic.Int64{}
+	// timelineEnd originからベンチマーク終了までの秒数、走行中は-1
+	timelineEnd = atomic.Int64{}
+	prepared    = atomic.Pointer[time.Time]{}
+	timeline    [maxTimelineSeconds]timelineBucket
+)
+
+func init() {
+	if !config.Enable {
+		return
+	}
+
+	prometheus.MustRegister(phaseCollector{
+		startDesc: prometheus.NewDesc(
+			"isutools_benchmark_phase_start_seconds",
+			"start of the benchmark phase in seconds from the beginning of the timeline",
+			[]string{"phase"}, nil,
+		),
+		durationDesc: prometheus.NewDesc(
+			"isutools_benchmark_phase_duration_seconds",
+			"duration of the benchmark phase in seconds",
+			[]string{"phase"}, nil,
+		),
+	})
+}
+
+// Prepare 初期化処理の開始を記録する
+func Prepare() {
+	if !config.Enable {
+		return
+	}
+
+	now := time.Now()
+	prepared.Store(&now)
+	resetTimeline(now)
+}
+
+func startTimeline(start time.Time) {
+	prepareTime := prepared.Swap(nil)
+	if prepareTime == nil || start.Sub(*prepareTime) > time.Duration(maxTimelineSeconds)*time.Second {
+		resetTimeline(start)
+		return
+	}
+
+	timelineStart.Store(int64(start.Sub(*prepareTime) / time.Second))
+}
+
+func endTimeline(end time.Time) {
+	origin := timelineOrigin.Load()
+	if origin == 0 {
+		return
+	}
+
+	timelineEnd.Store(int64(end.Sub(time.Unix(0, origin))/time.Second) + 1)
+}
+
+func resetTimeline(origin time.Time) {
+	timelineOrigin.Store(0)
+	for i := range timeline {
+		timeline[i].requests.Store(0)
+		timeline[i].errors.Store(0)
+	}
+	timelineStart.Store(0)
+	timelineEnd.Store(-1)
+	timelineOrigin.Store(origin.UnixNano())
+}
+
+// Observe レスポンスを返したリクエストを記録する
+func Observe(statusCode int) {
+	origin := timelineOrigin.Load()
+	if origin == 0 {
+		return
+	}
+
+	i := time.Since(time.Unix(0, origin)) / time.Second
+	if i < 0 || i >= maxTimelineSeconds {
+		return
+	}
+
+	timeline[i].requests.Add(1)
+	if statusCode >= 500 {
+		timeline[i].errors.Add(1)
+	}
+}
+
+type TimelinePoint struct {
+	Second   int    `json:"second"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+type Phase struct {
+	Name  string  `json:"name"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type Timeline struct {
+	Origin time.Time       `json:"origin"`
+	Points []TimelinePoint `json:"points"`
+	Phases []Phase         `json:"phases"`
+}
+
+func currentTimeline() *Timeline {
+	origin := timelineOrigin.Load()
+	if origin == 0 {
+		return nil
+	}
+
+	originTime := time.Unix(0, origin)
+
+	length := int(timelineEnd.Load())
+	if length < 0 {
+		length = int(time.Since(originTime)/time.Second) + 1
+	}
+	length = min(length, maxTimelineSeconds)
+
+	points := make([]TimelinePoint, 0, length)
+	requests := make([]uint64, 0, length)
+	for i := range length {
+		points = append(points, TimelinePoint{
+			Second:   i,
+			Requests: timeline[i].requests.Load(),
+			Errors:   timeline[i].errors.Load(),
+		})
+		requests = append(requests, points[i].Requests)
+	}
+
+	return &Timeline{
+		Origin: originTime,
+		Points: points,
+		Phases: detectPhases(requests, int(timelineStart.Load())),
+	}
+}
+
+// detectPhases 秒ごとのリクエスト数からベンチマークのフェーズを推定する
+// start以前は初期化処理、それ以降はリクエストレートがピークのloadThreshold以上の区間を負荷走行とし、
+// その前後を事前検証、最終検証とみなす
+func detectPhases(requests []uint64, start int) []Phase {
+	var phases []Phase
+	if start > 0 {
+		phases = append(phases, Phase{
+			Name:  PhaseInitialize,
+			Start: 0,
+			End:   float64(start),
+		})
+	}
+
+	if start >= len(requests) {
+		return phases
+	}
+
+	// 1秒ごとのばらつきを抑えるため、前後1秒との移動平均をとる
+	rates := requests[start:]
+	smoothed := make([]float64, len(rates))
+	var peak float64
+	for i := range rates {
+		var (
+			sum   float64
+			count float64
+		)
+		for j := max(i-1, 0); j <= min(i+1, len(rates)-1); j++ {
+			sum += float64(rates[j])
+			count++
+		}
+		smoothed[i] = sum / count
+		peak = max(peak, smoothed[i])
+	}
+
+	loadStart, loadEnd := -1, -1
+	if peak > 0 {
+		for i, rate := range smoothed {
+			if rate >= peak*loadThreshold {
+				if loadStart < 0 {
+					loadStart = i
+				}
+				loadEnd = i + 1
+			}
+		}
+	}
+
+	if loadStart < 0 {
+		return append(phases, Phase{
+			Name:  PhasePreValidation,
+			Start: float64(start),
+			End:   float64(len(requests)),
+		})
+	}
+
+	if loadStart > 0 {
+		phases = append(phases, Phase{
+			Name:  PhasePreValidation,
+			Start: float64(start),
+			End:   float64(start + loadStart),
+		})
+	}
+	phases = append(phases, Phase{
+		Name:  PhaseLoad,
+		Start: float64(start + loadStart),
+		End:   float64(start + loadEnd),
+	})
+	if loadEnd < len(rates) {
+		phases = append(phases, Phase{
+			Name:  PhaseFinalValidation,
+			Start: float64(start + loadEnd),
+			End:   float64(len(requests)),
+		})
+	}
+
+	return phases
+}
+
+type phaseCollector struct {
+	startDesc    *prometheus.Desc
+	durationDesc *prometheus.Desc
+}
+
+func (c phaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.startDesc
+	ch <- c.durationDesc
+}
+
+func (c phaseCollector) Collect(ch chan<- prometheus.Metric) {
+	tl := currentTimeline()
+	if tl == nil {
+		return
+	}
+
+	for _, phase := range tl.Phases {
+		ch <- prometheus.MustNewConstMetric(c.startDesc, prometheus.GaugeValue, phase.Start, phase.Name)
+		ch <- prometheus.MustNewConstMetric(c.durationDesc, prometheus.GaugeValue, phase.End-phase.Start, phase.Name)
+	}
+}
+
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	tl := currentTimeline()
+	if tl == nil {
+		http.Error(w, "no timeline", http.StatusNotFound)
+		return
+	}
+
+	response.JSON(w, tl)
+}
@@ -0,0 +1,59 @@
+package benchmark
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectPhases(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []uint64
+		start    int
+		expected []Phase
+	}{
+		{
+			name:     "all phases",
+			requests: []uint64{1, 1, 1, 5, 5, 5, 100, 100, 100, 100, 100, 3, 3, 3},
+			start:    3,
+			expected: []Phase{
+				{Name: PhaseInitialize, Start: 0, End: 3},
+				{Name: PhasePreValidation, Start: 3, End: 6},
+				{Name: PhaseLoad, Start: 6, End: 11},
+				{Name: PhaseFinalValidation, Start: 11, End: 14},
+			},
+		},
+		{
+			name:     "without initialize",
+			requests: []uint64{100, 100, 100, 100},
+			start:    0,
+			expected: []Phase{
+				{Name: PhaseLoad, Start: 0, End: 4},
+			},
+		},
+		{
+			name:     "no requests",
+			requests: []uint64{0, 0, 0},
+			start:    1,
+			expected: []Phase{
+				{Name: PhaseInitialize, Start: 0, End: 1},
+				{Name: PhasePreValidation, Start: 1, End: 3},
+			},
+		},
+		{
+			name:     "not started",
+			requests: []uint64{1, 1},
+			start:    2,
+			expected: []Phase{
+				{Name: PhaseInitialize, Start: 0, End: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, detectPhases(test.requests, test.start))
+		})
+	}
+}
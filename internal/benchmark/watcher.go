@@ -0,0 +1,84 @@
+package benchmark
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+)
+
+var (
+	watchInterval = time.Second
+	// idleTimeout 最後のリクエストからこの時間リクエストがなければベンチマークが終了したとみなす
+	// 0以下の場合は終了検知を行わない
+	idleTimeout = 10 * time.Second
+)
+
+func init() {
+	if !config.Enable {
+		return
+	}
+
+	strIdleTimeout, ok := os.LookupEnv("BENCHMARK_IDLE_TIMEOUT")
+	if !ok {
+		return
+	}
+
+	timeout, err := time.ParseDuration(strIdleTimeout)
+	if err != nil {
+		slog.Error("failed to parse BENCHMARK_IDLE_TIMEOUT",
+			slog.String("BENCHMARK_IDLE_TIMEOUT", strIdleTimeout),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	idleTimeout = timeout
+}
+
+// watch Endが過ぎた時点の値を取得し、idleTimeoutの間リクエストがなければ終了させる
+func watch(r *run) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if current.Load() != r || r.finished.Load() {
+			return
+		}
+
+		end := end.Load()
+		if end == nil || time.Now().Before(*end) {
+			continue
+		}
+
+		sampleEnd(context.Background(), r.id, r.start, *end)
+
+		// endは最後のリクエストの2秒後なので、そこから計測する
+		if idleTimeout <= 0 || time.Since(*end) < idleTimeout {
+			continue
+		}
+
+		if !r.finished.CompareAndSwap(false, true) {
+			return
+		}
+
+		slog.Info("benchmark end detected",
+			slog.Int("id", r.id),
+			slog.Time("start", r.start),
+			slog.Time("end", *end),
+		)
+
+		finish(context.Background(), &Benchmark{
+			ID:       r.id,
+			Start:    r.start,
+			End:      *end,
+			Commit:   commit,
+			Host:     config.Host,
+			Unscored: true,
+		})
+
+		return
+	}
+}
@@ -0,0 +1,120 @@
+package benchmark
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWatchAndAttachScore 走行中のベンチマークや履歴を書き換えるので、並行に実行しない
+func TestWatchAndAttachScore(t *testing.T) {
+	historyLocker.Lock()
+	prevHistory := history
+	historyLocker.Unlock()
+	snapshotLocker.Lock()
+	prevSnapshots := snapshots
+	snapshotLocker.Unlock()
+	prevEndHooks, prevHistoryWritable, prevSnapshotWritable := endHooks, historyWritable, snapshotWritable
+	prevInterval, prevIdleTimeout := watchInterval, idleTimeout
+	prevCurrent, prevEnd := current.Load(), end.Load()
+	t.Cleanup(func() {
+		historyLocker.Lock()
+		history = prevHistory
+		historyLocker.Unlock()
+		snapshotLocker.Lock()
+		snapshots = prevSnapshots
+		snapshotLocker.Unlock()
+		endHooks, historyWritable, snapshotWritable = prevEndHooks, prevHistoryWritable, prevSnapshotWritable
+		watchInterval, idleTimeout = prevInterval, prevIdleTimeout
+		current.Store(prevCurrent)
+		end.Store(prevEnd)
+	})
+	historyWritable, snapshotWritable = false, false
+	watchInterval = 10 * time.Millisecond
+	idleTimeout = 100 * time.Millisecond
+
+	finished := make(chan *Benchmark, 1)
+	endHooks = []func(context.Context, *Benchmark){
+		func(_ context.Context, b *Benchmark) {
+			finished <- b
+		},
+	}
+
+	const id = 1 << 21
+	r := &run{id: id, start: time.Now()}
+	current.Store(r)
+	lastEnd := time.Now()
+	end.Store(&lastEnd)
+
+	go watch(r)
+
+	var b *Benchmark
+	select {
+	case b = <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("benchmark end is not detected")
+	}
+
+	assert.Equal(t, id, b.ID)
+	assert.True(t, b.Unscored)
+	assert.True(t, lastEnd.Equal(b.End))
+	assert.GreaterOrEqual(t, time.Since(lastEnd), idleTimeout)
+	assert.True(t, r.finished.Load())
+
+	if latest := Latest(); assert.NotNil(t, latest) {
+		assert.Equal(t, id, latest.ID)
+		assert.True(t, latest.Unscored)
+	}
+
+	mux := http.NewServeMux()
+	Register(mux)
+
+	post := func(path string, form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		description string
+		path        string
+		form        url.Values
+		status      int
+	}{
+		{description: "invalid score", path: "/benchmark/2097152/score", form: url.Values{"score": {"high"}}, status: http.StatusBadRequest},
+		{description: "unknown id", path: "/benchmark/1/score", form: url.Values{"score": {"100"}}, status: http.StatusNotFound},
+		{description: "attach", path: "/benchmark/2097152/score", form: url.Values{"score": {"1234"}, "note": {"late"}}, status: http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			assert.Equal(t, test.status, post(test.path, test.form))
+		})
+	}
+
+	latest := Latest()
+	require.NotNil(t, latest)
+	assert.Equal(t, id, latest.ID)
+	assert.False(t, latest.Unscored)
+	assert.Equal(t, int64(1234), latest.Score)
+	assert.Equal(t, "late", latest.Note)
+	assert.True(t, lastEnd.Equal(latest.End))
+
+	if snapshot := findSnapshot(id); assert.NotNil(t, snapshot) {
+		assert.Equal(t, int64(1234), snapshot.Benchmark.Score)
+		assert.False(t, snapshot.Benchmark.Unscored)
+	}
+
+	if best := Best(); assert.NotNil(t, best) {
+		assert.Equal(t, id, best.ID)
+	}
+}
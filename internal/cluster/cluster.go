@@ -0,0 +1,436 @@
+package cluster
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/dashboard"
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+const fetchTimeout = 5 * time.Second
+
+var errNotFound = errors.New("not found")
+
+type Peer struct {
+	Name string
+	URL  string
+}
+
+var peers []Peer
+
+func init() {
+	strPeers, ok := os.LookupEnv("ISUTOOLS_PEERS")
+	if !ok {
+		return
+	}
+
+	peers = ParsePeers(strPeers)
+}
+
+// Peers ISUTOOLS_PEERSで指定された他ホストのadminサーバー
+func Peers() []Peer {
+	return peers
+}
+
+// ParsePeers "name=http://host:6060,http://host2:6060" の形式の文字列をパースする
+// 名前を省略した場合はURLを名前として扱う
+func ParsePeers(s string) []Peer {
+	var peers []Peer
+	for _, strPeer := range strings.Split(s, ",") {
+		strPeer = strings.TrimSpace(strPeer)
+		if strPeer == "" {
+			continue
+		}
+
+		name, url, ok := strings.Cut(strPeer, "=")
+		if !ok {
+			url = name
+		}
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+
+		peers = append(peers, Peer{
+			Name: name,
+			URL:  strings.TrimSuffix(url, "/"),
+		})
+	}
+
+	return peers
+}
+
+type source struct {
+	host  string
+	fetch func(ctx context.Context, path string) ([]byte, error)
+}
+
+type Aggregator struct {
+	sources []source
+}
+
+// NewAggregator 自ホスト(self)と他ホストのadminサーバーの結果をまとめるAggregatorを作成する
+// selfはHTTPを経由せずに直接呼び出す
+// 結果はホスト名ごとにまとめるため、重複したホスト名には連番を付けて区別する
+func NewAggregator(selfName string, self http.Handler, peers []Peer, client *http.Client) *Aggregator {
+	a := &Aggregator{}
+	names := map[string]int{}
+	if self != nil {
+		a.sources = append(a.sources, source{
+			host:  uniqueName(names, selfName),
+			fetch: handlerFetcher(self),
+		})
+	}
+
+	for _, peer := range peers {
+		a.sources = append(a.sources, source{
+			host:  uniqueName(names, peer.Name),
+			fetch: httpFetcher(client, peer.URL),
+		})
+	}
+
+	return a
+}
+
+// uniqueName 2つ目以降の同じ名前に"#2"のような連番を付ける
+func uniqueName(names map[string]int, name string) string {
+	unique := name
+	for names[unique] > 0 {
+		names[name]++
+		unique = fmt.Sprintf("%s#%d", name, names[name])
+	}
+	names[unique]++
+
+	if unique != name {
+		slog.Warn("duplicate host name in ISUTOOLS_PEERS",
+			slog.String("name", name),
+			slog.String("renamed", unique),
+		)
+	}
+
+	return unique
+}
+
+func httpFetcher(client *http.Client, baseURL string) func(context.Context, string) ([]byte, error) {
+	return func(ctx context.Context, path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		admin.Authorize(req)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to request: %w", err)
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+
+		return checkStatus(res.StatusCode, body)
+	}
+}
+
+func handlerFetcher(handler http.Handler) func(context.Context, string) ([]byte, error) {
+	return func(ctx context.Context, path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		w := &bufferResponseWriter{
+			header:     http.Header{},
+			statusCode: http.StatusOK,
+		}
+		handler.ServeHTTP(w, req)
+
+		return checkStatus(w.statusCode, w.body.Bytes())
+	}
+}
+
+func checkStatus(statusCode int, body []byte) ([]byte, error) {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return nil, errNotFound
+	case statusCode >= 400:
+		return nil, fmt.Errorf("unexpected status code %d: %s", statusCode, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+type bufferResponseWriter struct {
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *bufferResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.statusCode = statusCode
+	w.wroteHeader = true
+}
+
+func (w *bufferResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(b)
+}
+
+type HostError struct {
+	Host  string `json:"host"`
+	Error string `json:"error"`
+}
+
+// fetchAll 全ホストから並行にpathの結果を取得する
+// 404のホストはnilとして扱う
+func fetchAll[T any](ctx context.Context, a *Aggregator, path string) (map[string]*T, []HostError) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	var (
+		locker  sync.Mutex
+		results = make(map[string]*T, len(a.sources))
+		errs    []HostError
+		wg      sync.WaitGroup
+	)
+	for _, src := range a.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			v, err := func() (*T, error) {
+				body, err := src.fetch(ctx, path)
+				if errors.Is(err, errNotFound) {
+					return nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+
+				var v T
+				err = json.Unmarshal(body, &v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decode response: %w", err)
+				}
+
+				return &v, nil
+			}()
+
+			locker.Lock()
+			defer locker.Unlock()
+
+			if err != nil {
+				slog.Error("failed to fetch from host",
+					slog.String("host", src.host),
+					slog.String("path", path),
+					slog.String("error", err.Error()),
+				)
+				errs = append(errs, HostError{Host: src.host, Error: err.Error()})
+				return
+			}
+
+			results[src.host] = v
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(errs, func(a, b HostError) int {
+		return cmp.Compare(a.Host, b.Host)
+	})
+
+	return results, errs
+}
+
+func (a *Aggregator) hosts() []string {
+	hosts := make([]string, 0, len(a.sources))
+	for _, src := range a.sources {
+		hosts = append(hosts, src.host)
+	}
+
+	return hosts
+}
+
+type Queries struct {
+	Queries []map[string]any `json:"queries"`
+	Errors  []HostError      `json:"errors,omitempty"`
+}
+
+func (a *Aggregator) Queries(ctx context.Context) *Queries {
+	results, errs := fetchAll[[]map[string]any](ctx, a, "/queries")
+
+	queries := &Queries{
+		Queries: []map[string]any{},
+		Errors:  errs,
+	}
+	for _, host := range a.hosts() {
+		result, ok := results[host]
+		if !ok || result == nil {
+			continue
+		}
+
+		for _, q := range *result {
+			q["host"] = host
+			queries.Queries = append(queries.Queries, q)
+		}
+	}
+
+	return queries
+}
+
+type HostBenchmark struct {
+	Host      string               `json:"host"`
+	Benchmark *benchmark.Benchmark `json:"benchmark"`
+}
+
+type Benchmarks struct {
+	Benchmarks []HostBenchmark `json:"benchmarks"`
+	Errors     []HostError     `json:"errors,omitempty"`
+}
+
+func (a *Aggregator) LatestBenchmarks(ctx context.Context) *Benchmarks {
+	results, errs := fetchAll[benchmark.Benchmark](ctx, a, "/benchmark/latest")
+
+	benchmarks := &Benchmarks{
+		Benchmarks: []HostBenchmark{},
+		Errors:     errs,
+	}
+	for _, host := range a.hosts() {
+		result, ok := results[host]
+		if !ok {
+			continue
+		}
+
+		benchmarks.Benchmarks = append(benchmarks.Benchmarks, HostBenchmark{
+			Host:      host,
+			Benchmark: result,
+		})
+	}
+
+	return benchmarks
+}
+
+type HostEndpoint struct {
+	Host string `json:"host"`
+	metrics.Endpoint
+}
+
+type HostQuery struct {
+	Host string `json:"host"`
+	metrics.Query
+}
+
+type HostCache struct {
+	Host string `json:"host"`
+	metrics.Cache
+}
+
+type Summary struct {
+	Hosts      []string        `json:"hosts"`
+	Benchmarks []HostBenchmark `json:"benchmarks"`
+	Endpoints  []HostEndpoint  `json:"endpoints"`
+	Queries    []HostQuery     `json:"queries"`
+	Caches     []HostCache     `json:"caches"`
+	Errors     []HostError     `json:"errors,omitempty"`
+}
+
+func (a *Aggregator) Summary(ctx context.Context) *Summary {
+	results, errs := fetchAll[dashboard.Summary](ctx, a, "/dashboard/summary")
+
+	summary := &Summary{
+		Hosts:      a.hosts(),
+		Benchmarks: []HostBenchmark{},
+		Endpoints:  []HostEndpoint{},
+		Queries:    []HostQuery{},
+		Caches:     []HostCache{},
+		Errors:     errs,
+	}
+	for _, host := range summary.Hosts {
+		result, ok := results[host]
+		if !ok || result == nil {
+			continue
+		}
+
+		summary.Benchmarks = append(summary.Benchmarks, HostBenchmark{
+			Host:      host,
+			Benchmark: result.Benchmark,
+		})
+
+		if result.Summary == nil {
+			continue
+		}
+		for _, e := range result.Endpoints {
+			summary.Endpoints = append(summary.Endpoints, HostEndpoint{Host: host, Endpoint: e})
+		}
+		for _, q := range result.Queries {
+			summary.Queries = append(summary.Queries, HostQuery{Host: host, Query: q})
+		}
+		for _, c := range result.Caches {
+			summary.Caches = append(summary.Caches, HostCache{Host: host, Cache: c})
+		}
+	}
+
+	slices.SortFunc(summary.Endpoints, func(a, b HostEndpoint) int {
+		return cmp.Compare(b.Total, a.Total)
+	})
+	slices.SortFunc(summary.Queries, func(a, b HostQuery) int {
+		return cmp.Compare(b.Total, a.Total)
+	})
+	slices.SortFunc(summary.Caches, func(a, b HostCache) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Host, b.Host))
+	})
+
+	return summary
+}
+
+func (a *Aggregator) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /cluster/queries", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, a.Queries(r.Context()))
+	})
+	mux.HandleFunc("GET /cluster/benchmark/latest", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, a.LatestBenchmarks(r.Context()))
+	})
+	mux.HandleFunc("GET /cluster/dashboard/summary", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, a.Summary(r.Context()))
+	})
+}
+
+// Register ISUTOOLS_PEERSが設定されている場合のみ、集約用のエンドポイントを登録する
+func Register(mux *http.ServeMux) {
+	if len(peers) == 0 {
+		return
+	}
+
+	selfName := config.Host
+	if selfName == "" {
+		selfName, _ = os.Hostname()
+	}
+
+	NewAggregator(selfName, mux, peers, &http.Client{}).Register(mux)
+}
@@ -0,0 +1,210 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/dashboard"
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+type fakeHost struct {
+	queries   []map[string]any
+	benchmark *benchmark.Benchmark
+	summary   *dashboard.Summary
+}
+
+func (h *fakeHost) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /queries", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, h.queries)
+	})
+	mux.HandleFunc("GET /benchmark/latest", func(w http.ResponseWriter, r *http.Request) {
+		if h.benchmark == nil {
+			http.Error(w, "no latest benchmark", http.StatusNotFound)
+			return
+		}
+		response.JSON(w, h.benchmark)
+	})
+	mux.HandleFunc("GET /dashboard/summary", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, h.summary)
+	})
+
+	return mux
+}
+
+func TestParsePeers(t *testing.T) {
+	t.Parallel()
+
+	peers := ParsePeers("isu2=http://192.168.0.12:6060/, 192.168.0.13:6060,")
+
+	expected := []Peer{
+		{Name: "isu2", URL: "http://192.168.0.12:6060"},
+		{Name: "192.168.0.13:6060", URL: "http://192.168.0.13:6060"},
+	}
+	if len(peers) != len(expected) {
+		t.Fatalf("unexpected peers: %+v", peers)
+	}
+	for i := range expected {
+		if peers[i] != expected[i] {
+			t.Errorf("peers[%d]: expected %+v, got %+v", i, expected[i], peers[i])
+		}
+	}
+}
+
+func TestNewAggregatorDuplicateNames(t *testing.T) {
+	t.Parallel()
+
+	aggregator := NewAggregator("isu1", http.NotFoundHandler(), []Peer{
+		{Name: "isu1", URL: "http://192.168.0.11:6060"},
+		{Name: "isu2", URL: "http://192.168.0.12:6060"},
+		{Name: "isu2", URL: "http://192.168.0.13:6060"},
+		{Name: "isu2#2", URL: "http://192.168.0.14:6060"},
+	}, &http.Client{})
+
+	expected := []string{"isu1", "isu1#2", "isu2", "isu2#2", "isu2#2#2"}
+	if len(aggregator.sources) != len(expected) {
+		t.Fatalf("unexpected sources: %+v", aggregator.sources)
+	}
+	for i, host := range expected {
+		if aggregator.sources[i].host != host {
+			t.Errorf("sources[%d]: expected %s, got %s", i, host, aggregator.sources[i].host)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	self := &fakeHost{
+		queries: []map[string]any{
+			{"id": "q1", "driver": "mysql", "normalized": "SELECT * FROM users WHERE id = ?"},
+		},
+		benchmark: &benchmark.Benchmark{ID: 3, Start: start, End: start.Add(time.Minute), Score: 1000},
+		summary: &dashboard.Summary{
+			Summary: &metrics.Summary{
+				Endpoints: []metrics.Endpoint{{Method: "GET", URL: "/api/users", Count: 10, Total: 1}},
+				Queries:   []metrics.Query{{Driver: "mysql", Query: "SELECT * FROM users WHERE id = ?", Count: 10, Total: 0.5}},
+			},
+		},
+	}
+	isu2 := &fakeHost{
+		queries: []map[string]any{
+			{"id": "q2", "driver": "mysql", "normalized": "SELECT * FROM posts"},
+		},
+		summary: &dashboard.Summary{
+			Summary: &metrics.Summary{
+				Endpoints: []metrics.Endpoint{{Method: "GET", URL: "/api/posts", Count: 5, Total: 30}},
+				Queries:   []metrics.Query{{Driver: "mysql", Query: "SELECT * FROM posts", Count: 5, Total: 25}},
+			},
+		},
+	}
+
+	isu2Server := httptest.NewServer(isu2.mux())
+	t.Cleanup(isu2Server.Close)
+
+	downServer := httptest.NewServer(http.NotFoundHandler())
+	downServer.Close()
+
+	aggregator := NewAggregator("isu1", self.mux(), []Peer{
+		{Name: "isu2", URL: isu2Server.URL},
+		{Name: "isu3", URL: downServer.URL},
+	}, &http.Client{})
+
+	mux := http.NewServeMux()
+	aggregator.Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	t.Run("queries", func(t *testing.T) {
+		t.Parallel()
+
+		var queries Queries
+		get(t, server.URL+"/cluster/queries", &queries)
+
+		if len(queries.Queries) != 2 {
+			t.Fatalf("expected 2 queries, got %+v", queries.Queries)
+		}
+		if queries.Queries[0]["host"] != "isu1" || queries.Queries[0]["id"] != "q1" {
+			t.Errorf("unexpected query: %+v", queries.Queries[0])
+		}
+		if queries.Queries[1]["host"] != "isu2" || queries.Queries[1]["id"] != "q2" {
+			t.Errorf("unexpected query: %+v", queries.Queries[1])
+		}
+		if len(queries.Errors) != 1 || queries.Errors[0].Host != "isu3" {
+			t.Errorf("expected error of isu3, got %+v", queries.Errors)
+		}
+	})
+
+	t.Run("benchmark", func(t *testing.T) {
+		t.Parallel()
+
+		var benchmarks Benchmarks
+		get(t, server.URL+"/cluster/benchmark/latest", &benchmarks)
+
+		if len(benchmarks.Benchmarks) != 2 {
+			t.Fatalf("expected 2 benchmarks, got %+v", benchmarks.Benchmarks)
+		}
+		if b := benchmarks.Benchmarks[0]; b.Host != "isu1" || b.Benchmark == nil || b.Benchmark.Score != 1000 {
+			t.Errorf("unexpected benchmark: %+v", b)
+		}
+		if b := benchmarks.Benchmarks[1]; b.Host != "isu2" || b.Benchmark != nil {
+			t.Errorf("unexpected benchmark: %+v", b)
+		}
+	})
+
+	t.Run("summary", func(t *testing.T) {
+		t.Parallel()
+
+		var summary Summary
+		get(t, server.URL+"/cluster/dashboard/summary", &summary)
+
+		if len(summary.Hosts) != 3 {
+			t.Errorf("expected 3 hosts, got %v", summary.Hosts)
+		}
+		if len(summary.Endpoints) != 2 {
+			t.Fatalf("expected 2 endpoints, got %+v", summary.Endpoints)
+		}
+		// 合計時間の大きいisu2のエンドポイントが先頭に来る
+		if e := summary.Endpoints[0]; e.Host != "isu2" || e.URL != "/api/posts" {
+			t.Errorf("unexpected endpoint: %+v", e)
+		}
+		if q := summary.Queries[0]; q.Host != "isu2" || q.Query.Query != "SELECT * FROM posts" {
+			t.Errorf("unexpected query: %+v", q)
+		}
+		if len(summary.Errors) != 1 || summary.Errors[0].Host != "isu3" {
+			t.Errorf("expected error of isu3, got %+v", summary.Errors)
+		}
+	})
+}
+
+func get(t *testing.T, url string, v any) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+	最終計測用のモード
+	ISUTOOLS_FINAL=trueの場合、計測・ログ・adminサーバーを全て無効化し、
+	ISUTOOLS_FINAL_KEEPで指定した高速化のための設定のみを残す
+*/
+
+const (
+	TweakUnixSocket        = "unix_socket"
+	TweakGoJSON            = "go_json"
+	TweakInterpolateParams = "interpolate_params"
+	// TweakDBConn SetMaxIdleConnsなどのコネクションの設定
+	TweakDBConn = "db_conn"
+	// TweakHTTPTransport http.DefaultTransportのコネクションプールの設定
+	TweakHTTPTransport = "http_transport"
+)
+
+var (
+	Final      = false
+	tweaks     = []string{TweakUnixSocket, TweakGoJSON, TweakInterpolateParams, TweakDBConn, TweakHTTPTransport}
+	keptTweaks = []string{TweakUnixSocket, TweakGoJSON, TweakInterpolateParams, TweakDBConn}
+)
+
+func init() {
+	strFinal, ok := os.LookupEnv("ISUTOOLS_FINAL")
+	if !ok {
+		return
+	}
+
+	final, err := strconv.ParseBool(strings.TrimSpace(strFinal))
+	if err != nil {
+		slog.Error("failed to parse ISUTOOLS_FINAL",
+			slog.String("ISUTOOLS_FINAL", strFinal),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	if !final {
+		return
+	}
+
+	Final = true
+	Enable = false
+
+	strKeep, ok := os.LookupEnv("ISUTOOLS_FINAL_KEEP")
+	if ok {
+		keptTweaks = nil
+		for _, tweak := range strings.Split(strKeep, ",") {
+			tweak = strings.TrimSpace(tweak)
+			if tweak == "" {
+				continue
+			}
+
+			if !slices.Contains(tweaks, tweak) {
+				slog.Error("unknown tweak in ISUTOOLS_FINAL_KEEP",
+					slog.String("tweak", tweak),
+					slog.Any("available", tweaks),
+				)
+				continue
+			}
+
+			keptTweaks = append(keptTweaks, tweak)
+		}
+	}
+
+	reportFinal()
+}
+
+// Tweak 高速化のための設定を適用するかどうか
+// 通常時は全て適用し、最終計測モードではISUTOOLS_FINAL_KEEPで指定したもののみ適用する
+func Tweak(name string) bool {
+	if !Final {
+		return true
+	}
+
+	return slices.Contains(keptTweaks, name)
+}
+
+func reportFinal() {
+	var disabled []string
+	for _, tweak := range tweaks {
+		if !Tweak(tweak) {
+			disabled = append(disabled, tweak)
+		}
+	}
+
+	// 最終計測モードではslogの出力を捨てるため、標準エラー出力に直接書き込む
+	slog.New(slog.NewTextHandler(os.Stderr, nil)).Info("isutools final mode",
+		slog.Bool("metrics", false),
+		slog.Bool("log", false),
+		slog.Bool("admin_server", false),
+		slog.Any("tweaks", keptTweaks),
+		slog.Any("disabled_tweaks", disabled),
+	)
+}
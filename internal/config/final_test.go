@@ -0,0 +1,21 @@
+package config
+
+import "testing"
+
+func TestTweak(t *testing.T) {
+	if !Tweak(TweakHTTPTransport) {
+		t.Errorf("all tweaks should be applied outside final mode")
+	}
+
+	Final = true
+	t.Cleanup(func() {
+		Final = false
+	})
+
+	if !Tweak(TweakUnixSocket) {
+		t.Errorf("%s should be kept by default", TweakUnixSocket)
+	}
+	if Tweak(TweakHTTPTransport) {
+		t.Errorf("%s should be stripped by default", TweakHTTPTransport)
+	}
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+const measureToggle = "measure"
+
+var (
+	// measuring 計測の有効/無効を実行中に切り替えるためのスイッチ
+	// Enableがfalseの場合は常に無効
+	measuring    = atomic.Bool{}
+	toggleLocker = &sync.RWMutex{}
+	toggles      = map[string]toggle{}
+	errNoToggle  = errors.New("toggle not found")
+	errReadOnly  = errors.New("toggle is read-only")
+)
+
+type toggle struct {
+	get func() bool
+	// set 起動時にのみ参照される設定の場合はnil
+	set func(bool)
+}
+
+func init() {
+	measuring.Store(true)
+	RegisterToggle(measureToggle, measuring.Load, measuring.Store)
+}
+
+// Measuring 計測を行うかどうか
+// ミドルウェアやDBのラッパーなど、リクエストごとに呼ばれる箇所で確認する
+func Measuring() bool {
+	return Enable && measuring.Load()
+}
+
+func SetMeasuring(enable bool) {
+	measuring.Store(enable)
+}
+
+// RegisterToggle /configから参照・変更できる設定を登録する
+// get, setは並行に呼ばれるため、atomicな操作にする
+func RegisterToggle(name string, get func() bool, set func(bool)) {
+	toggleLocker.Lock()
+	defer toggleLocker.Unlock()
+
+	toggles[name] = toggle{
+		get: get,
+		set: set,
+	}
+}
+
+// RegisterReadOnly DBの接続時などにのみ参照され、実行中に変更しても反映されない設定を登録する
+// /configで値は確認できるが、変更はできない
+func RegisterReadOnly(name string, get func() bool) {
+	toggleLocker.Lock()
+	defer toggleLocker.Unlock()
+
+	toggles[name] = toggle{
+		get: get,
+	}
+}
+
+func Toggles() map[string]bool {
+	toggleLocker.RLock()
+	defer toggleLocker.RUnlock()
+
+	values := make(map[string]bool, len(toggles))
+	for name, t := range toggles {
+		values[name] = t.get()
+	}
+
+	return values
+}
+
+func readOnlyToggles() []string {
+	toggleLocker.RLock()
+	defer toggleLocker.RUnlock()
+
+	names := []string{}
+	for name, t := range toggles {
+		if t.set == nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func SetToggle(name string, value bool) error {
+	toggleLocker.RLock()
+	defer toggleLocker.RUnlock()
+
+	t, ok := toggles[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoToggle, name)
+	}
+	if t.set == nil {
+		return fmt.Errorf("%w: %s", errReadOnly, name)
+	}
+
+	t.set(value)
+
+	slog.Info("config changed",
+		slog.String("name", name),
+		slog.Bool("value", value),
+	)
+
+	return nil
+}
+
+type configResponse struct {
+	Enable  bool            `json:"enable"`
+	Host    string          `json:"host"`
+	Toggles map[string]bool `json:"toggles"`
+	// ReadOnly 起動時にのみ参照されるため、POST /configで変更できない設定
+	ReadOnly []string `json:"read_only"`
+}
+
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /config", configHandler)
+	// form(name=true)またはJSON({"name": true})で複数の設定をまとめて変更する
+	mux.HandleFunc("POST /config", func(w http.ResponseWriter, r *http.Request) {
+		values := map[string]bool{}
+		if r.Header.Get("Content-Type") == "application/json" {
+			err := json.NewDecoder(r.Body).Decode(&values)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to decode body: %s", err), http.StatusBadRequest)
+				return
+			}
+		} else {
+			err := r.ParseForm()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to parse form: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			for name := range r.Form {
+				strValue := r.Form.Get(name)
+				value, err := strconv.ParseBool(strValue)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to parse %s(%s): %s", name, strValue, err), http.StatusBadRequest)
+					return
+				}
+
+				values[name] = value
+			}
+		}
+
+		// 一部だけ変更されることがないよう、先に全ての設定が存在するか確認する
+		current := Toggles()
+		readOnly := readOnlyToggles()
+		for _, name := range slices.Sorted(maps.Keys(values)) {
+			if _, ok := current[name]; !ok {
+				http.Error(w, fmt.Sprintf("unknown config: %s", name), http.StatusBadRequest)
+				return
+			}
+			if slices.Contains(readOnly, name) {
+				http.Error(w, fmt.Sprintf("read-only config: %s", name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(values)) {
+			err := SetToggle(name, values[name])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		configHandler(w, r)
+	})
+
+	// 計測の有無などプロセスの動作を変えるため、read-onlyモードでは無効化する
+	admin.MarkUnsafe("POST /config")
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	response.JSON(w, configResponse{
+		Enable:   Enable,
+		Host:     Host,
+		Toggles:  Toggles(),
+		ReadOnly: readOnlyToggles(),
+	})
+}
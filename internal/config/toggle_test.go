@@ -0,0 +1,98 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConfigHandler(t *testing.T) {
+	var value atomic.Bool
+	RegisterToggle("test.value", value.Load, value.Store)
+	RegisterReadOnly("test.read_only", func() bool { return true })
+
+	mux := http.NewServeMux()
+	Register(mux)
+
+	tests := []struct {
+		description string
+		contentType string
+		body        string
+		status      int
+		value       bool
+		measuring   bool
+	}{
+		{
+			description: "json",
+			contentType: "application/json",
+			body:        `{"test.value": true, "measure": false}`,
+			status:      http.StatusOK,
+			value:       true,
+			measuring:   false,
+		},
+		{
+			description: "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"test.value": {"false"}, "measure": {"true"}}.Encode(),
+			status:      http.StatusOK,
+			value:       false,
+			measuring:   true,
+		},
+		{
+			description: "unknown config is rejected without partial update",
+			contentType: "application/json",
+			body:        `{"test.value": true, "unknown": true}`,
+			status:      http.StatusBadRequest,
+			value:       false,
+			measuring:   true,
+		},
+		{
+			description: "read-only config is rejected without partial update",
+			contentType: "application/json",
+			body:        `{"test.value": true, "test.read_only": false}`,
+			status:      http.StatusBadRequest,
+			value:       false,
+			measuring:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/config", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if value.Load() != test.value {
+				t.Errorf("expected test.value %t, got %t", test.value, value.Load())
+			}
+			if Measuring() != test.measuring {
+				t.Errorf("expected measuring %t, got %t", test.measuring, Measuring())
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var res configResponse
+			err := json.NewDecoder(w.Body).Decode(&res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Toggles["test.value"] != test.value {
+				t.Errorf("unexpected response: %+v", res)
+			}
+			if !res.Toggles["test.read_only"] || !slices.Contains(res.ReadOnly, "test.read_only") {
+				t.Errorf("read-only config must be listed: %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package dashboard
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+//go:embed static
+var staticFS embed.FS
+
+type Summary struct {
+	Host      string               `json:"host"`
+	Benchmark *benchmark.Benchmark `json:"benchmark,omitempty"`
+	*metrics.Summary
+}
+
+func summary() (*Summary, error) {
+	sample, err := metrics.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Summary{
+		Host:      config.Host,
+		Benchmark: benchmark.Latest(),
+		Summary:   sample.Summary(),
+	}, nil
+}
+
+func Register(mux *http.ServeMux) {
+	static, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		// embedしたディレクトリが存在しないことはないので、panicさせる
+		panic(err)
+	}
+
+	mux.Handle("GET /dashboard/", http.StripPrefix("/dashboard/", http.FileServerFS(static)))
+	mux.HandleFunc("GET /dashboard/summary", func(w http.ResponseWriter, r *http.Request) {
+		s, err := summary()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get summary: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		response.JSON(w, s)
+	})
+}
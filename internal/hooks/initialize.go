@@ -0,0 +1,26 @@
+package hooks
+
+import "sync"
+
+// 初期化処理(POST /initialize)の開始時に呼ぶ関数
+// isutools.BeforeInitializeから呼ばれる
+var (
+	beforeInitializeLocker = &sync.Mutex{}
+	beforeInitializeHooks  []func()
+)
+
+func SetBeforeInitialize(f func()) {
+	beforeInitializeLocker.Lock()
+	defer beforeInitializeLocker.Unlock()
+
+	beforeInitializeHooks = append(beforeInitializeHooks, f)
+}
+
+func BeforeInitialize() {
+	beforeInitializeLocker.Lock()
+	defer beforeInitializeLocker.Unlock()
+
+	for _, f := range beforeInitializeHooks {
+		f()
+	}
+}
@@ -0,0 +1,36 @@
+package hooks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	httpのミドルウェアから、レスポンスの遅いリクエストを通知するためのフック
+	isuhttpがprofilerに依存しないよう、このパッケージを経由する
+*/
+
+type slowRequestHook struct {
+	threshold time.Duration
+	f         func(method, route string, d time.Duration)
+}
+
+var slowRequest = atomic.Pointer[slowRequestHook]{}
+
+// SetSlowRequest threshold以上かかったリクエストについてfを呼ぶよう登録する
+// fはリクエストの処理中に呼ばれるため、重い処理はgoroutineで行う
+func SetSlowRequest(threshold time.Duration, f func(method, route string, d time.Duration)) {
+	slowRequest.Store(&slowRequestHook{
+		threshold: threshold,
+		f:         f,
+	})
+}
+
+func SlowRequest(method, route string, d time.Duration) {
+	hook := slowRequest.Load()
+	if hook == nil || d < hook.threshold {
+		return
+	}
+
+	hook.f(method, route, d)
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"cmp"
+	"math"
+	"slices"
+)
+
+type Delta struct {
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+	Diff float64 `json:"diff"`
+}
+
+func newDelta(from, to float64) Delta {
+	return Delta{
+		From: from,
+		To:   to,
+		Diff: to - from,
+	}
+}
+
+type EndpointDiff struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Count  Delta  `json:"count"`
+	Total  Delta  `json:"total"`
+	P50    Delta  `json:"p50"`
+	P99    Delta  `json:"p99"`
+}
+
+type QueryDiff struct {
+	Driver string `json:"driver"`
+	Query  string `json:"query"`
+	Count  Delta  `json:"count"`
+	Total  Delta  `json:"total"`
+}
+
+type CacheDiff struct {
+	Name     string `json:"name"`
+	HitRatio Delta  `json:"hit_ratio"`
+}
+
+type SummaryDiff struct {
+	Endpoints []EndpointDiff `json:"endpoints"`
+	Queries   []QueryDiff    `json:"queries"`
+	Caches    []CacheDiff    `json:"caches"`
+}
+
+// Diff fromからtoへの変化を、合計時間の変化が大きい順に並べて返す
+// 片方にしか存在しない項目は、もう片方を0として扱う
+func Diff(from, to *Summary) *SummaryDiff {
+	diff := &SummaryDiff{}
+
+	fromEndpoints := make(map[EndpointKey]Endpoint, len(from.Endpoints))
+	for _, e := range from.Endpoints {
+		fromEndpoints[EndpointKey{Method: e.Method, URL: e.URL}] = e
+	}
+	toEndpoints := make(map[EndpointKey]Endpoint, len(to.Endpoints))
+	for _, e := range to.Endpoints {
+		toEndpoints[EndpointKey{Method: e.Method, URL: e.URL}] = e
+	}
+	for _, key := range unionKeys(fromEndpoints, toEndpoints) {
+		f, t := fromEndpoints[key], toEndpoints[key]
+		diff.Endpoints = append(diff.Endpoints, EndpointDiff{
+			Method: key.Method,
+			URL:    key.URL,
+			Count:  newDelta(float64(f.Count), float64(t.Count)),
+			Total:  newDelta(f.Total, t.Total),
+			P50:    newDelta(f.P50, t.P50),
+			P99:    newDelta(f.P99, t.P99),
+		})
+	}
+	slices.SortFunc(diff.Endpoints, func(a, b EndpointDiff) int {
+		return cmp.Compare(math.Abs(b.Total.Diff), math.Abs(a.Total.Diff))
+	})
+
+	fromQueries := make(map[QueryKey]Query, len(from.Queries))
+	for _, q := range from.Queries {
+		fromQueries[QueryKey{Driver: q.Driver, Query: q.Query}] = q
+	}
+	toQueries := make(map[QueryKey]Query, len(to.Queries))
+	for _, q := range to.Queries {
+		toQueries[QueryKey{Driver: q.Driver, Query: q.Query}] = q
+	}
+	for _, key := range unionKeys(fromQueries, toQueries) {
+		f, t := fromQueries[key], toQueries[key]
+		diff.Queries = append(diff.Queries, QueryDiff{
+			Driver: key.Driver,
+			Query:  key.Query,
+			Count:  newDelta(float64(f.Count), float64(t.Count)),
+			Total:  newDelta(f.Total, t.Total),
+		})
+	}
+	slices.SortFunc(diff.Queries, func(a, b QueryDiff) int {
+		return cmp.Compare(math.Abs(b.Total.Diff), math.Abs(a.Total.Diff))
+	})
+
+	fromCaches := make(map[string]Cache, len(from.Caches))
+	for _, c := range from.Caches {
+		fromCaches[c.Name] = c
+	}
+	toCaches := make(map[string]Cache, len(to.Caches))
+	for _, c := range to.Caches {
+		toCaches[c.Name] = c
+	}
+	for _, name := range unionKeys(fromCaches, toCaches) {
+		diff.Caches = append(diff.Caches, CacheDiff{
+			Name:     name,
+			HitRatio: newDelta(fromCaches[name].HitRatio, toCaches[name].HitRatio),
+		})
+	}
+	slices.SortFunc(diff.Caches, func(a, b CacheDiff) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return diff
+}
+
+func unionKeys[K comparable, V any](a, b map[K]V) []K {
+	keys := make([]K, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,418 @@
+package metrics
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	apiDurationName   = "isutools_api_request_duration_seconds"
+	apiRequestName    = "isutools_api_request_total"
+	queryDurationName = "isutools_db_query_duration_seconds"
+	cacheHitName      = "isutools_cache_hit_count"
+	cacheLoadName     = "isutools_cache_load_count"
+)
+
+type EndpointKey struct {
+	Method string
+	URL    string
+}
+
+type QueryKey struct {
+	Driver string
+	Query  string
+}
+
+type Histogram struct {
+	Count uint64
+	Sum   float64
+	// Bounds 各bucketの上限(+Infは含まない)
+	Bounds []float64
+	// Buckets 各bucketの累積カウント
+	Buckets []uint64
+}
+
+type endpointSample struct {
+	hist  Histogram
+	codes map[string]uint64
+	// success 2xx, 3xxのリクエスト数
+	success float64
+}
+
+type cacheSample struct {
+	hit  float64
+	miss float64
+}
+
+// Sample Prometheusのレジストリから取り出した、isutoolsのメトリクスのある時点の値
+type Sample struct {
+	endpoints map[EndpointKey]*endpointSample
+	queries   map[QueryKey]*Histogram
+	caches    map[string]*cacheSample
+}
+
+func Gather() (*Sample, error) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	return Collect(mfs), nil
+}
+
+func Collect(mfs []*dto.MetricFamily) *Sample {
+	s := &Sample{
+		endpoints: map[EndpointKey]*endpointSample{},
+		queries:   map[QueryKey]*Histogram{},
+		caches:    map[string]*cacheSample{},
+	}
+
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case apiDurationName:
+			for _, m := range mf.GetMetric() {
+				labels := labelMap(m)
+				key := EndpointKey{Method: labels["method"], URL: labels["url"]}
+
+				es, ok := s.endpoints[key]
+				if !ok {
+					es = &endpointSample{codes: map[string]uint64{}}
+					s.endpoints[key] = es
+				}
+
+				h := fromDTO(m.GetHistogram())
+				es.hist = es.hist.Add(h)
+				es.codes[labels["code"]] += h.Count
+			}
+		case apiRequestName:
+			for _, m := range mf.GetMetric() {
+				labels := labelMap(m)
+				code := labels["code"]
+				if len(code) == 0 || (code[0] != '2' && code[0] != '3') {
+					continue
+				}
+
+				key := EndpointKey{Method: labels["method"], URL: labels["url"]}
+
+				es, ok := s.endpoints[key]
+				if !ok {
+					es = &endpointSample{codes: map[string]uint64{}}
+					s.endpoints[key] = es
+				}
+
+				// hostの違いは無視して集計する
+				es.success += m.GetCounter().GetValue()
+			}
+		case queryDurationName:
+			for _, m := range mf.GetMetric() {
+				labels := labelMap(m)
+				// addrの違いは無視して集計する
+				key := QueryKey{Driver: labels["driver"], Query: labels["query"]}
+
+				h := fromDTO(m.GetHistogram())
+				if base, ok := s.queries[key]; ok {
+					h = base.Add(h)
+				}
+				s.queries[key] = &h
+			}
+		case cacheHitName, cacheLoadName:
+			for _, m := range mf.GetMetric() {
+				labels := labelMap(m)
+				name := labels["name"]
+
+				cs, ok := s.caches[name]
+				if !ok {
+					cs = &cacheSample{}
+					s.caches[name] = cs
+				}
+
+				stat := labels["stat"]
+				if stat == "" {
+					stat = labels["status"]
+				}
+
+				switch stat {
+				case "hit", "grace_hit":
+					cs.hit += m.GetGauge().GetValue()
+				case "miss":
+					cs.miss += m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	return s
+}
+
+// Sub baseからの増分を計算する
+func (s *Sample) Sub(base *Sample) *Sample {
+	if base == nil {
+		return s
+	}
+
+	diff := &Sample{
+		endpoints: make(map[EndpointKey]*endpointSample, len(s.endpoints)),
+		queries:   make(map[QueryKey]*Histogram, len(s.queries)),
+		caches:    make(map[string]*cacheSample, len(s.caches)),
+	}
+
+	for key, es := range s.endpoints {
+		newES := &endpointSample{
+			hist:    es.hist,
+			codes:   make(map[string]uint64, len(es.codes)),
+			success: es.success,
+		}
+		for code, count := range es.codes {
+			newES.codes[code] = count
+		}
+
+		if baseES, ok := base.endpoints[key]; ok {
+			newES.hist = es.hist.Sub(baseES.hist)
+			newES.success = max(es.success-baseES.success, 0)
+			for code, count := range baseES.codes {
+				newES.codes[code] = subUint(newES.codes[code], count)
+			}
+		}
+
+		if newES.hist.Count == 0 {
+			continue
+		}
+		diff.endpoints[key] = newES
+	}
+
+	for key, h := range s.queries {
+		newH := *h
+		if baseH, ok := base.queries[key]; ok {
+			newH = h.Sub(*baseH)
+		}
+
+		if newH.Count == 0 {
+			continue
+		}
+		diff.queries[key] = &newH
+	}
+
+	for name, cs := range s.caches {
+		newCS := *cs
+		if baseCS, ok := base.caches[name]; ok {
+			newCS.hit -= baseCS.hit
+			newCS.miss -= baseCS.miss
+		}
+
+		diff.caches[name] = &newCS
+	}
+
+	return diff
+}
+
+type Endpoint struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Count   uint64            `json:"count"`
+	Success uint64            `json:"success"`
+	Total   float64           `json:"total"`
+	Avg     float64           `json:"avg"`
+	P50     float64           `json:"p50"`
+	P90     float64           `json:"p90"`
+	P99     float64           `json:"p99"`
+	Codes   map[string]uint64 `json:"codes"`
+}
+
+type Query struct {
+	Driver string  `json:"driver"`
+	Query  string  `json:"query"`
+	Count  uint64  `json:"count"`
+	Total  float64 `json:"total"`
+	Avg    float64 `json:"avg"`
+	P99    float64 `json:"p99"`
+}
+
+type Cache struct {
+	Name     string  `json:"name"`
+	Hit      float64 `json:"hit"`
+	Miss     float64 `json:"miss"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+type Summary struct {
+	Endpoints []Endpoint `json:"endpoints"`
+	Queries   []Query    `json:"queries"`
+	Caches    []Cache    `json:"caches"`
+}
+
+// Summary 合計時間の降順に並べた集計結果を返す
+func (s *Sample) Summary() *Summary {
+	summary := &Summary{
+		Endpoints: make([]Endpoint, 0, len(s.endpoints)),
+		Queries:   make([]Query, 0, len(s.queries)),
+		Caches:    make([]Cache, 0, len(s.caches)),
+	}
+
+	for key, es := range s.endpoints {
+		summary.Endpoints = append(summary.Endpoints, Endpoint{
+			Method:  key.Method,
+			URL:     key.URL,
+			Count:   es.hist.Count,
+			Success: uint64(es.success),
+			Total:   es.hist.Sum,
+			Avg:     es.hist.Avg(),
+			P50:     es.hist.Quantile(0.5),
+			P90:     es.hist.Quantile(0.9),
+			P99:     es.hist.Quantile(0.99),
+			Codes:   es.codes,
+		})
+	}
+	slices.SortFunc(summary.Endpoints, func(a, b Endpoint) int {
+		return cmp.Compare(b.Total, a.Total)
+	})
+
+	for key, h := range s.queries {
+		summary.Queries = append(summary.Queries, Query{
+			Driver: key.Driver,
+			Query:  key.Query,
+			Count:  h.Count,
+			Total:  h.Sum,
+			Avg:    h.Avg(),
+			P99:    h.Quantile(0.99),
+		})
+	}
+	slices.SortFunc(summary.Queries, func(a, b Query) int {
+		return cmp.Compare(b.Total, a.Total)
+	})
+
+	for name, cs := range s.caches {
+		var ratio float64
+		if cs.hit+cs.miss > 0 {
+			ratio = cs.hit / (cs.hit + cs.miss)
+		}
+
+		summary.Caches = append(summary.Caches, Cache{
+			Name:     name,
+			Hit:      cs.hit,
+			Miss:     cs.miss,
+			HitRatio: ratio,
+		})
+	}
+	slices.SortFunc(summary.Caches, func(a, b Cache) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return summary
+}
+
+func fromDTO(h *dto.Histogram) Histogram {
+	hist := Histogram{
+		Count:   h.GetSampleCount(),
+		Sum:     h.GetSampleSum(),
+		Bounds:  make([]float64, 0, len(h.GetBucket())),
+		Buckets: make([]uint64, 0, len(h.GetBucket())),
+	}
+	for _, b := range h.GetBucket() {
+		hist.Bounds = append(hist.Bounds, b.GetUpperBound())
+		hist.Buckets = append(hist.Buckets, b.GetCumulativeCount())
+	}
+
+	return hist
+}
+
+// Add 同じbucket定義のHistogramを足し合わせる
+func (h Histogram) Add(o Histogram) Histogram {
+	if len(h.Bounds) == 0 {
+		return o.clone()
+	}
+
+	sum := h.clone()
+	sum.Count += o.Count
+	sum.Sum += o.Sum
+	for i := range sum.Buckets {
+		if i < len(o.Buckets) {
+			sum.Buckets[i] += o.Buckets[i]
+		}
+	}
+
+	return sum
+}
+
+func (h Histogram) Sub(o Histogram) Histogram {
+	diff := h.clone()
+	diff.Count = subUint(h.Count, o.Count)
+	diff.Sum -= o.Sum
+	for i := range diff.Buckets {
+		if i < len(o.Buckets) {
+			diff.Buckets[i] = subUint(diff.Buckets[i], o.Buckets[i])
+		}
+	}
+
+	return diff
+}
+
+func (h Histogram) clone() Histogram {
+	return Histogram{
+		Count:   h.Count,
+		Sum:     h.Sum,
+		Bounds:  slices.Clone(h.Bounds),
+		Buckets: slices.Clone(h.Buckets),
+	}
+}
+
+func (h Histogram) Avg() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return h.Sum / float64(h.Count)
+}
+
+// Quantile histogram_quantileと同様にbucket内を線形補間して分位数を推定する
+func (h Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.Count)
+	for i, count := range h.Buckets {
+		if float64(count) < rank {
+			continue
+		}
+
+		var (
+			lower     float64
+			lowerRank float64
+		)
+		if i > 0 {
+			lower = h.Bounds[i-1]
+			lowerRank = float64(h.Buckets[i-1])
+		}
+
+		bucketCount := float64(count) - lowerRank
+		if bucketCount <= 0 {
+			return h.Bounds[i]
+		}
+
+		return lower + (h.Bounds[i]-lower)*(rank-lowerRank)/bucketCount
+	}
+
+	// +Infのbucketに入る場合は最大の上限を返す
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+func labelMap(m *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+
+	return labels
+}
+
+func subUint(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+
+	return a - b
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func histogramFamily(name string, labels map[string]string, bounds []float64, cumulative []uint64, sum float64) *dto.MetricFamily {
+	m := &dto.Metric{
+		Histogram: &dto.Histogram{
+			SampleCount: proto.Uint64(cumulative[len(cumulative)-1]),
+			SampleSum:   proto.Float64(sum),
+		},
+	}
+	for k, v := range labels {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+	for i, b := range bounds {
+		m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(b),
+			CumulativeCount: proto.Uint64(cumulative[i]),
+		})
+	}
+
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{m},
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := Histogram{
+		Count:   100,
+		Bounds:  []float64{0.1, 0.2, 0.4},
+		Buckets: []uint64{50, 90, 100},
+	}
+
+	assert.InDelta(t, 0.1, h.Quantile(0.5), 1e-9)
+	assert.InDelta(t, 0.15, h.Quantile(0.7), 1e-9)
+	assert.InDelta(t, 0.38, h.Quantile(0.99), 1e-9)
+	assert.Equal(t, 0.0, Histogram{}.Quantile(0.5))
+}
+
+func TestSampleSub(t *testing.T) {
+	labels := map[string]string{"code": "200", "method": "GET", "url": "/api/user/<number>"}
+	bounds := []float64{0.1, 1}
+
+	base := Collect([]*dto.MetricFamily{
+		histogramFamily(apiDurationName, labels, bounds, []uint64{10, 10}, 0.5),
+	})
+	cur := Collect([]*dto.MetricFamily{
+		histogramFamily(apiDurationName, labels, bounds, []uint64{10, 30}, 10.5),
+	})
+
+	summary := cur.Sub(base).Summary()
+	if assert.Len(t, summary.Endpoints, 1) {
+		e := summary.Endpoints[0]
+		assert.Equal(t, uint64(20), e.Count)
+		assert.InDelta(t, 10.0, e.Total, 1e-9)
+		assert.Equal(t, uint64(20), e.Codes["200"])
+		// 増分は全て(0.1, 1]のbucketに入っている
+		assert.InDelta(t, 0.55, e.P50, 1e-9)
+	}
+
+	assert.Empty(t, base.Sub(base).Summary().Endpoints)
+}
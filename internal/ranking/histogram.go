@@ -0,0 +1,83 @@
+package ranking
+
+import (
+	"math/bits"
+	"time"
+)
+
+/*
+	レイテンシのパーセンタイルを求めるためのヒストグラム
+	ナノ秒の値の上位7bitでバケットを分けるので、相対誤差は1/64(約1.6%)以内になる
+	PrometheusのDefBucketsと異なり、p99でも値がバケットの境界に丸められない
+*/
+
+const (
+	mantissaBits = 6
+	subBuckets   = 1 << mantissaBits
+	// numBuckets time.Durationの最大値まで表せる数
+	numBuckets = (64 - mantissaBits) * subBuckets
+)
+
+type histogram struct {
+	counts [numBuckets]uint32
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func bucketIndex(d time.Duration) int {
+	v := uint64(max(d, 0))
+	if v < subBuckets {
+		return int(v)
+	}
+
+	// vの最上位bitを除いた上位mantissaBits bitでバケットを決める
+	shift := bits.Len64(v) - mantissaBits - 1
+	return (shift+1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketValue バケットに入る値の中央の値
+func bucketValue(i int) time.Duration {
+	if i < subBuckets {
+		return time.Duration(i)
+	}
+
+	shift := i/subBuckets - 1
+	lower := uint64(subBuckets+i%subBuckets) << shift
+	return time.Duration(lower + (uint64(1)<<shift)/2)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.counts[bucketIndex(d)]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+func (h *histogram) merge(other *histogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.count += other.count
+	h.sum += other.sum
+	h.max = max(h.max, other.max)
+}
+
+// quantile q(0<=q<=1)の位置の値を返す
+// 最大値を超えないよう、maxで丸める
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(q*float64(h.count-1)) + 1
+	var seen uint64
+	for i, c := range h.counts {
+		seen += uint64(c)
+		if seen >= rank {
+			return min(bucketValue(i), h.max)
+		}
+	}
+
+	return h.max
+}
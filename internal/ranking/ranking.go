@@ -0,0 +1,284 @@
+package ranking
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+/*
+	alpのようなエンドポイントごとの集計を、プロセス内で行う
+	httpのミドルウェアからObserveで記録し、ベンチマークの開始時にリセットする
+	GET /api/ranking
+		sort: count, total, avg, p50, p90, p99, max, bytes, avg_bytes, method, route(デフォルトtotal)
+		order: asc, desc(デフォルトdesc)
+		status: 集計するステータスコードのクラスをカンマ区切りで指定する(例: 2xx,3xx、デフォルトは全て)
+*/
+
+const numClasses = 5
+
+type endpointKey struct {
+	method string
+	route  string
+}
+
+type endpoint struct {
+	locker sync.Mutex
+	// classes ステータスコードのクラス(1xx~5xx)ごとの集計
+	classes [numClasses]*classStat
+}
+
+type classStat struct {
+	histogram
+	bytes float64
+	// sized サイズがわかったレスポンスの数
+	sized  uint64
+	status map[int]uint64
+}
+
+var (
+	locker    = &sync.RWMutex{}
+	since     = time.Now()
+	endpoints = map[endpointKey]*endpoint{}
+)
+
+func init() {
+	benchmark.SetStartHook(func(_ context.Context, b *benchmark.Benchmark) {
+		reset(b.Start)
+	})
+}
+
+func reset(start time.Time) {
+	locker.Lock()
+	defer locker.Unlock()
+
+	since = start
+	endpoints = map[endpointKey]*endpoint{}
+}
+
+// classIndex 範囲外のステータスコードは5xxとして扱う
+func classIndex(statusCode int) int {
+	return min(max(statusCode/100, 1), numClasses) - 1
+}
+
+// Observe resSizeにはレスポンスボディのサイズを渡し、わからない場合は負の値を渡す
+func Observe(method, route string, statusCode int, d time.Duration, resSize float64) {
+	key := endpointKey{method: method, route: route}
+
+	locker.RLock()
+	e, ok := endpoints[key]
+	locker.RUnlock()
+	if !ok {
+		locker.Lock()
+		e, ok = endpoints[key]
+		if !ok {
+			e = &endpoint{}
+			endpoints[key] = e
+		}
+		locker.Unlock()
+	}
+
+	e.locker.Lock()
+	defer e.locker.Unlock()
+
+	i := classIndex(statusCode)
+	if e.classes[i] == nil {
+		e.classes[i] = &classStat{
+			status: map[int]uint64{},
+		}
+	}
+	s := e.classes[i]
+
+	s.observe(d)
+	if resSize >= 0 {
+		s.bytes += resSize
+		s.sized++
+	}
+	s.status[statusCode]++
+}
+
+type Ranking struct {
+	Since     time.Time   `json:"since"`
+	Endpoints []*Endpoint `json:"endpoints"`
+}
+
+// Endpoint 時間の単位は秒
+type Endpoint struct {
+	Method   string         `json:"method"`
+	Route    string         `json:"route"`
+	Count    uint64         `json:"count"`
+	Total    float64        `json:"total"`
+	Avg      float64        `json:"avg"`
+	P50      float64        `json:"p50"`
+	P90      float64        `json:"p90"`
+	P99      float64        `json:"p99"`
+	Max      float64        `json:"max"`
+	Bytes    float64        `json:"bytes"`
+	AvgBytes float64        `json:"avg_bytes"`
+	Status   map[int]uint64 `json:"status"`
+}
+
+var sortKeys = map[string]func(a, b *Endpoint) int{
+	"count":     func(a, b *Endpoint) int { return cmp.Compare(a.Count, b.Count) },
+	"total":     func(a, b *Endpoint) int { return cmp.Compare(a.Total, b.Total) },
+	"avg":       func(a, b *Endpoint) int { return cmp.Compare(a.Avg, b.Avg) },
+	"p50":       func(a, b *Endpoint) int { return cmp.Compare(a.P50, b.P50) },
+	"p90":       func(a, b *Endpoint) int { return cmp.Compare(a.P90, b.P90) },
+	"p99":       func(a, b *Endpoint) int { return cmp.Compare(a.P99, b.P99) },
+	"max":       func(a, b *Endpoint) int { return cmp.Compare(a.Max, b.Max) },
+	"bytes":     func(a, b *Endpoint) int { return cmp.Compare(a.Bytes, b.Bytes) },
+	"avg_bytes": func(a, b *Endpoint) int { return cmp.Compare(a.AvgBytes, b.AvgBytes) },
+	"method":    func(a, b *Endpoint) int { return cmp.Compare(a.Method, b.Method) },
+	"route":     func(a, b *Endpoint) int { return cmp.Compare(a.Route, b.Route) },
+}
+
+// ranking classesがtrueのクラスのリクエストのみを集計する
+// 該当するリクエストのないエンドポイントは含めない
+func ranking(classes [numClasses]bool) *Ranking {
+	locker.RLock()
+	r := &Ranking{
+		Since:     since,
+		Endpoints: make([]*Endpoint, 0, len(endpoints)),
+	}
+	keys := make([]endpointKey, 0, len(endpoints))
+	values := make([]*endpoint, 0, len(endpoints))
+	for key, e := range endpoints {
+		keys = append(keys, key)
+		values = append(values, e)
+	}
+	locker.RUnlock()
+
+	for i, e := range values {
+		ep := e.summary(classes)
+		if ep == nil {
+			continue
+		}
+
+		ep.Method = keys[i].method
+		ep.Route = keys[i].route
+		r.Endpoints = append(r.Endpoints, ep)
+	}
+
+	return r
+}
+
+func (e *endpoint) summary(classes [numClasses]bool) *Endpoint {
+	var (
+		h      histogram
+		bytes  float64
+		sized  uint64
+		status = map[int]uint64{}
+	)
+
+	e.locker.Lock()
+	for i, s := range e.classes {
+		if s == nil || !classes[i] {
+			continue
+		}
+
+		h.merge(&s.histogram)
+		bytes += s.bytes
+		sized += s.sized
+		for code, count := range s.status {
+			status[code] += count
+		}
+	}
+	e.locker.Unlock()
+
+	if h.count == 0 {
+		return nil
+	}
+
+	ep := &Endpoint{
+		Count:  h.count,
+		Total:  h.sum.Seconds(),
+		Avg:    h.sum.Seconds() / float64(h.count),
+		P50:    h.quantile(0.5).Seconds(),
+		P90:    h.quantile(0.9).Seconds(),
+		P99:    h.quantile(0.99).Seconds(),
+		Max:    h.max.Seconds(),
+		Bytes:  bytes,
+		Status: status,
+	}
+	if sized > 0 {
+		ep.AvgBytes = bytes / float64(sized)
+	}
+
+	return ep
+}
+
+// parseClasses 2xx,3xxのような指定を解釈する
+// 空の場合は全てのクラスを対象にする
+func parseClasses(s string) ([numClasses]bool, error) {
+	var classes [numClasses]bool
+	if s == "" {
+		for i := range classes {
+			classes[i] = true
+		}
+		return classes, nil
+	}
+
+	for _, strClass := range strings.Split(s, ",") {
+		strClass = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(strClass)), "xx")
+
+		class, err := strconv.Atoi(strClass)
+		if err != nil || class < 1 || class > numClasses {
+			return classes, fmt.Errorf("invalid status class: %s", strClass)
+		}
+
+		classes[class-1] = true
+	}
+
+	return classes, nil
+}
+
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/ranking", rankingHandler)
+}
+
+func rankingHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	classes, err := parseClasses(query.Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sortKey := query.Get("sort")
+	if sortKey == "" {
+		sortKey = "total"
+	}
+	compare, ok := sortKeys[sortKey]
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid sort key: %s", sortKey), http.StatusBadRequest)
+		return
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+		asc := compare
+		compare = func(a, b *Endpoint) int { return asc(b, a) }
+	case "asc":
+	default:
+		http.Error(w, fmt.Sprintf("invalid order: %s", query.Get("order")), http.StatusBadRequest)
+		return
+	}
+
+	res := ranking(classes)
+	slices.SortFunc(res.Endpoints, func(a, b *Endpoint) int {
+		// 同じ値の場合に順序が変わらないよう、ルートでも比較する
+		return cmp.Or(compare(a, b), cmp.Compare(a.Route, b.Route), cmp.Compare(a.Method, b.Method))
+	})
+
+	response.JSON(w, res)
+}
@@ -0,0 +1,247 @@
+package ranking
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucketValue(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		description string
+		d           time.Duration
+	}{
+		{description: "zero", d: 0},
+		{description: "small", d: 63},
+		{description: "boundary", d: 64},
+		{description: "microsecond", d: 1234 * time.Microsecond},
+		{description: "millisecond", d: 57 * time.Millisecond},
+		{description: "second", d: 3 * time.Second},
+		{description: "hour", d: time.Hour},
+		{description: "max", d: math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			i := bucketIndex(test.d)
+			if i < 0 || i >= numBuckets {
+				t.Fatalf("index out of range: %d", i)
+			}
+
+			actual := bucketValue(i)
+			if diff := math.Abs(float64(actual-test.d)) / math.Max(float64(test.d), 1); diff > 1.0/subBuckets {
+				t.Errorf("expected %s, got %s (relative error %f)", test.d, actual, diff)
+			}
+		})
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	t.Parallel()
+
+	h := &histogram{}
+	// 1ms~1000msを1つずつ
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+
+	tests := []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{q: 0, expected: 1 * time.Millisecond},
+		{q: 0.5, expected: 500 * time.Millisecond},
+		{q: 0.9, expected: 900 * time.Millisecond},
+		{q: 0.99, expected: 990 * time.Millisecond},
+		{q: 1, expected: 1000 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		actual := h.quantile(test.q)
+		if diff := math.Abs(float64(actual-test.expected)) / float64(test.expected); diff > 1.0/subBuckets {
+			t.Errorf("q=%f: expected %s, got %s", test.q, test.expected, actual)
+		}
+	}
+
+	if actual := h.quantile(1); actual > h.max {
+		t.Errorf("quantile must not exceed max(%s), got %s", h.max, actual)
+	}
+}
+
+func TestParseClasses(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		description string
+		s           string
+		expected    [numClasses]bool
+		isErr       bool
+	}{
+		{description: "empty", s: "", expected: [numClasses]bool{true, true, true, true, true}},
+		{description: "single", s: "2xx", expected: [numClasses]bool{false, true, false, false, false}},
+		{description: "multiple", s: "4xx, 5XX", expected: [numClasses]bool{false, false, false, true, true}},
+		{description: "digit only", s: "3", expected: [numClasses]bool{false, false, true, false, false}},
+		{description: "out of range", s: "6xx", isErr: true},
+		{description: "invalid", s: "ok", isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := parseClasses(test.s)
+			if test.isErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func findEndpoint(endpoints []*Endpoint, route string) (int, *Endpoint) {
+	for i, e := range endpoints {
+		if e.Route == route {
+			return i, e
+		}
+	}
+
+	return -1, nil
+}
+
+func TestRankingHandler(t *testing.T) {
+	t.Parallel()
+
+	// 他のテストと集計が混ざらないよう、このテスト専用のルートを使う
+	for i := 1; i <= 10; i++ {
+		Observe(http.MethodGet, "/test/ranking/fast", http.StatusOK, time.Duration(i)*time.Millisecond, 100)
+	}
+	Observe(http.MethodGet, "/test/ranking/fast", http.StatusNotFound, time.Millisecond, -1)
+	Observe(http.MethodPost, "/test/ranking/slow", http.StatusOK, time.Second, 10)
+	Observe(http.MethodPost, "/test/ranking/slow", http.StatusInternalServerError, 2*time.Second, 20)
+
+	tests := []struct {
+		description string
+		query       string
+		status      int
+		// order 期待するルートの順序
+		order []string
+		check func(t *testing.T, endpoints []*Endpoint)
+	}{
+		{
+			description: "default sort by total desc",
+			order:       []string{"/test/ranking/slow", "/test/ranking/fast"},
+			check: func(t *testing.T, endpoints []*Endpoint) {
+				_, fast := findEndpoint(endpoints, "/test/ranking/fast")
+				if fast.Count != 11 {
+					t.Errorf("expected count 11, got %d", fast.Count)
+				}
+				if fast.Max != 0.01 {
+					t.Errorf("expected max 0.01, got %f", fast.Max)
+				}
+				if fast.Bytes != 1000 || fast.AvgBytes != 100 {
+					t.Errorf("expected bytes 1000 and avg 100, got %f and %f", fast.Bytes, fast.AvgBytes)
+				}
+				if fast.Status[http.StatusOK] != 10 || fast.Status[http.StatusNotFound] != 1 {
+					t.Errorf("unexpected status breakdown: %v", fast.Status)
+				}
+			},
+		},
+		{
+			description: "sort by count asc",
+			query:       "?sort=count&order=asc",
+			order:       []string{"/test/ranking/slow", "/test/ranking/fast"},
+		},
+		{
+			description: "sort by count desc",
+			query:       "?sort=count",
+			order:       []string{"/test/ranking/fast", "/test/ranking/slow"},
+		},
+		{
+			description: "filter 5xx",
+			query:       "?status=5xx",
+			order:       []string{"/test/ranking/slow"},
+			check: func(t *testing.T, endpoints []*Endpoint) {
+				if _, fast := findEndpoint(endpoints, "/test/ranking/fast"); fast != nil {
+					t.Error("endpoint without 5xx must be excluded")
+				}
+
+				_, slow := findEndpoint(endpoints, "/test/ranking/slow")
+				if slow.Count != 1 || slow.Total != 2 {
+					t.Errorf("expected count 1 and total 2, got %d and %f", slow.Count, slow.Total)
+				}
+			},
+		},
+		{
+			description: "filter 4xx",
+			query:       "?status=4xx",
+			order:       []string{"/test/ranking/fast"},
+			check: func(t *testing.T, endpoints []*Endpoint) {
+				_, fast := findEndpoint(endpoints, "/test/ranking/fast")
+				if fast.Count != 1 || fast.AvgBytes != 0 {
+					t.Errorf("expected count 1 and avg bytes 0, got %d and %f", fast.Count, fast.AvgBytes)
+				}
+			},
+		},
+		{description: "invalid sort", query: "?sort=unknown", status: http.StatusBadRequest},
+		{description: "invalid order", query: "?order=up", status: http.StatusBadRequest},
+		{description: "invalid status", query: "?status=9xx", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			rankingHandler(rec, httptest.NewRequest(http.MethodGet, "/api/ranking"+test.query, nil))
+
+			expectedStatus := test.status
+			if expectedStatus == 0 {
+				expectedStatus = http.StatusOK
+			}
+			if rec.Code != expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", expectedStatus, rec.Code, rec.Body.String())
+			}
+			if expectedStatus != http.StatusOK {
+				return
+			}
+
+			var res Ranking
+			err := json.NewDecoder(rec.Body).Decode(&res)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			prev := -1
+			for _, route := range test.order {
+				i, _ := findEndpoint(res.Endpoints, route)
+				if i < 0 {
+					t.Fatalf("%s is not found", route)
+				}
+				if i < prev {
+					t.Errorf("expected order %v, got %s at %d", test.order, route, i)
+				}
+				prev = i
+			}
+
+			if test.check != nil {
+				test.check(t, res.Endpoints)
+			}
+		})
+	}
+}
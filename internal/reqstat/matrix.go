@@ -0,0 +1,185 @@
+package reqstat
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+/*
+	どのエンドポイントがどのクエリを発行しているかをルート×クエリの行列として集計する
+	N+1の検出に使うため、クエリはリクエストあたりの回数も返す
+	ベンチマークの開始時にリセットする
+	GET /api/route-queries
+*/
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type routeStat struct {
+	locker    sync.Mutex
+	requests  int64
+	dbTime    time.Duration
+	dbCount   int64
+	httpTime  time.Duration
+	httpCount int64
+	queries   map[string]*queryStat
+}
+
+var (
+	matrixLocker = &sync.RWMutex{}
+	matrixSince  = time.Now()
+	matrix       = map[routeKey]*routeStat{}
+)
+
+func init() {
+	benchmark.SetStartHook(func(_ context.Context, b *benchmark.Benchmark) {
+		resetMatrix(b.Start)
+	})
+}
+
+func resetMatrix(start time.Time) {
+	matrixLocker.Lock()
+	defer matrixLocker.Unlock()
+
+	matrixSince = start
+	matrix = map[routeKey]*routeStat{}
+}
+
+// Record リクエストの処理が終わった後に呼び、ルートごとの集計に加える
+// 全てのリクエストから呼ばれるため、全体のロックはルートの検索・追加の間のみ取る
+func Record(method, route string, s *Stat) {
+	key := routeKey{method: method, route: route}
+
+	matrixLocker.RLock()
+	rs, ok := matrix[key]
+	matrixLocker.RUnlock()
+	if !ok {
+		matrixLocker.Lock()
+		rs, ok = matrix[key]
+		if !ok {
+			rs = &routeStat{
+				queries: map[string]*queryStat{},
+			}
+			matrix[key] = rs
+		}
+		matrixLocker.Unlock()
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	rs.locker.Lock()
+	defer rs.locker.Unlock()
+
+	rs.requests++
+	rs.dbTime += s.DBTime()
+	rs.dbCount += s.Queries()
+	rs.httpTime += s.HTTPTime()
+	rs.httpCount += s.HTTPCalls()
+
+	for query, qs := range s.queries {
+		total, ok := rs.queries[query]
+		if !ok {
+			total = &queryStat{}
+			rs.queries[query] = total
+		}
+		total.count += qs.count
+		total.time += qs.time
+	}
+}
+
+type Matrix struct {
+	Since  time.Time       `json:"since"`
+	Routes []*RouteQueries `json:"routes"`
+}
+
+// RouteQueries 時間の単位は秒
+type RouteQueries struct {
+	Method   string `json:"method"`
+	Route    string `json:"route"`
+	Requests int64  `json:"requests"`
+	// QueriesPerRequest 1リクエストあたりのクエリ数で、大きいものはN+1の可能性がある
+	QueriesPerRequest float64       `json:"queries_per_request"`
+	DBTime            float64       `json:"db_time"`
+	HTTPCalls         int64         `json:"http_calls"`
+	HTTPTime          float64       `json:"http_time"`
+	Queries           []*RouteQuery `json:"queries"`
+}
+
+type RouteQuery struct {
+	Query      string  `json:"query"`
+	Count      int64   `json:"count"`
+	PerRequest float64 `json:"per_request"`
+	Time       float64 `json:"time"`
+}
+
+// snapshot ルートはDBの処理時間、クエリは合計時間の降順に並べる
+func snapshot() *Matrix {
+	matrixLocker.RLock()
+	m := &Matrix{
+		Since:  matrixSince,
+		Routes: make([]*RouteQueries, 0, len(matrix)),
+	}
+	keys := make([]routeKey, 0, len(matrix))
+	values := make([]*routeStat, 0, len(matrix))
+	for key, rs := range matrix {
+		keys = append(keys, key)
+		values = append(values, rs)
+	}
+	matrixLocker.RUnlock()
+
+	for i, rs := range values {
+		m.Routes = append(m.Routes, rs.summary(keys[i]))
+	}
+
+	slices.SortFunc(m.Routes, func(a, b *RouteQueries) int {
+		return cmp.Or(cmp.Compare(b.DBTime, a.DBTime), cmp.Compare(a.Route, b.Route), cmp.Compare(a.Method, b.Method))
+	})
+
+	return m
+}
+
+func (rs *routeStat) summary(key routeKey) *RouteQueries {
+	rs.locker.Lock()
+	defer rs.locker.Unlock()
+
+	rq := &RouteQueries{
+		Method:            key.method,
+		Route:             key.route,
+		Requests:          rs.requests,
+		QueriesPerRequest: float64(rs.dbCount) / float64(rs.requests),
+		DBTime:            rs.dbTime.Seconds(),
+		HTTPCalls:         rs.httpCount,
+		HTTPTime:          rs.httpTime.Seconds(),
+		Queries:           make([]*RouteQuery, 0, len(rs.queries)),
+	}
+
+	for query, qs := range rs.queries {
+		rq.Queries = append(rq.Queries, &RouteQuery{
+			Query:      query,
+			Count:      qs.count,
+			PerRequest: float64(qs.count) / float64(rs.requests),
+			Time:       qs.time.Seconds(),
+		})
+	}
+	slices.SortFunc(rq.Queries, func(a, b *RouteQuery) int {
+		return cmp.Or(cmp.Compare(b.Time, a.Time), cmp.Compare(a.Query, b.Query))
+	})
+
+	return rq
+}
+
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/route-queries", func(w http.ResponseWriter, r *http.Request) {
+		response.JSON(w, snapshot())
+	})
+}
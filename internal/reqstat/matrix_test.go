@@ -0,0 +1,114 @@
+package reqstat
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func findRoute(m *Matrix, method, route string) *RouteQueries {
+	for _, rq := range m.Routes {
+		if rq.Method == method && rq.Route == route {
+			return rq
+		}
+	}
+
+	return nil
+}
+
+// TestRecord 集計をリセットするので、並行に実行しない
+func TestRecord(t *testing.T) {
+	resetMatrix(time.Now())
+
+	const route = "/test/matrix/users"
+
+	for range 2 {
+		s := &Stat{}
+		ctx := NewContext(context.Background(), s)
+
+		// N+1: ユーザーごとにアイコンを取得する
+		AddQuery(ctx, "SELECT * FROM users", 2*time.Millisecond)
+		for range 10 {
+			AddQuery(ctx, "SELECT * FROM icons WHERE user_id = ?", time.Millisecond)
+		}
+		AddHTTP(ctx, 5*time.Millisecond)
+
+		Record(http.MethodGet, route, s)
+	}
+
+	rq := findRoute(snapshot(), http.MethodGet, route)
+	if rq == nil {
+		t.Fatal("route is not recorded")
+	}
+
+	if rq.Requests != 2 {
+		t.Errorf("expected 2 requests, got %d", rq.Requests)
+	}
+	if rq.QueriesPerRequest != 11 {
+		t.Errorf("expected 11 queries per request, got %f", rq.QueriesPerRequest)
+	}
+	if rq.DBTime != 0.024 {
+		t.Errorf("expected db time 0.024, got %f", rq.DBTime)
+	}
+	if rq.HTTPCalls != 2 || rq.HTTPTime != 0.01 {
+		t.Errorf("expected 2 http calls in 0.01s, got %d in %f", rq.HTTPCalls, rq.HTTPTime)
+	}
+
+	expected := []RouteQuery{
+		{Query: "SELECT * FROM icons WHERE user_id = ?", Count: 20, PerRequest: 10, Time: 0.02},
+		{Query: "SELECT * FROM users", Count: 2, PerRequest: 1, Time: 0.004},
+	}
+	if len(rq.Queries) != len(expected) {
+		t.Fatalf("expected %d queries, got %d", len(expected), len(rq.Queries))
+	}
+	for i, q := range rq.Queries {
+		if *q != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], *q)
+		}
+	}
+}
+
+// TestRecordConcurrent 異なるルートへの記録と集計の取得が並行に行われても、記録が失われない
+func TestRecordConcurrent(t *testing.T) {
+	resetMatrix(time.Now())
+
+	routes := []string{"/test/matrix/a", "/test/matrix/b", "/test/matrix/c", "/test/matrix/d"}
+	const requests = 100
+
+	var wg sync.WaitGroup
+	for _, route := range routes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range requests {
+				s := &Stat{}
+				AddQuery(NewContext(context.Background(), s), "SELECT 1", time.Millisecond)
+				Record(http.MethodGet, route, s)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for range 10 {
+			snapshot()
+		}
+	}()
+	wg.Wait()
+
+	m := snapshot()
+	for _, route := range routes {
+		rq := findRoute(m, http.MethodGet, route)
+		if rq == nil {
+			t.Fatalf("%s is not recorded", route)
+		}
+		if rq.Requests != requests || len(rq.Queries) != 1 || rq.Queries[0].Count != requests {
+			t.Errorf("%s: unexpected record: %+v", route, rq)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package reqstat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	リクエストごとの処理内訳を集計する
+	httpのミドルウェアがリクエストのcontextにStatを入れ、dbのラッパーや外部へのHTTPリクエストが処理時間を加算する
+	isuhttpとisudbが互いに依存しないよう、このパッケージを経由する
+*/
+
+type Stat struct {
+	dbTime    atomic.Int64
+	dbCount   atomic.Int64
+	httpTime  atomic.Int64
+	httpCount atomic.Int64
+
+	locker  sync.Mutex
+	queries map[string]*queryStat
+}
+
+type queryStat struct {
+	count int64
+	time  time.Duration
+}
+
+type contextKey struct{}
+
+// Key fasthttpのUserValueなど、context.WithValue以外で値を設定する場合に使うキー
+var Key = contextKey{}
+
+func NewContext(ctx context.Context, s *Stat) context.Context {
+	return context.WithValue(ctx, Key, s)
+}
+
+// FromContext リクエストの処理中でない場合はnilを返す
+func FromContext(ctx context.Context) *Stat {
+	if ctx == nil {
+		return nil
+	}
+
+	s, _ := ctx.Value(Key).(*Stat)
+	return s
+}
+
+// AddQuery ctxがリクエストの処理中のものであれば、DBのクエリを記録する
+// queryには正規化済みのクエリを渡し、空の場合は回数と時間のみを記録する
+func AddQuery(ctx context.Context, query string, d time.Duration) {
+	s := FromContext(ctx)
+	if s == nil {
+		return
+	}
+
+	s.dbTime.Add(int64(d))
+	s.dbCount.Add(1)
+
+	if query == "" {
+		return
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.queries == nil {
+		s.queries = map[string]*queryStat{}
+	}
+
+	qs, ok := s.queries[query]
+	if !ok {
+		qs = &queryStat{}
+		s.queries[query] = qs
+	}
+	qs.count++
+	qs.time += d
+}
+
+// AddHTTP ctxがリクエストの処理中のものであれば、外部へのHTTPリクエストにかかった時間を加算する
+func AddHTTP(ctx context.Context, d time.Duration) {
+	s := FromContext(ctx)
+	if s == nil {
+		return
+	}
+
+	s.httpTime.Add(int64(d))
+	s.httpCount.Add(1)
+}
+
+// DBTime 同じリクエストから並行に発行されたクエリの時間も足し合わせるので、
+// リクエストの処理時間より長くなることがある
+func (s *Stat) DBTime() time.Duration {
+	return time.Duration(s.dbTime.Load())
+}
+
+func (s *Stat) Queries() int64 {
+	return s.dbCount.Load()
+}
+
+func (s *Stat) HTTPTime() time.Duration {
+	return time.Duration(s.httpTime.Load())
+}
+
+func (s *Stat) HTTPCalls() int64 {
+	return s.httpCount.Load()
+}
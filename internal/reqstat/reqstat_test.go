@@ -0,0 +1,28 @@
+package reqstat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAddQuery(t *testing.T) {
+	t.Parallel()
+
+	s := &Stat{}
+	ctx := NewContext(context.Background(), s)
+
+	AddQuery(ctx, "SELECT 1", 10*time.Millisecond)
+	AddQuery(ctx, "", 5*time.Millisecond)
+	// リクエスト外のクエリは無視される
+	AddQuery(context.Background(), "SELECT 1", time.Second)
+	//nolint:staticcheck
+	AddQuery(nil, "SELECT 1", time.Second)
+
+	if actual := s.DBTime(); actual != 15*time.Millisecond {
+		t.Errorf("expected 15ms, got %s", actual)
+	}
+	if actual := s.Queries(); actual != 2 {
+		t.Errorf("expected 2 queries, got %d", actual)
+	}
+}
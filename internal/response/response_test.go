@@ -0,0 +1,56 @@
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		description string
+		value       any
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			description: "encodable value",
+			value:       map[string]int{"score": 100},
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        "{\"score\":100}\n",
+		},
+		{
+			description: "unencodable value",
+			value:       map[string]any{"ch": make(chan int)},
+			status:      http.StatusInternalServerError,
+			contentType: "text/plain; charset=utf-8",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			JSON(w, test.value)
+
+			if w.Code != test.status {
+				t.Errorf("unexpected status: expected %d, actual %d", test.status, w.Code)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+				t.Errorf("unexpected content type: expected %s, actual %s", test.contentType, contentType)
+			}
+			if test.body != "" && w.Body.String() != test.body {
+				t.Errorf("unexpected body: expected %q, actual %q", test.body, w.Body.String())
+			}
+			if test.status != http.StatusOK && strings.HasPrefix(w.Body.String(), "{") {
+				t.Errorf("partial json must not be written: %q", w.Body.String())
+			}
+		})
+	}
+}
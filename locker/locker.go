@@ -35,7 +35,7 @@ func NewValue[T any](value T, name string) *Value[T] {
 }
 
 func (v *Value[T]) Read(f func(v *T)) {
-	if config.Enable {
+	if config.Measuring() {
 		timer := prometheus.NewTimer(lockHistVec.WithLabelValues(v.name, "read"))
 		defer timer.ObserveDuration()
 	}
@@ -47,7 +47,7 @@ func (v *Value[T]) Read(f func(v *T)) {
 }
 
 func (v *Value[T]) Write(f func(v *T)) {
-	if config.Enable {
+	if config.Measuring() {
 		timer := prometheus.NewTimer(lockHistVec.WithLabelValues(v.name, "write"))
 		defer timer.ObserveDuration()
 	}
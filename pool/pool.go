@@ -32,7 +32,7 @@ func New[T ~*S, S any](name string, fn func() T) *Pool[T, S] {
 	return &Pool[T, S]{
 		pool: &sync.Pool{
 			New: func() interface{} {
-				if counter != nil {
+				if counter != nil && config.Measuring() {
 					counter.WithLabelValues(name, "alloc").Inc()
 				}
 
@@ -45,7 +45,7 @@ func New[T ~*S, S any](name string, fn func() T) *Pool[T, S] {
 }
 
 func (p *Pool[T, _]) Get() T {
-	if p.counter != nil {
+	if p.counter != nil && config.Measuring() {
 		p.counter.WithLabelValues(p.name, "get").Inc()
 	}
 
@@ -53,7 +53,7 @@ func (p *Pool[T, _]) Get() T {
 }
 
 func (p *Pool[T, _]) Put(t T) {
-	if p.counter != nil {
+	if p.counter != nil && config.Measuring() {
 		p.counter.WithLabelValues(p.name, "put").Inc()
 	}
 
@@ -79,7 +79,7 @@ func NewSlice[T ~*[]S, S any](name string, fn func() T) *SlicePool[T, S] {
 	return &SlicePool[T, S]{
 		pool: &sync.Pool{
 			New: func() interface{} {
-				if counter != nil {
+				if counter != nil && config.Measuring() {
 					counter.WithLabelValues(name, "alloc").Inc()
 				}
 
@@ -92,7 +92,7 @@ func NewSlice[T ~*[]S, S any](name string, fn func() T) *SlicePool[T, S] {
 }
 
 func (p *SlicePool[T, _]) Get() T {
-	if p.counter != nil {
+	if p.counter != nil && config.Measuring() {
 		p.counter.WithLabelValues(p.name, "get").Inc()
 	}
 
@@ -104,7 +104,7 @@ func (p *SlicePool[T, _]) Get() T {
 }
 
 func (p *SlicePool[T, _]) Put(t T) {
-	if p.counter != nil {
+	if p.counter != nil && config.Measuring() {
 		p.counter.WithLabelValues(p.name, "put").Inc()
 	}
 
@@ -130,7 +130,7 @@ func NewMap[T ~*map[K]S, K comparable, S any](name string, fn func() T) *MapPool
 	return &MapPool[T, K, S]{
 		pool: &sync.Pool{
 			New: func() interface{} {
-				if counter != nil {
+				if counter != nil && config.Measuring() {
 					counter.WithLabelValues(name, "alloc").Inc()
 				}
 
@@ -143,7 +143,7 @@ func NewMap[T ~*map[K]S, K comparable, S any](name string, fn func() T) *MapPool
 }
 
 func (p *MapPool[T, _, _]) Get() T {
-	if p.counter != nil {
+	if p.counter != nil && config.Measuring() {
 		p.counter.WithLabelValues(p.name, "get").Inc()
 	}
 
@@ -157,7 +157,7 @@ func (p *MapPool[T, _, _]) Get() T {
 }
 
 func (p *MapPool[T, _, _]) Put(t T) {
-	if p.counter != nil {
+	if p.counter != nil && config.Measuring() {
 		p.counter.WithLabelValues(p.name, "put").Inc()
 	}
 
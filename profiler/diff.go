@@ -0,0 +1,280 @@
+package profiler
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+	"github.com/mazrean/isucon-go-tools/v2/internal/metrics"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+const defaultDiffLimit = 20
+
+var errNoProfile = errors.New("profile not found")
+
+// FunctionDiff 関数ごとの、プロファイル全体に占める割合の変化
+// ベンチマークごとに走行時間や負荷が異なるため、値そのものではなく割合で比較する
+type FunctionDiff struct {
+	Function  string        `json:"function"`
+	Flat      metrics.Delta `json:"flat"`
+	Cum       metrics.Delta `json:"cum"`
+	FlatShare metrics.Delta `json:"flat_share"`
+	CumShare  metrics.Delta `json:"cum_share"`
+}
+
+type ProfileDiff struct {
+	SampleType string         `json:"sample_type"`
+	Unit       string         `json:"unit"`
+	Total      metrics.Delta  `json:"total"`
+	Functions  []FunctionDiff `json:"functions"`
+}
+
+// diffProfile go tool pprof -diff_baseと同様に、baseを負にしてマージする
+// baseのサンプルにはpprof::baseラベルを付けるので、そのままgo tool pprofで差分として表示できる
+func diffProfile(base, p *profile.Profile) (*profile.Profile, error) {
+	base = base.Copy()
+	base.Scale(-1)
+	for _, s := range base.Sample {
+		if s.Label == nil {
+			s.Label = map[string][]string{}
+		}
+		s.Label["pprof::base"] = []string{"true"}
+	}
+
+	diff, err := profile.Merge([]*profile.Profile{base, p})
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge profiles: %w", err)
+	}
+
+	return diff, nil
+}
+
+func sampleIndex(p *profile.Profile, sampleType string) (int, error) {
+	if sampleType == "" {
+		sampleType = p.DefaultSampleType
+	}
+	if sampleType == "" {
+		return len(p.SampleType) - 1, nil
+	}
+
+	for i, st := range p.SampleType {
+		if st.Type == sampleType {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("sample type %s not found", sampleType)
+}
+
+type functionStat struct {
+	flat int64
+	cum  int64
+}
+
+// functionStats 関数ごとのflat, cumを集計する
+// インライン展開された関数も、それぞれ別の関数として扱う
+func functionStats(p *profile.Profile, index int) (map[string]functionStat, int64) {
+	stats := map[string]functionStat{}
+	var total int64
+	for _, s := range p.Sample {
+		v := s.Value[index]
+		total += v
+
+		seen := map[string]struct{}{}
+		for i, loc := range s.Location {
+			for j, line := range loc.Line {
+				if line.Function == nil {
+					continue
+				}
+				name := line.Function.Name
+
+				stat := stats[name]
+				// Sample.Location[0].Line[0]が最も内側の関数
+				if i == 0 && j == 0 {
+					stat.flat += v
+				}
+				if _, ok := seen[name]; !ok {
+					stat.cum += v
+					seen[name] = struct{}{}
+				}
+				stats[name] = stat
+			}
+		}
+	}
+
+	return stats, total
+}
+
+func share(v, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(v) / float64(total)
+}
+
+// topDiff flatの割合の変化が大きい順に、上位n件の関数を返す
+func topDiff(from, to *profile.Profile, sampleType string, n int) (*ProfileDiff, error) {
+	toIndex, err := sampleIndex(to, sampleType)
+	if err != nil {
+		return nil, err
+	}
+	st := to.SampleType[toIndex]
+
+	fromIndex, err := sampleIndex(from, st.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	fromStats, fromTotal := functionStats(from, fromIndex)
+	toStats, toTotal := functionStats(to, toIndex)
+
+	names := make(map[string]struct{}, len(fromStats)+len(toStats))
+	for name := range fromStats {
+		names[name] = struct{}{}
+	}
+	for name := range toStats {
+		names[name] = struct{}{}
+	}
+
+	functions := make([]FunctionDiff, 0, len(names))
+	for name := range names {
+		f, t := fromStats[name], toStats[name]
+		functions = append(functions, FunctionDiff{
+			Function:  name,
+			Flat:      newDelta(float64(f.flat), float64(t.flat)),
+			Cum:       newDelta(float64(f.cum), float64(t.cum)),
+			FlatShare: newDelta(share(f.flat, fromTotal), share(t.flat, toTotal)),
+			CumShare:  newDelta(share(f.cum, fromTotal), share(t.cum, toTotal)),
+		})
+	}
+	slices.SortFunc(functions, func(a, b FunctionDiff) int {
+		return cmp.Or(
+			cmp.Compare(math.Abs(b.FlatShare.Diff), math.Abs(a.FlatShare.Diff)),
+			cmp.Compare(math.Abs(b.CumShare.Diff), math.Abs(a.CumShare.Diff)),
+			cmp.Compare(a.Function, b.Function),
+		)
+	})
+	if n > 0 && len(functions) > n {
+		functions = functions[:n]
+	}
+
+	return &ProfileDiff{
+		SampleType: st.Type,
+		Unit:       st.Unit,
+		Total:      newDelta(float64(fromTotal), float64(toTotal)),
+		Functions:  functions,
+	}, nil
+}
+
+func newDelta(from, to float64) metrics.Delta {
+	return metrics.Delta{
+		From: from,
+		To:   to,
+		Diff: to - from,
+	}
+}
+
+func loadProfile(id int, typ string) (*profile.Profile, error) {
+	f, err := os.Open(profilePath(id, typ))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoProfile
+		}
+
+		return nil, fmt.Errorf("failed to open profile: %w", err)
+	}
+	defer f.Close()
+
+	p, err := profile.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profile: %w", err)
+	}
+
+	return p, nil
+}
+
+func profileDiffHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	strFrom := query.Get("from")
+	fromID, err := strconv.Atoi(strFrom)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from(%s): %s", strFrom, err), http.StatusBadRequest)
+		return
+	}
+
+	strTo := query.Get("to")
+	toID, err := strconv.Atoi(strTo)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to(%s): %s", strTo, err), http.StatusBadRequest)
+		return
+	}
+
+	typ := query.Get("type")
+	if typ == "" {
+		typ = ProfileCPU
+	}
+	if !slices.Contains(profileTypes, typ) {
+		http.Error(w, fmt.Sprintf("unknown profile type: %s", typ), http.StatusBadRequest)
+		return
+	}
+
+	n := defaultDiffLimit
+	if strN := query.Get("n"); strN != "" {
+		n, err = strconv.Atoi(strN)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid n(%s): %s", strN, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	profiles := make([]*profile.Profile, 0, 2)
+	for _, id := range []int{fromID, toID} {
+		p, err := loadProfile(id, typ)
+		if errors.Is(err, errNoProfile) {
+			http.Error(w, fmt.Sprintf("%s profile of run %d not found", typ, id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to load profile: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		profiles = append(profiles, p)
+	}
+	from, to := profiles[0], profiles[1]
+
+	switch format := query.Get("format"); format {
+	case "", "json":
+		diff, err := topDiff(from, to, query.Get("sample"), n)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to diff profiles: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		response.JSON(w, diff)
+	case "pprof":
+		diff, err := diffProfile(from, to)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to diff profiles: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d-%d-%s%s"`, fromID, toID, typ, profileExt))
+		err = diff.Write(w)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to write profile: %s", err), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format: %s", format), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,133 @@
+package profiler
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// newFixtureProfile "leaf;caller;main"形式のスタックごとの値からCPUプロファイルを作る
+func newFixtureProfile(stacks map[string]int64) *profile.Profile {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+	}
+
+	functions := map[string]*profile.Function{}
+	locations := map[string]*profile.Location{}
+	for stack, v := range stacks {
+		sample := &profile.Sample{Value: []int64{v / p.Period, v}}
+		for _, name := range strings.Split(stack, ";") {
+			loc, ok := locations[name]
+			if !ok {
+				fn := &profile.Function{
+					ID:   uint64(len(functions) + 1),
+					Name: name,
+				}
+				functions[name] = fn
+				p.Function = append(p.Function, fn)
+
+				loc = &profile.Location{
+					ID:   uint64(len(locations) + 1),
+					Line: []profile.Line{{Function: fn}},
+				}
+				locations[name] = loc
+				p.Location = append(p.Location, loc)
+			}
+
+			sample.Location = append(sample.Location, loc)
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+
+	return p
+}
+
+func TestTopDiff(t *testing.T) {
+	t.Parallel()
+
+	from := newFixtureProfile(map[string]int64{
+		"json.Marshal;getUsers;main": 600,
+		"sql.Query;getUsers;main":    300,
+		"sql.Query;getPosts;main":    100,
+	})
+	// 走行時間が倍になり、json.Marshalの割合が減った
+	to := newFixtureProfile(map[string]int64{
+		"json.Marshal;getUsers;main": 400,
+		"sql.Query;getUsers;main":    1200,
+		"sql.Query;getPosts;main":    400,
+	})
+
+	diff, err := topDiff(from, to, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff.SampleType != "cpu" {
+		t.Errorf("expected sample type cpu, got %s", diff.SampleType)
+	}
+	if diff.Total.From != 1000 || diff.Total.To != 2000 {
+		t.Errorf("unexpected total: %+v", diff.Total)
+	}
+	if len(diff.Functions) != 2 {
+		t.Fatalf("expected 2 functions, got %+v", diff.Functions)
+	}
+
+	// flatの割合: json.Marshal 0.6 -> 0.2, sql.Query 0.4 -> 0.8
+	for _, f := range diff.Functions {
+		var expected float64
+		switch f.Function {
+		case "json.Marshal":
+			expected = -0.4
+		case "sql.Query":
+			expected = 0.4
+		default:
+			t.Errorf("unexpected function: %s", f.Function)
+			continue
+		}
+
+		if math.Abs(f.FlatShare.Diff-expected) > 1e-9 {
+			t.Errorf("%s: expected flat share diff %f, got %f", f.Function, expected, f.FlatShare.Diff)
+		}
+	}
+}
+
+func TestDiffProfile(t *testing.T) {
+	t.Parallel()
+
+	from := newFixtureProfile(map[string]int64{
+		"sql.Query;getUsers;main": 300,
+	})
+	to := newFixtureProfile(map[string]int64{
+		"sql.Query;getUsers;main": 500,
+	})
+
+	diff, err := diffProfile(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		total int64
+		base  int
+	)
+	for _, s := range diff.Sample {
+		total += s.Value[1]
+		if len(s.Label["pprof::base"]) > 0 {
+			base++
+		}
+	}
+
+	if total != 200 {
+		t.Errorf("expected total 200, got %d", total)
+	}
+	if base != 1 {
+		t.Errorf("expected 1 base sample, got %d", base)
+	}
+}
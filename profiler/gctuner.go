@@ -0,0 +1,494 @@
+package profiler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+/*
+	ベンチマーク中のGCのCPU使用率とメモリ使用量を見てGOGC, GOMEMLIMITを調整する
+	GC_TUNER: off(デフォルト), on(調整して結果を保存), replay(保存済みの設定の適用のみ)
+	GC_TUNER_FILE: 調整結果の保存先(デフォルトgctuner.json)
+	GC_TUNER_TARGET: 目標とするGCのCPU使用率(デフォルト0.05)、この半分を下回っている間はGOGCを下げてメモリを空ける
+	GC_TUNER_GOGC_MIN, GC_TUNER_GOGC_MAX: GOGCの範囲(デフォルト50〜1600)
+	GC_TUNER_MEMORY_LIMIT: GOMEMLIMITの上限(例: 2GiB)、未設定の場合はGOMEMLIMITを変更しない
+*/
+
+const (
+	gcTunerOff    = "off"
+	gcTunerOn     = "on"
+	gcTunerReplay = "replay"
+
+	// memoryPressure メモリ使用量がGC_TUNER_MEMORY_LIMITのこの割合を超えたらGOGCを下げる
+	memoryPressure = 0.8
+	// maxGCDecisions /gctunerで返す直近の調整履歴の数
+	maxGCDecisions = 100
+)
+
+var (
+	gcTunerInterval = 5 * time.Second
+
+	gcTunerMode = gcTunerOff
+	gcTunerFile = "gctuner.json"
+	gcTuner     = gcTunerConfig{
+		target:  0.05,
+		gogcMin: 50,
+		gogcMax: 1600,
+	}
+	gcTunerLocker = &sync.Mutex{}
+	gcTunerRun    *gcTunerWatch
+	gcDecisions   []gcDecision
+
+	gogcGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "isutools",
+		Subsystem: "gctuner",
+		Name:      "gogc",
+		Help:      "GOGC set by the gc tuner",
+	})
+	memoryLimitGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "isutools",
+		Subsystem: "gctuner",
+		Name:      "memory_limit_bytes",
+		Help:      "GOMEMLIMIT set by the gc tuner",
+	})
+	gcDecisionCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isutools",
+		Subsystem: "gctuner",
+		Name:      "decisions_total",
+		Help:      "number of adjustments made by the gc tuner",
+	}, []string{"knob", "reason"})
+)
+
+type gcTunerConfig struct {
+	target      float64
+	gogcMin     int
+	gogcMax     int
+	memoryLimit int64
+}
+
+// gcSettings GC_TUNER_FILEに保存する調整結果
+type gcSettings struct {
+	Benchmark   int       `json:"benchmark"`
+	Time        time.Time `json:"time"`
+	GOGC        int       `json:"gogc"`
+	MemoryLimit int64     `json:"memory_limit"`
+}
+
+type gcDecision struct {
+	Time        time.Time `json:"time"`
+	Knob        string    `json:"knob"`
+	Reason      string    `json:"reason"`
+	From        int64     `json:"from"`
+	To          int64     `json:"to"`
+	CPUFraction float64   `json:"cpu_fraction"`
+	Memory      uint64    `json:"memory"`
+}
+
+type gcTunerWatch struct {
+	id   int
+	stop chan struct{}
+	done chan struct{}
+}
+
+// setupGCTuner 本番走行などで計測を無効にしている場合も、保存済みの設定は適用する
+func setupGCTuner() error {
+	mode, ok := os.LookupEnv("GC_TUNER")
+	if !ok {
+		return nil
+	}
+
+	switch mode {
+	case gcTunerOff:
+		return nil
+	case gcTunerOn, gcTunerReplay:
+		gcTunerMode = mode
+	default:
+		return fmt.Errorf("invalid GC_TUNER(%s): must be one of %s, %s, %s", mode, gcTunerOff, gcTunerOn, gcTunerReplay)
+	}
+
+	file, ok := os.LookupEnv("GC_TUNER_FILE")
+	if ok {
+		gcTunerFile = file
+	}
+
+	err := loadGCTunerConfig()
+	if err != nil {
+		return err
+	}
+
+	settings, err := readGCSettings()
+	if err != nil {
+		slog.Error("failed to read gc tuner settings",
+			slog.String("file", gcTunerFile),
+			slog.String("error", err.Error()),
+		)
+	} else if settings != nil {
+		applyGCSettings(settings)
+		slog.Info("replayed gc tuner settings",
+			slog.String("file", gcTunerFile),
+			slog.Int("benchmark", settings.Benchmark),
+			slog.Int("gogc", settings.GOGC),
+			slog.Int64("memory_limit", settings.MemoryLimit),
+		)
+	}
+
+	if gcTunerMode == gcTunerOn {
+		benchmark.SetStartHook(startGCTuner)
+		benchmark.SetEndHook(finishGCTuner)
+	}
+
+	return nil
+}
+
+func loadGCTunerConfig() error {
+	strTarget, ok := os.LookupEnv("GC_TUNER_TARGET")
+	if ok {
+		target, err := strconv.ParseFloat(strTarget, 64)
+		if err != nil || target <= 0 || target >= 1 {
+			return fmt.Errorf("invalid GC_TUNER_TARGET(%s): must be in (0, 1)", strTarget)
+		}
+		gcTuner.target = target
+	}
+
+	for env, v := range map[string]*int{
+		"GC_TUNER_GOGC_MIN": &gcTuner.gogcMin,
+		"GC_TUNER_GOGC_MAX": &gcTuner.gogcMax,
+	} {
+		str, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s(%s): must be a positive integer", env, str)
+		}
+		*v = n
+	}
+	if gcTuner.gogcMin > gcTuner.gogcMax {
+		return fmt.Errorf("GC_TUNER_GOGC_MIN(%d) is larger than GC_TUNER_GOGC_MAX(%d)", gcTuner.gogcMin, gcTuner.gogcMax)
+	}
+
+	strLimit, ok := os.LookupEnv("GC_TUNER_MEMORY_LIMIT")
+	if ok {
+		limit, err := parseBytes(strLimit)
+		if err != nil {
+			return fmt.Errorf("invalid GC_TUNER_MEMORY_LIMIT(%s): %w", strLimit, err)
+		}
+		gcTuner.memoryLimit = limit
+	}
+
+	return nil
+}
+
+// parseBytes GOMEMLIMITと同じ形式(B, KiB, MiB, GiB, TiB)のサイズをパースする
+func parseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+		{"B", 1},
+	}
+
+	size := int64(1)
+	for _, unit := range units {
+		if num, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s = num
+			size = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 || n > math.MaxInt64/size {
+		return 0, errors.New("out of range")
+	}
+
+	return n * size, nil
+}
+
+func readGCSettings() (*gcSettings, error) {
+	buf, err := os.ReadFile(gcTunerFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var settings gcSettings
+	err = json.Unmarshal(buf, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal settings: %w", err)
+	}
+
+	return &settings, nil
+}
+
+func writeGCSettings(settings *gcSettings) error {
+	buf, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settings: %w", err)
+	}
+
+	tmp := gcTunerFile + ".tmp"
+	err = os.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	err = os.Rename(tmp, gcTunerFile)
+	if err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return nil
+}
+
+func applyGCSettings(settings *gcSettings) {
+	if settings.GOGC > 0 {
+		debug.SetGCPercent(settings.GOGC)
+		gogcGauge.Set(float64(settings.GOGC))
+	}
+
+	if settings.MemoryLimit > 0 {
+		debug.SetMemoryLimit(settings.MemoryLimit)
+		memoryLimitGauge.Set(float64(settings.MemoryLimit))
+	}
+}
+
+// currentGOGC GOGC=offの場合は-1を返す
+func currentGOGC() int {
+	sample := []metrics.Sample{{Name: metricGOGC}}
+	metrics.Read(sample)
+
+	gogc := sample[0].Value.Uint64()
+	if gogc > math.MaxInt32 {
+		return -1
+	}
+
+	return int(gogc)
+}
+
+func startGCTuner(_ context.Context, b *benchmark.Benchmark) {
+	// 調整中のgoroutineがgcTunerLockerを待っていることがあるので、ロックを外してから止める
+	gcTunerLocker.Lock()
+	prev := gcTunerRun
+	gcTunerRun = nil
+	gcTunerLocker.Unlock()
+
+	if prev != nil {
+		close(prev.stop)
+		<-prev.done
+	}
+
+	gcTunerLocker.Lock()
+	defer gcTunerLocker.Unlock()
+
+	if gcTuner.memoryLimit > 0 && debug.SetMemoryLimit(-1) != gcTuner.memoryLimit {
+		// GOGCを上げてもOOMにならないよう、先に上限を設定しておく
+		from := debug.SetMemoryLimit(gcTuner.memoryLimit)
+		recordGCDecision(gcDecision{
+			Time:   time.Now(),
+			Knob:   "memory_limit",
+			Reason: "configured",
+			From:   from,
+			To:     gcTuner.memoryLimit,
+		})
+		memoryLimitGauge.Set(float64(gcTuner.memoryLimit))
+	}
+
+	gcTunerRun = &gcTunerWatch{
+		id:   b.ID,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go gcTunerRun.watch()
+}
+
+func (w *gcTunerWatch) watch() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(gcTunerInterval)
+	defer ticker.Stop()
+
+	prev := readRuntimeMetrics()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+
+		current := readRuntimeMetrics()
+		tuneGC(prev, current)
+		prev = current
+	}
+}
+
+func tuneGC(prev, current map[string]metrics.Value) {
+	fraction := gcSummary(prev, current).CPUFraction
+
+	var memory uint64
+	if current[metricTotalMemory].Kind() == metrics.KindUint64 {
+		memory = current[metricTotalMemory].Uint64()
+	}
+
+	gogc := currentGOGC()
+	next, reason := decideGOGC(gcTuner, gogc, fraction, memory)
+	if next == gogc {
+		return
+	}
+
+	debug.SetGCPercent(next)
+	gogcGauge.Set(float64(next))
+
+	gcTunerLocker.Lock()
+	defer gcTunerLocker.Unlock()
+
+	recordGCDecision(gcDecision{
+		Time:        time.Now(),
+		Knob:        "gogc",
+		Reason:      reason,
+		From:        int64(gogc),
+		To:          int64(next),
+		CPUFraction: fraction,
+		Memory:      memory,
+	})
+}
+
+// decideGOGC メモリに余裕がなければGOGCを下げ、GCのCPU使用率が目標を超えていればGOGCを上げる
+// 目標の半分を下回っている場合は、GOGCが上がり続けないよう下げる
+// 一度に変える幅は2倍までにして、目標付近では変えないことで振動しないようにする
+func decideGOGC(cfg gcTunerConfig, gogc int, fraction float64, memory uint64) (int, string) {
+	// GOGC=offの場合も範囲内に戻す
+	if gogc < 0 {
+		return cfg.gogcMax, "out_of_range"
+	}
+
+	clamp := func(v int) int {
+		return min(max(v, cfg.gogcMin), cfg.gogcMax)
+	}
+
+	if cfg.memoryLimit > 0 && float64(memory) > float64(cfg.memoryLimit)*memoryPressure {
+		return clamp(gogc * 3 / 4), "memory_pressure"
+	}
+
+	if fraction > cfg.target {
+		ratio := min(fraction/cfg.target, 2)
+		return clamp(int(math.Round(float64(gogc) * ratio))), "gc_cpu"
+	}
+
+	if fraction < cfg.target/2 {
+		if next := clamp(gogc * 3 / 4); next != gogc {
+			return next, "gc_cpu_low"
+		}
+	}
+
+	if next := clamp(gogc); next != gogc {
+		return next, "out_of_range"
+	}
+
+	return gogc, ""
+}
+
+// recordGCDecision gcTunerLockerを取得した状態で呼ぶ
+func recordGCDecision(d gcDecision) {
+	slog.Info("gc tuner adjusted",
+		slog.String("knob", d.Knob),
+		slog.String("reason", d.Reason),
+		slog.Int64("from", d.From),
+		slog.Int64("to", d.To),
+		slog.Float64("cpu_fraction", d.CPUFraction),
+		slog.Uint64("memory", d.Memory),
+	)
+	gcDecisionCounterVec.WithLabelValues(d.Knob, d.Reason).Inc()
+
+	gcDecisions = append(gcDecisions, d)
+	if len(gcDecisions) > maxGCDecisions {
+		gcDecisions = gcDecisions[len(gcDecisions)-maxGCDecisions:]
+	}
+}
+
+func finishGCTuner(_ context.Context, b *benchmark.Benchmark) {
+	gcTunerLocker.Lock()
+	w := gcTunerRun
+	if w != nil && w.id == b.ID {
+		gcTunerRun = nil
+	}
+	gcTunerLocker.Unlock()
+
+	if w == nil || w.id != b.ID {
+		return
+	}
+
+	close(w.stop)
+	<-w.done
+
+	settings := &gcSettings{
+		Benchmark:   b.ID,
+		Time:        time.Now(),
+		GOGC:        currentGOGC(),
+		MemoryLimit: gcTuner.memoryLimit,
+	}
+	err := writeGCSettings(settings)
+	if err != nil {
+		slog.Error("failed to save gc tuner settings",
+			slog.String("file", gcTunerFile),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	slog.Info("saved gc tuner settings",
+		slog.String("file", gcTunerFile),
+		slog.Int("benchmark", b.ID),
+		slog.Int("gogc", settings.GOGC),
+		slog.Int64("memory_limit", settings.MemoryLimit),
+	)
+}
+
+func gcTunerHandler(w http.ResponseWriter, r *http.Request) {
+	gcTunerLocker.Lock()
+	defer gcTunerLocker.Unlock()
+
+	response.JSON(w, struct {
+		Mode        string       `json:"mode"`
+		Running     bool         `json:"running"`
+		GOGC        int          `json:"gogc"`
+		MemoryLimit int64        `json:"memory_limit"`
+		Decisions   []gcDecision `json:"decisions"`
+	}{
+		Mode:        gcTunerMode,
+		Running:     gcTunerRun != nil,
+		GOGC:        currentGOGC(),
+		MemoryLimit: debug.SetMemoryLimit(-1),
+		Decisions:   gcDecisions,
+	})
+}
@@ -0,0 +1,224 @@
+package profiler
+
+import (
+	"context"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+)
+
+func TestDecideGOGC(t *testing.T) {
+	t.Parallel()
+
+	cfg := gcTunerConfig{
+		target:      0.05,
+		gogcMin:     50,
+		gogcMax:     800,
+		memoryLimit: 1000,
+	}
+
+	tests := []struct {
+		description string
+		gogc        int
+		fraction    float64
+		memory      uint64
+		expected    int
+		reason      string
+	}{
+		{
+			description: "within target",
+			gogc:        100,
+			fraction:    0.03,
+			memory:      100,
+			expected:    100,
+		},
+		{
+			description: "gc cpu over target",
+			gogc:        100,
+			fraction:    0.075,
+			memory:      100,
+			expected:    150,
+			reason:      "gc_cpu",
+		},
+		{
+			description: "step is limited to twice",
+			gogc:        100,
+			fraction:    0.5,
+			memory:      100,
+			expected:    200,
+			reason:      "gc_cpu",
+		},
+		{
+			description: "clamped to max",
+			gogc:        600,
+			fraction:    0.5,
+			memory:      100,
+			expected:    800,
+			reason:      "gc_cpu",
+		},
+		{
+			description: "memory pressure wins over gc cpu",
+			gogc:        400,
+			fraction:    0.5,
+			memory:      900,
+			expected:    300,
+			reason:      "memory_pressure",
+		},
+		{
+			description: "clamped to min",
+			gogc:        60,
+			fraction:    0,
+			memory:      900,
+			expected:    50,
+			reason:      "memory_pressure",
+		},
+		{
+			description: "gc cpu well under target",
+			gogc:        400,
+			fraction:    0.01,
+			memory:      100,
+			expected:    300,
+			reason:      "gc_cpu_low",
+		},
+		{
+			description: "gc cpu under target at min",
+			gogc:        50,
+			fraction:    0,
+			memory:      100,
+			expected:    50,
+		},
+		{
+			description: "gogc off",
+			gogc:        -1,
+			fraction:    0,
+			memory:      100,
+			expected:    800,
+			reason:      "out_of_range",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			actual, reason := decideGOGC(cfg, test.gogc, test.fraction, test.memory)
+			if actual != test.expected || reason != test.reason {
+				t.Errorf("expected (%d, %q), got (%d, %q)", test.expected, test.reason, actual, reason)
+			}
+		})
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected int64
+		isErr    bool
+	}{
+		{input: "1024", expected: 1024},
+		{input: "512B", expected: 512},
+		{input: "2KiB", expected: 2 << 10},
+		{input: "3MiB", expected: 3 << 20},
+		{input: "2GiB", expected: 2 << 30},
+		{input: "1TiB", expected: 1 << 40},
+		{input: "1GB", isErr: true},
+		{input: "0", isErr: true},
+		{input: "-1GiB", isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := parseBytes(test.input)
+			if test.isErr {
+				if err == nil {
+					t.Errorf("expected error, got %d", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, actual)
+			}
+		})
+	}
+}
+
+// TestGCTunerLifecycle グローバルな設定を書き換えるので、並行に実行しない
+func TestGCTunerLifecycle(t *testing.T) {
+	prevGOGC := debug.SetGCPercent(1000)
+	prevInterval, prevConfig, prevFile := gcTunerInterval, gcTuner, gcTunerFile
+	t.Cleanup(func() {
+		debug.SetGCPercent(prevGOGC)
+		gcTunerInterval, gcTuner, gcTunerFile = prevInterval, prevConfig, prevFile
+	})
+
+	// 毎回の調整でGOGCが範囲外から戻るよう、短い間隔で調整する
+	gcTunerInterval = time.Millisecond
+	gcTuner = gcTunerConfig{
+		target:  0.05,
+		gogcMin: 50,
+		gogcMax: 200,
+	}
+	gcTunerFile = filepath.Join(t.TempDir(), "gctuner.json")
+
+	ctx := context.Background()
+
+	// 調整中に次のベンチマークが始まった場合は、前の調整を止めて切り替える
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 100; i++ {
+			debug.SetGCPercent(1000)
+			startGCTuner(ctx, &benchmark.Benchmark{ID: i})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("startGCTuner is blocked")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for currentGOGC() > gcTuner.gogcMax {
+		if time.Now().After(deadline) {
+			t.Fatalf("gogc is not tuned: %d", currentGOGC())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 別のベンチマークの終了では止めない
+	finishGCTuner(ctx, &benchmark.Benchmark{ID: 1})
+	if settings, err := readGCSettings(); err != nil || settings != nil {
+		t.Fatalf("settings must not be saved: %v, %v", settings, err)
+	}
+
+	finishGCTuner(ctx, &benchmark.Benchmark{ID: 100})
+
+	gcTunerLocker.Lock()
+	running := gcTunerRun != nil
+	gcTunerLocker.Unlock()
+	if running {
+		t.Error("tuner must be stopped")
+	}
+
+	settings, err := readGCSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings == nil || settings.Benchmark != 100 {
+		t.Fatalf("unexpected settings: %+v", settings)
+	}
+	if settings.GOGC < gcTuner.gogcMin || settings.GOGC > gcTuner.gogcMax {
+		t.Errorf("saved gogc is out of range: %d", settings.GOGC)
+	}
+}
@@ -0,0 +1,259 @@
+package profiler
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// maxGoroutineSamples ベンチマーク中に保持するサンプル数の上限(5秒間隔で30分)
+	maxGoroutineSamples = 360
+	// minGoroutineGrowth 増加し続けていても、この数未満の増加はリークとみなさない
+	minGoroutineGrowth = 10
+	// minGrowingSamples 単調増加の判定に必要なサンプル数
+	minGrowingSamples = 3
+	// creatorUnknown 生成元のないgoroutine(main goroutineなど)
+	creatorUnknown = "unknown"
+)
+
+var (
+	goroutineGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "isutools",
+		Subsystem: "runtime",
+		Name:      "goroutines",
+		Help:      "number of goroutines grouped by the creation site",
+	}, []string{"creator"})
+
+	goroutineLocker = &sync.RWMutex{}
+	// goroutineWindow ベンチマーク走行中のサンプル
+	goroutineWindow  []goroutineSample
+	goroutineRunning bool
+	latestGoroutine  goroutineSample
+)
+
+type goroutineSample struct {
+	Time     time.Time
+	Total    int
+	Creators map[string]int
+}
+
+func setupGoroutineWatch() {
+	benchmark.SetStartHook(startGoroutineWindow)
+	benchmark.SetEndHook(finishGoroutineWindow)
+
+	go func() {
+		ticker := time.NewTicker(goroutineInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			sample, err := sampleGoroutineCreators()
+			if err != nil {
+				slog.Error("failed to sample goroutines",
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+
+			addGoroutineSample(sample)
+			// goroutineプロファイルの取得を2重に行わないよう、ベンチマークごとのプロファイルもここで更新する
+			sampleRunGoroutine(sample.Total)
+		}
+	}()
+}
+
+// sampleGoroutineCreators debug=2のgoroutineプロファイルの「created by」から生成元ごとの数を数える
+// protobuf形式のプロファイルには生成元が含まれないため、テキスト形式を使う
+func sampleGoroutineCreators() (goroutineSample, error) {
+	buf := &bytes.Buffer{}
+	err := pprof.Lookup("goroutine").WriteTo(buf, 2)
+	if err != nil {
+		return goroutineSample{}, fmt.Errorf("failed to write goroutine profile: %w", err)
+	}
+
+	creators := parseGoroutineCreators(buf.Bytes())
+
+	total := 0
+	for _, count := range creators {
+		total += count
+	}
+
+	return goroutineSample{
+		Time:     time.Now(),
+		Total:    total,
+		Creators: creators,
+	}, nil
+}
+
+func parseGoroutineCreators(stacks []byte) map[string]int {
+	creators := map[string]int{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(stacks))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	inGoroutine := false
+	creator := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "goroutine "):
+			inGoroutine = true
+			creator = creatorUnknown
+		case line == "":
+			if inGoroutine {
+				creators[creator]++
+			}
+			inGoroutine = false
+		case strings.HasPrefix(line, "created by "):
+			creator, _, _ = strings.Cut(strings.TrimPrefix(line, "created by "), " in goroutine ")
+
+			// 同じ関数から複数箇所で生成されている場合を区別するため、生成した行を付ける
+			if scanner.Scan() {
+				location, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " +0x")
+				creator = fmt.Sprintf("%s@%s", creator, filepath.Base(location))
+			}
+		}
+	}
+	if inGoroutine {
+		creators[creator]++
+	}
+
+	return creators
+}
+
+func addGoroutineSample(sample goroutineSample) {
+	goroutineLocker.Lock()
+	defer goroutineLocker.Unlock()
+
+	// 消えた生成元のラベルが残らないよう、毎回作り直す
+	goroutineGaugeVec.Reset()
+	for creator, count := range sample.Creators {
+		goroutineGaugeVec.WithLabelValues(creator).Set(float64(count))
+	}
+
+	latestGoroutine = sample
+	if goroutineRunning && len(goroutineWindow) < maxGoroutineSamples {
+		goroutineWindow = append(goroutineWindow, sample)
+	}
+}
+
+func startGoroutineWindow(context.Context, *benchmark.Benchmark) {
+	goroutineLocker.Lock()
+	defer goroutineLocker.Unlock()
+
+	goroutineWindow = nil
+	goroutineRunning = true
+}
+
+func finishGoroutineWindow(_ context.Context, b *benchmark.Benchmark) {
+	goroutineLocker.Lock()
+	defer goroutineLocker.Unlock()
+
+	goroutineRunning = false
+
+	for _, growth := range growingCreators(goroutineWindow) {
+		slog.Warn("goroutines kept increasing during the benchmark",
+			slog.Int("benchmark", b.ID),
+			slog.String("creator", growth.Creator),
+			slog.Int("from", growth.From),
+			slog.Int("to", growth.To),
+		)
+	}
+}
+
+type goroutineGrowth struct {
+	Creator string `json:"creator"`
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+}
+
+// growingCreators 全サンプルを通して一度も減らずにminGoroutineGrowth以上増えた生成元を返す
+func growingCreators(samples []goroutineSample) []goroutineGrowth {
+	if len(samples) < minGrowingSamples {
+		return nil
+	}
+
+	creators := map[string]struct{}{}
+	for _, sample := range samples {
+		for creator := range sample.Creators {
+			creators[creator] = struct{}{}
+		}
+	}
+
+	growths := []goroutineGrowth{}
+	for creator := range creators {
+		monotonic := true
+		for i := 1; i < len(samples); i++ {
+			if samples[i].Creators[creator] < samples[i-1].Creators[creator] {
+				monotonic = false
+				break
+			}
+		}
+
+		from, to := samples[0].Creators[creator], samples[len(samples)-1].Creators[creator]
+		if monotonic && to-from >= minGoroutineGrowth {
+			growths = append(growths, goroutineGrowth{
+				Creator: creator,
+				From:    from,
+				To:      to,
+			})
+		}
+	}
+	slices.SortFunc(growths, func(a, b goroutineGrowth) int {
+		return cmp.Or(cmp.Compare(b.To-b.From, a.To-a.From), cmp.Compare(a.Creator, b.Creator))
+	})
+
+	return growths
+}
+
+type goroutineCreator struct {
+	Creator string `json:"creator"`
+	Count   int    `json:"count"`
+}
+
+func goroutineHandler(w http.ResponseWriter, r *http.Request) {
+	goroutineLocker.RLock()
+	defer goroutineLocker.RUnlock()
+
+	creators := make([]goroutineCreator, 0, len(latestGoroutine.Creators))
+	for creator, count := range latestGoroutine.Creators {
+		creators = append(creators, goroutineCreator{
+			Creator: creator,
+			Count:   count,
+		})
+	}
+	slices.SortFunc(creators, func(a, b goroutineCreator) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Creator, b.Creator))
+	})
+
+	response.JSON(w, struct {
+		Time     time.Time          `json:"time"`
+		Total    int                `json:"total"`
+		Running  bool               `json:"running"`
+		Samples  int                `json:"samples"`
+		Creators []goroutineCreator `json:"creators"`
+		Growing  []goroutineGrowth  `json:"growing"`
+	}{
+		Time:     latestGoroutine.Time,
+		Total:    latestGoroutine.Total,
+		Running:  goroutineRunning,
+		Samples:  len(goroutineWindow),
+		Creators: creators,
+		Growing:  growingCreators(goroutineWindow),
+	})
+}
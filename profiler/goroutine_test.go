@@ -0,0 +1,121 @@
+package profiler
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseGoroutineCreators(t *testing.T) {
+	t.Parallel()
+
+	stacks := `goroutine 1 [running]:
+main.main()
+	/app/main.go:10 +0x1d
+
+goroutine 7 [sleep]:
+time.Sleep(0x3b9aca00)
+	/usr/local/go/src/runtime/time.go:300 +0xf2
+main.postHandler.func1()
+	/app/handler.go:42 +0x25
+created by main.postHandler in goroutine 6
+	/app/handler.go:40 +0x8e
+
+goroutine 8 [sleep]:
+main.postHandler.func1()
+	/app/handler.go:42 +0x25
+created by main.postHandler in goroutine 6
+	/app/handler.go:40 +0x8e
+
+goroutine 9 [select]:
+main.postHandler.func2()
+	/app/handler.go:52 +0x25
+created by main.postHandler in goroutine 6
+	/app/handler.go:50 +0x8e
+`
+
+	expected := map[string]int{
+		creatorUnknown:                   1,
+		"main.postHandler@handler.go:40": 2,
+		"main.postHandler@handler.go:50": 1,
+	}
+
+	actual := parseGoroutineCreators([]byte(stacks))
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for creator, count := range expected {
+		if actual[creator] != count {
+			t.Errorf("%s: expected %d, got %d", creator, count, actual[creator])
+		}
+	}
+}
+
+func TestGrowingCreators(t *testing.T) {
+	t.Parallel()
+
+	newSamples := func(counts ...map[string]int) []goroutineSample {
+		samples := make([]goroutineSample, 0, len(counts))
+		for _, c := range counts {
+			samples = append(samples, goroutineSample{Creators: c})
+		}
+
+		return samples
+	}
+
+	tests := []struct {
+		description string
+		samples     []goroutineSample
+		expected    []string
+	}{
+		{
+			description: "monotonic growth",
+			samples: newSamples(
+				map[string]int{"leak": 1, "pool": 10},
+				map[string]int{"leak": 20, "pool": 30},
+				map[string]int{"leak": 40, "pool": 5},
+			),
+			expected: []string{"leak"},
+		},
+		{
+			description: "appears during the window",
+			samples: newSamples(
+				map[string]int{},
+				map[string]int{"leak": 5},
+				map[string]int{"leak": 15},
+			),
+			expected: []string{"leak"},
+		},
+		{
+			description: "small growth",
+			samples: newSamples(
+				map[string]int{"worker": 1},
+				map[string]int{"worker": 2},
+				map[string]int{"worker": 3},
+			),
+			expected: []string{},
+		},
+		{
+			description: "too few samples",
+			samples: newSamples(
+				map[string]int{"leak": 1},
+				map[string]int{"leak": 100},
+			),
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			actual := []string{}
+			for _, growth := range growingCreators(test.samples) {
+				actual = append(actual, growth.Creator)
+			}
+
+			if !slices.Equal(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
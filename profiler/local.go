@@ -0,0 +1,204 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+)
+
+const (
+	// cpuChunkDuration CPUプロファイルを区切る間隔
+	// 終了が検知されないまま次のベンチマークが始まっても、それまでのプロファイルは残る
+	cpuChunkDuration = 10 * time.Second
+	// maxCPUChunks 30分を超えて終了しないベンチマークはプロファイルの取得を打ち切る
+	maxCPUChunks = int(30 * time.Minute / cpuChunkDuration)
+)
+
+var (
+	cpuCollector    = atomic.Pointer[cpuProfileCollector]{}
+	errNoCPUProfile = errors.New("no cpu profile collected")
+)
+
+// cpuProfileCollector ベンチマーク中のCPUプロファイルを一定間隔で区切って取得する
+type cpuProfileCollector struct {
+	id     int
+	locker sync.Mutex
+	chunks []*profile.Profile
+	// sampled Endの時点までに取得したチャンク数(Endの時点の区切りを入れる前は-1)
+	sampled int
+	cut     chan chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func startCPUProfile(_ context.Context, b *benchmark.Benchmark) {
+	c := &cpuProfileCollector{
+		id:      b.ID,
+		sampled: -1,
+		cut:     make(chan chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if prev := cpuCollector.Swap(c); prev != nil {
+		_, _ = prev.finish()
+	}
+
+	go c.run()
+}
+
+func (c *cpuProfileCollector) run() {
+	defer close(c.done)
+
+	for range maxCPUChunks {
+		buf := &bytes.Buffer{}
+		err := pprof.StartCPUProfile(buf)
+		if err != nil {
+			slog.Error("failed to start cpu profile",
+				slog.Int("benchmark", c.id),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+
+		var (
+			stopped bool
+			cutDone chan struct{}
+		)
+		timer := time.NewTimer(cpuChunkDuration)
+		select {
+		case <-timer.C:
+		case cutDone = <-c.cut:
+			timer.Stop()
+		case <-c.stop:
+			timer.Stop()
+			stopped = true
+		}
+		pprof.StopCPUProfile()
+
+		p, err := profile.Parse(buf)
+		if err != nil {
+			slog.Error("failed to parse cpu profile",
+				slog.Int("benchmark", c.id),
+				slog.String("error", err.Error()),
+			)
+		} else {
+			c.locker.Lock()
+			c.chunks = append(c.chunks, p)
+			c.locker.Unlock()
+		}
+
+		if cutDone != nil {
+			c.markSampled()
+			close(cutDone)
+		}
+
+		if stopped {
+			return
+		}
+	}
+
+	slog.Warn("cpu profile chunk limit exceeded",
+		slog.Int("benchmark", c.id),
+	)
+}
+
+// sampleEnd 取得中のチャンクを区切り、そこまでをベンチマーク中のプロファイルとする
+// 終了フックはEndより後に呼ばれるため、Endの時点で呼んでおく
+func (c *cpuProfileCollector) sampleEnd() {
+	cutDone := make(chan struct{})
+	select {
+	case c.cut <- cutDone:
+		<-cutDone
+	case <-c.done:
+		c.markSampled()
+	}
+}
+
+func (c *cpuProfileCollector) markSampled() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.sampled = len(c.chunks)
+}
+
+// finish プロファイルの取得を止め、Endの時点までに取得したプロファイルを1つにまとめる
+// 何度呼んでも同じプロファイルを返す
+func (c *cpuProfileCollector) finish() (*profile.Profile, error) {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	<-c.done
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	chunks := c.chunks
+	if c.sampled >= 0 {
+		chunks = chunks[:c.sampled]
+	}
+	if len(chunks) == 0 {
+		return nil, errNoCPUProfile
+	}
+
+	p, err := profile.Merge(chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge cpu profiles: %w", err)
+	}
+
+	return p, nil
+}
+
+func sampleCPUProfile(id int) {
+	c := cpuCollector.Load()
+	if c == nil || c.id != id {
+		return
+	}
+
+	c.sampleEnd()
+}
+
+func finishCPUProfile(id int) (*profile.Profile, error) {
+	c := cpuCollector.Load()
+	if c == nil || c.id != id {
+		return nil, errNoCPUProfile
+	}
+
+	return c.finish()
+}
+
+// LocalPGO ベンチマーク中にプロセス内で取得したCPUプロファイルからPGO用のファイルを生成する
+// Pyroscopeサーバーを用意しなくてもPGOを使えるようにするためのもの
+//
+// Deprecated: PGO_MODE=localの場合は終了時のフックでPGO用のファイルが書き込まれるため、登録する必要はない
+// PGO_MERGE_RUNS, PGO_MERGE_HOSTSを設定している場合、登録するとマージしたファイルが直前の1回分で上書きされる
+func LocalPGO(ctx context.Context, b *benchmark.Benchmark) {
+	p, err := finishCPUProfile(b.ID)
+	if err != nil {
+		slog.Error("failed to collect cpu profile",
+			slog.Int("benchmark", b.ID),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	err = writePGO(p)
+	if err != nil {
+		slog.Error("failed to write pgo file",
+			slog.String("file", pgoFile),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+}
@@ -0,0 +1,64 @@
+package profiler
+
+import (
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestCPUProfileCollectorFinish(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		description string
+		sampleEnd   bool
+		expected    map[string]int64
+	}{
+		{
+			description: "sampled at end",
+			sampleEnd:   true,
+			// Endより後のチャンクは含めない
+			expected: map[string]int64{"before": 100, "after": 0},
+		},
+		{
+			description: "not sampled",
+			sampleEnd:   false,
+			expected:    map[string]int64{"before": 100, "after": 200},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			c := &cpuProfileCollector{
+				sampled: -1,
+				cut:     make(chan chan struct{}),
+				stop:    make(chan struct{}),
+				done:    make(chan struct{}),
+			}
+			close(c.done)
+
+			c.chunks = []*profile.Profile{newFixtureProfile(map[string]int64{"before;main": 100})}
+			if test.sampleEnd {
+				c.sampleEnd()
+			}
+			c.chunks = append(c.chunks, newFixtureProfile(map[string]int64{"after;main": 200}))
+
+			// 終了フックから複数回呼ばれても同じプロファイルを返す
+			for range 2 {
+				p, err := c.finish()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				stats, _ := functionStats(p, 1)
+				for name, expected := range test.expected {
+					if actual := stats[name].flat; actual != expected {
+						t.Errorf("%s: expected %d, got %d", name, expected, actual)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package profiler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/cluster"
+	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+)
+
+/*
+	複数回のベンチマーク・複数ホストのCPUプロファイルをマージしてPGO用のファイルを生成する
+	PGO_MERGE_RUNS: 各ホストの直近何回分のベンチマークをマージするか(デフォルトは1で、マージしない)
+	PGO_MERGE_WEIGHT: equal, score, recencyのいずれかで、各プロファイルの重み付けの方法
+	PGO_MERGE_HOSTS: trueの場合、ISUTOOLS_PEERSの各ホストのプロファイルもマージする
+*/
+
+const (
+	weightEqual   = "equal"
+	weightScore   = "score"
+	weightRecency = "recency"
+
+	// recencyDecay 1回前のベンチマークごとに重みをこの割合にする
+	recencyDecay = 0.5
+	peerTimeout  = 10 * time.Second
+)
+
+var (
+	mergeRuns   = 1
+	mergeWeight = weightEqual
+	mergeHosts  = false
+	errNoSource = errors.New("no profile to merge")
+)
+
+func setupPGOMerge() {
+	strRuns, ok := os.LookupEnv("PGO_MERGE_RUNS")
+	if ok {
+		runs, err := strconv.Atoi(strRuns)
+		if err != nil || runs < 1 {
+			slog.Error("invalid PGO_MERGE_RUNS",
+				slog.String("PGO_MERGE_RUNS", strRuns),
+			)
+		} else {
+			mergeRuns = runs
+		}
+	}
+
+	weight, ok := os.LookupEnv("PGO_MERGE_WEIGHT")
+	if ok {
+		switch weight {
+		case weightEqual, weightScore, weightRecency:
+			mergeWeight = weight
+		default:
+			slog.Error("invalid PGO_MERGE_WEIGHT",
+				slog.String("PGO_MERGE_WEIGHT", weight),
+			)
+		}
+	}
+
+	strHosts, ok := os.LookupEnv("PGO_MERGE_HOSTS")
+	if ok {
+		hosts, err := strconv.ParseBool(strings.TrimSpace(strHosts))
+		if err != nil {
+			slog.Error("failed to parse PGO_MERGE_HOSTS",
+				slog.String("PGO_MERGE_HOSTS", strHosts),
+				slog.String("error", err.Error()),
+			)
+		} else {
+			mergeHosts = hosts
+		}
+	}
+}
+
+// pgoSource マージ対象のベンチマーク1回分のCPUプロファイル
+type pgoSource struct {
+	host    string
+	id      int
+	score   int64
+	end     time.Time
+	profile *profile.Profile
+}
+
+/*
+mergePGO 各ホストの直近runs回分のプロファイルを重み付けしてマージする
+走行時間の違いで長いベンチマークのプロファイルが支配的にならないよう、
+合計値を揃えてから重みを掛ける
+*/
+func mergePGO(sources []pgoSource, runs int, weight string) (*profile.Profile, error) {
+	byHost := map[string][]pgoSource{}
+	for _, src := range sources {
+		byHost[src.host] = append(byHost[src.host], src)
+	}
+
+	type weighted struct {
+		src    pgoSource
+		weight float64
+	}
+	var selected []weighted
+	for _, hostSources := range byHost {
+		slices.SortFunc(hostSources, func(a, b pgoSource) int {
+			return b.end.Compare(a.end)
+		})
+
+		for i, src := range hostSources[:min(runs, len(hostSources))] {
+			w := 1.0
+			switch weight {
+			case weightScore:
+				if src.score <= 0 {
+					continue
+				}
+				w = float64(src.score)
+			case weightRecency:
+				w = math.Pow(recencyDecay, float64(i))
+			}
+
+			selected = append(selected, weighted{src: src, weight: w})
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errNoSource
+	}
+
+	var (
+		maxWeight float64
+		meanTotal float64
+		totals    = make([]float64, len(selected))
+	)
+	for i, s := range selected {
+		maxWeight = max(maxWeight, s.weight)
+
+		index := len(s.src.profile.SampleType) - 1
+		for _, sample := range s.src.profile.Sample {
+			totals[i] += float64(sample.Value[index])
+		}
+		meanTotal += totals[i] / float64(len(selected))
+	}
+
+	profiles := make([]*profile.Profile, 0, len(selected))
+	for i, s := range selected {
+		if totals[i] == 0 {
+			continue
+		}
+
+		p := s.src.profile.Copy()
+		p.Scale(s.weight / maxWeight * meanTotal / totals[i])
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 0 {
+		return nil, errNoSource
+	}
+
+	merged, err := profile.Merge(profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge profiles: %w", err)
+	}
+
+	return merged, nil
+}
+
+// updatePGO ベンチマーク終了時に、設定に従ってPGO用のファイルを更新する
+func updatePGO(ctx context.Context, b *benchmark.Benchmark, cpu *profile.Profile) error {
+	if mergeRuns <= 1 && !mergeHosts {
+		return writePGO(cpu)
+	}
+
+	host := config.Host
+	if host == "" {
+		host = "self"
+	}
+
+	sources := localPGOSources(host, b, cpu)
+	if mergeHosts {
+		for _, peer := range cluster.Peers() {
+			peerSources, err := fetchPeerPGOSources(ctx, peer, mergeRuns)
+			if err != nil {
+				slog.Error("failed to fetch profiles from peer",
+					slog.String("peer", peer.Name),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+
+			sources = append(sources, peerSources...)
+		}
+	}
+
+	merged, err := mergePGO(sources, mergeRuns, mergeWeight)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("merged pgo profiles",
+		slog.Int("sources", len(sources)),
+		slog.Int("runs", mergeRuns),
+		slog.String("weight", mergeWeight),
+	)
+
+	return writePGO(merged)
+}
+
+// localPGOSources 保存済みのプロファイルと、終了したばかりのベンチマークのプロファイル
+// 終了時のフックは履歴への保存より前に呼ばれるため、bは別で追加する
+func localPGOSources(host string, b *benchmark.Benchmark, cpu *profile.Profile) []pgoSource {
+	sources := []pgoSource{{
+		host:    host,
+		id:      b.ID,
+		score:   b.Score,
+		end:     b.End,
+		profile: cpu,
+	}}
+
+	history := benchmark.History()
+	slices.SortFunc(history, func(a, b *benchmark.Benchmark) int {
+		return b.End.Compare(a.End)
+	})
+	for _, h := range history {
+		if len(sources) >= mergeRuns {
+			break
+		}
+		if h.ID == b.ID {
+			continue
+		}
+
+		p, err := loadProfile(h.ID, ProfileCPU)
+		if errors.Is(err, errNoProfile) {
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to load profile",
+				slog.Int("benchmark", h.ID),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		score := h.Score
+		if h.Unscored {
+			score = 0
+		}
+
+		sources = append(sources, pgoSource{
+			host:    host,
+			id:      h.ID,
+			score:   score,
+			end:     h.End,
+			profile: p,
+		})
+	}
+
+	return sources
+}
+
+func fetchPeerPGOSources(ctx context.Context, peer cluster.Peer, runs int) ([]pgoSource, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+
+	body, err := getPeer(ctx, peer.URL+"/profiles")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var infos []runInfo
+	err = json.NewDecoder(body).Decode(&infos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode profile list: %w", err)
+	}
+
+	infos = slices.DeleteFunc(infos, func(info runInfo) bool {
+		return !slices.Contains(info.Types, ProfileCPU)
+	})
+	slices.SortFunc(infos, func(a, b runInfo) int {
+		return b.End.Compare(a.End)
+	})
+
+	sources := make([]pgoSource, 0, runs)
+	for _, info := range infos[:min(runs, len(infos))] {
+		p, err := func() (*profile.Profile, error) {
+			body, err := getPeer(ctx, fmt.Sprintf("%s/profiles/%d/%s", peer.URL, info.ID, ProfileCPU))
+			if err != nil {
+				return nil, err
+			}
+			defer body.Close()
+
+			return profile.Parse(body)
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch profile of run %d: %w", info.ID, err)
+		}
+
+		score := info.Score
+		if info.Unscored {
+			score = 0
+		}
+
+		sources = append(sources, pgoSource{
+			host:    peer.Name,
+			id:      info.ID,
+			score:   score,
+			end:     info.End,
+			profile: p,
+		})
+	}
+
+	return sources, nil
+}
+
+func getPeer(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	admin.Authorize(req)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	return res.Body, nil
+}
+
+// pgoRollbackHandler 指定したベンチマークのマージ前のプロファイルをPGO用のファイルに書き戻す
+func pgoRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	strRun := r.FormValue("run")
+	id, err := strconv.Atoi(strRun)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid run(%s): %s", strRun, err), http.StatusBadRequest)
+		return
+	}
+
+	p, err := loadProfile(id, ProfileCPU)
+	if errors.Is(err, errNoProfile) {
+		http.Error(w, fmt.Sprintf("cpu profile of run %d not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load profile: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = writePGO(p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to write pgo file: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pgoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="default.pgo"`)
+	http.ServeFile(w, r, pgoFile)
+}
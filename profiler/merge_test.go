@@ -0,0 +1,73 @@
+package profiler
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMergePGO(t *testing.T) {
+	t.Parallel()
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sources := []pgoSource{
+		{host: "isu1", id: 1, score: 10, end: base.Add(1 * time.Minute), profile: newFixtureProfile(map[string]int64{"a1;main": 100})},
+		{host: "isu1", id: 2, score: 50, end: base.Add(2 * time.Minute), profile: newFixtureProfile(map[string]int64{"a2;main": 200})},
+		{host: "isu1", id: 3, score: 100, end: base.Add(3 * time.Minute), profile: newFixtureProfile(map[string]int64{"a3;main": 400})},
+		{host: "isu2", id: 1, score: 0, end: base.Add(1 * time.Minute), profile: newFixtureProfile(map[string]int64{"b1;main": 100})},
+	}
+
+	tests := []struct {
+		description string
+		weight      string
+		expected    map[string]float64
+	}{
+		{
+			description: "equal",
+			weight:      weightEqual,
+			// 合計値の平均(700/3)に揃える
+			expected: map[string]float64{"a1": 0, "a2": 700.0 / 3, "a3": 700.0 / 3, "b1": 700.0 / 3},
+		},
+		{
+			description: "recency",
+			weight:      weightRecency,
+			expected:    map[string]float64{"a1": 0, "a2": 700.0 / 6, "a3": 700.0 / 3, "b1": 700.0 / 3},
+		},
+		{
+			description: "score",
+			weight:      weightScore,
+			// スコアのない実行は除外する
+			expected: map[string]float64{"a1": 0, "a2": 150, "a3": 300, "b1": 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			merged, err := mergePGO(sources, 2, test.weight)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, _ := functionStats(merged, 1)
+			for name, expected := range test.expected {
+				actual := float64(stats[name].flat)
+				if math.Abs(actual-expected) > 1 {
+					t.Errorf("%s: expected %f, got %f", name, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestMergePGONoSource(t *testing.T) {
+	t.Parallel()
+
+	_, err := mergePGO([]pgoSource{
+		{host: "isu1", id: 1, score: 0, profile: newFixtureProfile(map[string]int64{"a;main": 100})},
+	}, 1, weightScore)
+	if err == nil {
+		t.Error("expected error when no scored profile exists")
+	}
+}
@@ -0,0 +1,89 @@
+package profiler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/pprof/profile"
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+)
+
+/*
+	ベンチマーク中のCPUプロファイルからPGO用のファイルを生成する
+	終了時のフックで書き込まれるので、DownloadPGO, LocalPGOを登録する必要はない
+	PGO_FILE: 出力先(デフォルトdefault.pgo)
+	PGO_MODE: pyroscope(デフォルト、Pyroscopeサーバーから取得), local(プロセス内で取得)
+*/
+
+const (
+	// pgoModePyroscope Pyroscopeサーバーからベンチマーク中のプロファイルを取得する
+	pgoModePyroscope = "pyroscope"
+	// pgoModeLocal プロセス内でCPUプロファイルを取得する
+	pgoModeLocal = "local"
+)
+
+var (
+	pgoFile string
+	pgoMode string
+)
+
+func setupPGO() error {
+	var ok bool
+	pgoFile, ok = os.LookupEnv("PGO_FILE")
+	if !ok {
+		pgoFile = "default.pgo"
+	}
+
+	pgoMode, ok = os.LookupEnv("PGO_MODE")
+	if !ok {
+		pgoMode = pgoModePyroscope
+	}
+
+	switch pgoMode {
+	case pgoModePyroscope:
+		return setupPyroscope()
+	case pgoModeLocal:
+		return nil
+	default:
+		return fmt.Errorf("unknown PGO_MODE: %s", pgoMode)
+	}
+}
+
+// cpuProfile PGO_MODEに応じて、ベンチマーク中のCPUプロファイルを取得する
+func cpuProfile(ctx context.Context, b *benchmark.Benchmark) (*profile.Profile, error) {
+	switch pgoMode {
+	case pgoModeLocal:
+		return finishCPUProfile(b.ID)
+	default:
+		return fetchPyroscopeProfile(ctx, b)
+	}
+}
+
+// writePGO 書き込み途中のファイルをビルドで読まないよう、一時ファイルに書き込んでからrenameする
+func writePGO(p *profile.Profile) error {
+	f, err := os.CreateTemp(filepath.Dir(pgoFile), filepath.Base(pgoFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary pgo file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = p.Write(f)
+	if err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close pgo file: %w", err)
+	}
+
+	err = os.Rename(f.Name(), pgoFile)
+	if err != nil {
+		return fmt.Errorf("failed to rename pgo file: %w", err)
+	}
+
+	return nil
+}
@@ -8,11 +8,19 @@ import (
 	"strconv"
 
 	"github.com/felixge/fgprof"
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func init() {
+	err := setupGCTuner()
+	if err != nil {
+		slog.Error("failed to setup gc tuner",
+			slog.String("error", err.Error()),
+		)
+	}
+
 	if !config.Enable {
 		return
 	}
@@ -43,9 +51,21 @@ func init() {
 		}
 	}
 
-	err := setupPyroscope()
+	err = setupPGO()
+	if err != nil {
+		slog.Error("failed to setup pgo",
+			slog.String("error", err.Error()),
+		)
+	}
+
+	setupProfileSnapshot()
+	setupPGOMerge()
+	setupGoroutineWatch()
+	setupRuntimeMetrics()
+
+	err = setupFlightRecorder()
 	if err != nil {
-		slog.Error("failed to setup pyroscope",
+		slog.Error("failed to setup flight recorder",
 			slog.String("error", err.Error()),
 		)
 	}
@@ -54,4 +74,16 @@ func init() {
 func Register(mux *http.ServeMux) {
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.Handle("/debug/fgprof", fgprof.Handler())
+	mux.HandleFunc("GET /profiles", profileListHandler)
+	mux.HandleFunc("GET /profiles/{run}/{type}", profileHandler)
+	mux.HandleFunc("GET /profiles/diff", profileDiffHandler)
+	mux.HandleFunc("GET /pgo", pgoHandler)
+	mux.HandleFunc("POST /pgo/rollback", pgoRollbackHandler)
+	mux.HandleFunc("GET /debug/traces", traceListHandler)
+	mux.HandleFunc("GET /debug/traces/{name}", traceHandler)
+	mux.HandleFunc("GET /debug/goroutines", goroutineHandler)
+	mux.HandleFunc("GET /gctuner", gcTunerHandler)
+
+	// ディスク上のdefault.pgoを書き換えるため、read-onlyモードでは無効化する
+	admin.MarkUnsafe("POST /pgo/rollback")
 }
@@ -1,18 +1,22 @@
 package profiler
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"connectrpc.com/connect"
+	"github.com/google/pprof/profile"
 	"github.com/grafana/pyroscope-go"
 	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
 	"github.com/grafana/pyroscope/api/gen/proto/go/querier/v1/querierv1connect"
@@ -21,11 +25,41 @@ import (
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 )
 
+/*
+	PYROSCOPE_SERVER: PyroscopeサーバーのURL
+	PYROSCOPE_APP_NAME: アプリケーション名(デフォルトisucon.go.app)
+	PYROSCOPE_PROFILE_TYPES: 取得するプロファイルの種類(例: cpu,alloc_space,inuse_space)、デフォルトは全て
+	PYROSCOPE_UPLOAD_RATE: アップロード間隔(デフォルト15s)
+	PYROSCOPE_TAGS: 追加する静的なタグ(例: team=isu,branch=main)
+	PGO_SELECT_RUN: trueの場合、時間範囲に加えてrun_idタグでベンチマーク中のプロファイルを選択する(デフォルトfalse)
+*/
+
+const defaultApplicationName = "isucon.go.app"
+
 var (
 	serverAddr  string
-	pgoFile     string
 	profileType string
 	query       string
+	// selectRun ミドルウェアが付けるrun_idタグでベンチマーク1回分のプロファイルを選択する
+	// run_idはリクエストの処理中にのみ付くため、バックグラウンドのgoroutineのプロファイルは含まれない
+	selectRun = false
+
+	pyroscopeLocker   = &sync.Mutex{}
+	pyroscopeConfig   pyroscope.Config
+	pyroscopeProfiler *pyroscope.Profiler
+
+	pyroscopeProfileTypes = []pyroscope.ProfileType{
+		pyroscope.ProfileCPU,
+		pyroscope.ProfileAllocObjects,
+		pyroscope.ProfileAllocSpace,
+		pyroscope.ProfileInuseObjects,
+		pyroscope.ProfileInuseSpace,
+		pyroscope.ProfileGoroutines,
+		pyroscope.ProfileMutexCount,
+		pyroscope.ProfileMutexDuration,
+		pyroscope.ProfileBlockCount,
+		pyroscope.ProfileBlockDuration,
+	}
 )
 
 func setupPyroscope() error {
@@ -35,9 +69,9 @@ func setupPyroscope() error {
 		serverAddr = "http://0.0.0.0:4040"
 	}
 
-	pgoFile, ok = os.LookupEnv("PGO_FILE")
-	if !ok {
-		pgoFile = "default.pgo"
+	cfg, err := loadPyroscopeConfig()
+	if err != nil {
+		return err
 	}
 
 	profileType, ok = os.LookupEnv("PGO_PROFILE_TYPE")
@@ -47,50 +81,166 @@ func setupPyroscope() error {
 
 	query, ok = os.LookupEnv("PGO_QUERY")
 	if !ok {
-		query = "{}"
+		query = fmt.Sprintf(`{service_name=%q}`, cfg.ApplicationName)
+	}
+
+	strSelectRun, ok := os.LookupEnv("PGO_SELECT_RUN")
+	if ok {
+		selectRun, err = strconv.ParseBool(strSelectRun)
+		if err != nil {
+			return fmt.Errorf("failed to parse PGO_SELECT_RUN(%s): %w", strSelectRun, err)
+		}
 	}
 
-	err := pyroscopeStart()
+	err = pyroscopeStart(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to start pyroscope: %w", err)
 	}
 
-	benchmark.SetEndHook(DownloadPGO)
-
 	return nil
 }
 
-func pyroscopeStart() error {
-	tagMap := map[string]string{}
+func loadPyroscopeConfig() (pyroscope.Config, error) {
+	cfg := pyroscope.Config{
+		ApplicationName: defaultApplicationName,
+		ServerAddress:   serverAddr,
+		Logger:          slogLogger{},
+		Tags:            map[string]string{},
+		ProfileTypes:    pyroscopeProfileTypes,
+	}
 	if config.Host != "" {
-		tagMap["hostname"] = config.Host
+		cfg.Tags["hostname"] = config.Host
 	}
 
-	_, err := pyroscope.Start(pyroscope.Config{
-		ApplicationName: "isucon.go.app",
-		ServerAddress:   serverAddr,
-		Logger:          slogLogger{},
-		Tags:            tagMap,
-		ProfileTypes: []pyroscope.ProfileType{
-			pyroscope.ProfileCPU,
-			pyroscope.ProfileAllocObjects,
-			pyroscope.ProfileAllocSpace,
-			pyroscope.ProfileInuseObjects,
-			pyroscope.ProfileInuseSpace,
-			pyroscope.ProfileGoroutines,
-			pyroscope.ProfileMutexCount,
-			pyroscope.ProfileMutexDuration,
-			pyroscope.ProfileBlockCount,
-			pyroscope.ProfileBlockDuration,
-		},
-	})
+	appName, ok := os.LookupEnv("PYROSCOPE_APP_NAME")
+	if ok {
+		cfg.ApplicationName = appName
+	}
+
+	strTypes, ok := os.LookupEnv("PYROSCOPE_PROFILE_TYPES")
+	if ok {
+		types, err := parseProfileTypes(strTypes)
+		if err != nil {
+			return pyroscope.Config{}, fmt.Errorf("invalid PYROSCOPE_PROFILE_TYPES(%s): %w", strTypes, err)
+		}
+		cfg.ProfileTypes = types
+	}
+
+	strRate, ok := os.LookupEnv("PYROSCOPE_UPLOAD_RATE")
+	if ok {
+		rate, err := time.ParseDuration(strRate)
+		if err != nil {
+			return pyroscope.Config{}, fmt.Errorf("failed to parse PYROSCOPE_UPLOAD_RATE(%s): %w", strRate, err)
+		}
+		cfg.UploadRate = rate
+	}
+
+	strTags, ok := os.LookupEnv("PYROSCOPE_TAGS")
+	if ok {
+		tags, err := parseTags(strTags)
+		if err != nil {
+			return pyroscope.Config{}, fmt.Errorf("invalid PYROSCOPE_TAGS(%s): %w", strTags, err)
+		}
+		maps.Copy(cfg.Tags, tags)
+	}
+
+	return cfg, nil
+}
+
+func parseProfileTypes(s string) ([]pyroscope.ProfileType, error) {
+	types := []pyroscope.ProfileType{}
+	for name := range strings.SplitSeq(s, ",") {
+		typ := pyroscope.ProfileType(strings.TrimSpace(name))
+		if typ == "" {
+			continue
+		}
+
+		if !slices.Contains(pyroscopeProfileTypes, typ) {
+			return nil, fmt.Errorf("unknown profile type: %s", typ)
+		}
+		types = append(types, typ)
+	}
+
+	if len(types) == 0 {
+		return nil, errors.New("no profile type")
+	}
+
+	return types, nil
+}
+
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for tag := range strings.SplitSeq(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("tag must be key=value: %s", tag)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return tags, nil
+}
+
+func pyroscopeStart(cfg pyroscope.Config) error {
+	pyroscopeLocker.Lock()
+	defer pyroscopeLocker.Unlock()
+
+	if pyroscopeProfiler != nil {
+		err := pyroscopeProfiler.Stop()
+		if err != nil {
+			return fmt.Errorf("failed to stop pyroscope: %w", err)
+		}
+		pyroscopeProfiler = nil
+	}
+
+	p, err := pyroscope.Start(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to start pyroscope: %w", err)
 	}
 
+	pyroscopeConfig = cfg
+	pyroscopeProfiler = p
+
 	return nil
 }
 
+// ConfigurePyroscope Pyroscopeの設定を変更して再起動する
+// 環境変数で設定した値を元にfで変更する
+func ConfigurePyroscope(f func(cfg *pyroscope.Config)) error {
+	pyroscopeLocker.Lock()
+	if pyroscopeProfiler == nil {
+		pyroscopeLocker.Unlock()
+		return errors.New("pyroscope is not started (PGO_MODE is not pyroscope or ISUTOOLS_ENABLE is false)")
+	}
+
+	cfg := pyroscopeConfig
+	cfg.Tags = maps.Clone(pyroscopeConfig.Tags)
+	cfg.ProfileTypes = slices.Clone(pyroscopeConfig.ProfileTypes)
+	pyroscopeLocker.Unlock()
+
+	f(&cfg)
+
+	return pyroscopeStart(cfg)
+}
+
+// runSelector PGO_QUERYのラベルセレクタにrun_idの条件を追加する
+func runSelector(selector string, id int) string {
+	matcher := fmt.Sprintf(`run_id="%d"`, id)
+
+	selector = strings.TrimSpace(selector)
+	inner, ok := strings.CutSuffix(strings.TrimPrefix(selector, "{"), "}")
+	if !ok || strings.TrimSpace(inner) == "" {
+		return "{" + matcher + "}"
+	}
+
+	return "{" + strings.TrimSpace(inner) + "," + matcher + "}"
+}
+
 type slogLogger struct{}
 
 func (slogLogger) Infof(format string, args ...any) {
@@ -150,7 +300,36 @@ func (slogLogger) Errorf(format string, args ...any) {
 	}
 }
 
+// DownloadPGO ベンチマーク中のプロファイルをPyroscopeサーバーから取得し、PGO用のファイルを生成する
+//
+// Deprecated: 終了時のフックでPGO用のファイルが書き込まれるため、登録する必要はない
+// PGO_MERGE_RUNS, PGO_MERGE_HOSTSを設定している場合、登録するとマージしたファイルが直前の1回分で上書きされる
 func DownloadPGO(ctx context.Context, b *benchmark.Benchmark) {
+	p, err := fetchPyroscopeProfile(ctx, b)
+	if err != nil {
+		slog.Error("failed to fetch profile from pyroscope",
+			slog.Group("benchmark",
+				slog.Time("start", b.Start),
+				slog.Time("end", b.End),
+				slog.Int64("score", b.Score),
+			),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	err = writePGO(p)
+	if err != nil {
+		slog.Error("failed to write pgo file",
+			slog.String("file", pgoFile),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+}
+
+// fetchPyroscopeProfile ベンチマーク中のプロファイルをPyroscopeサーバーから取得する
+func fetchPyroscopeProfile(ctx context.Context, b *benchmark.Benchmark) (*profile.Profile, error) {
 	client := querierv1connect.NewQuerierServiceClient(
 		http.DefaultClient,
 		serverAddr,
@@ -160,49 +339,30 @@ func DownloadPGO(ctx context.Context, b *benchmark.Benchmark) {
 		)...,
 	)
 
+	labelSelector := query
+	if selectRun {
+		labelSelector = runSelector(query, b.ID)
+	}
+
 	res, err := client.SelectMergeProfile(ctx, connect.NewRequest(&querierv1.SelectMergeProfileRequest{
 		ProfileTypeID: profileType,
 		Start:         b.Start.UnixMilli(),
 		End:           b.End.UnixMilli(),
-		LabelSelector: query,
+		LabelSelector: labelSelector,
 	}))
 	if err != nil {
-		slog.Error("failed to select merge span profile",
-			slog.Group("benchmark",
-				slog.Time("start", b.Start),
-				slog.Time("end", b.End),
-				slog.Int64("score", b.Score),
-			),
-			slog.String("error", err.Error()),
-		)
-		return
+		return nil, fmt.Errorf("failed to select merge profile: %w", err)
 	}
 
 	buf, err := res.Msg.MarshalVT()
 	if err != nil {
-		slog.Error("failed to marshal vt",
-			slog.String("error", err.Error()),
-		)
-		return
+		return nil, fmt.Errorf("failed to marshal vt: %w", err)
 	}
 
-	f, err := os.Create(pgoFile)
+	p, err := profile.ParseData(buf)
 	if err != nil {
-		slog.Error("failed to create pgo file",
-			slog.String("file", pgoFile),
-			slog.String("error", err.Error()),
-		)
-		return
+		return nil, fmt.Errorf("failed to parse profile: %w", err)
 	}
-	defer f.Close()
 
-	gzipWriter := gzip.NewWriter(f)
-	defer gzipWriter.Close()
-
-	if _, err := io.Copy(gzipWriter, bytes.NewReader(buf)); err != nil {
-		slog.Error("failed to copy buffer",
-			slog.String("error", err.Error()),
-		)
-		return
-	}
+	return p, nil
 }
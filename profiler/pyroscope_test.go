@@ -0,0 +1,69 @@
+package profiler
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestRunSelector(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		selector string
+		expected string
+	}{
+		{selector: "{}", expected: `{run_id="3"}`},
+		{selector: "", expected: `{run_id="3"}`},
+		{selector: `{service_name="isucon.go.app"}`, expected: `{service_name="isucon.go.app",run_id="3"}`},
+		{selector: ` {hostname="isu1", service_name="app"} `, expected: `{hostname="isu1", service_name="app",run_id="3"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			t.Parallel()
+
+			actual := runSelector(test.selector, 3)
+			if actual != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	t.Parallel()
+
+	tags, err := parseTags("team=isu, branch = main,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"team": "isu", "branch": "main"}
+	if !maps.Equal(tags, expected) {
+		t.Errorf("expected %v, got %v", expected, tags)
+	}
+
+	_, err = parseTags("team")
+	if err == nil {
+		t.Error("expected error for tag without value")
+	}
+}
+
+func TestParseProfileTypes(t *testing.T) {
+	t.Parallel()
+
+	types, err := parseProfileTypes("cpu, inuse_space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0] != "cpu" || types[1] != "inuse_space" {
+		t.Errorf("unexpected profile types: %v", types)
+	}
+
+	for _, s := range []string{"cpu,unknown", ""} {
+		_, err := parseProfileTypes(s)
+		if err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
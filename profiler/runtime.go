@@ -0,0 +1,283 @@
+package profiler
+
+import (
+	"context"
+	"math"
+	"runtime/metrics"
+	"sync"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricGCPauses     = "/sched/pauses/total/gc:seconds"
+	metricSchedLatency = "/sched/latencies:seconds"
+	metricMutexWait    = "/sync/mutex/wait/total:seconds"
+	metricHeapGoal     = "/gc/heap/goal:bytes"
+	metricMemoryLimit  = "/gc/gomemlimit:bytes"
+	metricGOGC         = "/gc/gogc:percent"
+	metricGCCycles     = "/gc/cycles/total:gc-cycles"
+	metricGCCPU        = "/cpu/classes/gc/total:cpu-seconds"
+	metricTotalCPU     = "/cpu/classes/total:cpu-seconds"
+	metricTotalMemory  = "/memory/classes/total:bytes"
+)
+
+// runtimeBuckets runtime/metricsのヒストグラムはバケット数が多いため、この境界にまとめて出力する
+var runtimeBuckets = prometheus.ExponentialBuckets(1e-6, 4, 11)
+
+var (
+	runtimeMetricNames = []string{
+		metricGCPauses,
+		metricSchedLatency,
+		metricMutexWait,
+		metricHeapGoal,
+		metricMemoryLimit,
+		metricGOGC,
+		metricGCCycles,
+		metricGCCPU,
+		metricTotalCPU,
+		metricTotalMemory,
+	}
+	runtimeBaseLocker = &sync.Mutex{}
+	runtimeBase       map[string]metrics.Value
+	// runtimeEnd ベンチマークのEndの時点の値
+	runtimeEnd map[string]metrics.Value
+)
+
+func setupRuntimeMetrics() {
+	prometheus.MustRegister(newRuntimeCollector())
+
+	benchmark.SetStartHook(startGCSummary)
+	benchmark.SetEndSampler(sampleGCSummary)
+	benchmark.SetEndHook(finishGCSummary)
+}
+
+// readRuntimeMetrics 対応していないメトリクスはKindBadのまま返す
+func readRuntimeMetrics() map[string]metrics.Value {
+	samples := make([]metrics.Sample, 0, len(runtimeMetricNames))
+	for _, name := range runtimeMetricNames {
+		samples = append(samples, metrics.Sample{Name: name})
+	}
+	metrics.Read(samples)
+
+	values := make(map[string]metrics.Value, len(samples))
+	for _, sample := range samples {
+		values[sample.Name] = sample.Value
+	}
+
+	return values
+}
+
+type runtimeCollector struct {
+	gcPauseDesc      *prometheus.Desc
+	schedLatencyDesc *prometheus.Desc
+	mutexWaitDesc    *prometheus.Desc
+	heapGoalDesc     *prometheus.Desc
+	memoryLimitDesc  *prometheus.Desc
+	gogcDesc         *prometheus.Desc
+}
+
+func newRuntimeCollector() runtimeCollector {
+	return runtimeCollector{
+		gcPauseDesc: prometheus.NewDesc(
+			"isutools_runtime_gc_pause_seconds",
+			"distribution of stop-the-world pauses caused by the garbage collector",
+			nil, nil,
+		),
+		schedLatencyDesc: prometheus.NewDesc(
+			"isutools_runtime_sched_latency_seconds",
+			"distribution of the time goroutines have spent in the scheduler in a runnable state",
+			nil, nil,
+		),
+		mutexWaitDesc: prometheus.NewDesc(
+			"isutools_runtime_mutex_wait_seconds_total",
+			"approximate cumulative time goroutines have spent blocked on a sync.Mutex or sync.RWMutex",
+			nil, nil,
+		),
+		heapGoalDesc: prometheus.NewDesc(
+			"isutools_runtime_heap_goal_bytes",
+			"heap size target for the end of the GC cycle",
+			nil, nil,
+		),
+		memoryLimitDesc: prometheus.NewDesc(
+			"isutools_runtime_memory_limit_bytes",
+			"Go runtime memory limit configured by GOMEMLIMIT or debug.SetMemoryLimit",
+			nil, nil,
+		),
+		gogcDesc: prometheus.NewDesc(
+			"isutools_runtime_gogc_percent",
+			"heap size target percentage configured by GOGC or debug.SetGCPercent",
+			nil, nil,
+		),
+	}
+}
+
+func (c runtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.gcPauseDesc
+	ch <- c.schedLatencyDesc
+	ch <- c.mutexWaitDesc
+	ch <- c.heapGoalDesc
+	ch <- c.memoryLimitDesc
+	ch <- c.gogcDesc
+}
+
+func (c runtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	values := readRuntimeMetrics()
+
+	for desc, name := range map[*prometheus.Desc]string{
+		c.gcPauseDesc:      metricGCPauses,
+		c.schedLatencyDesc: metricSchedLatency,
+	} {
+		if values[name].Kind() != metrics.KindFloat64Histogram {
+			continue
+		}
+
+		count, sum, buckets := convertHistogram(values[name].Float64Histogram(), runtimeBuckets)
+		ch <- prometheus.MustNewConstHistogram(desc, count, sum, buckets)
+	}
+
+	for desc, name := range map[*prometheus.Desc]string{
+		c.heapGoalDesc:    metricHeapGoal,
+		c.memoryLimitDesc: metricMemoryLimit,
+		c.gogcDesc:        metricGOGC,
+	} {
+		if values[name].Kind() != metrics.KindUint64 {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(values[name].Uint64()))
+	}
+
+	if values[metricMutexWait].Kind() == metrics.KindFloat64 {
+		ch <- prometheus.MustNewConstMetric(c.mutexWaitDesc, prometheus.CounterValue, values[metricMutexWait].Float64())
+	}
+}
+
+// convertHistogram runtime/metricsのヒストグラムをboundsを上限とする累積のバケットに変換する
+// 合計値は記録されていないため、各バケットの中央値(上限が無限の場合は下限)で近似する
+func convertHistogram(h *metrics.Float64Histogram, bounds []float64) (uint64, float64, map[float64]uint64) {
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+
+	var (
+		count uint64
+		sum   float64
+	)
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+
+		lower, upper := h.Buckets[i], h.Buckets[i+1]
+		count += n
+		switch {
+		case math.IsInf(upper, 1):
+			sum += float64(n) * lower
+		case math.IsInf(lower, -1):
+			sum += float64(n) * upper
+		default:
+			sum += float64(n) * (lower + upper) / 2
+		}
+
+		for _, bound := range bounds {
+			if upper <= bound {
+				buckets[bound] += n
+			}
+		}
+	}
+
+	return count, sum, buckets
+}
+
+func startGCSummary(context.Context, *benchmark.Benchmark) {
+	runtimeBaseLocker.Lock()
+	defer runtimeBaseLocker.Unlock()
+
+	runtimeBase = readRuntimeMetrics()
+	runtimeEnd = nil
+}
+
+// sampleGCSummary 終了フックの処理が含まれないよう、Endの時点の値を取っておく
+func sampleGCSummary(context.Context, *benchmark.Benchmark) {
+	runtimeBaseLocker.Lock()
+	defer runtimeBaseLocker.Unlock()
+
+	if runtimeBase == nil {
+		return
+	}
+
+	runtimeEnd = readRuntimeMetrics()
+}
+
+func finishGCSummary(_ context.Context, b *benchmark.Benchmark) {
+	runtimeBaseLocker.Lock()
+	defer runtimeBaseLocker.Unlock()
+
+	if runtimeBase == nil || runtimeEnd == nil {
+		return
+	}
+
+	b.GC = gcSummary(runtimeBase, runtimeEnd)
+	runtimeBase = nil
+	runtimeEnd = nil
+}
+
+// gcSummary ベンチマーク開始時(base)から終了時(current)までのGCの状況をまとめる
+func gcSummary(base, current map[string]metrics.Value) *benchmark.GCSummary {
+	summary := &benchmark.GCSummary{}
+
+	if base[metricGCCycles].Kind() == metrics.KindUint64 && current[metricGCCycles].Kind() == metrics.KindUint64 {
+		summary.Cycles = current[metricGCCycles].Uint64() - base[metricGCCycles].Uint64()
+	}
+
+	if current[metricGCCPU].Kind() == metrics.KindFloat64 && current[metricTotalCPU].Kind() == metrics.KindFloat64 {
+		gcCPU := current[metricGCCPU].Float64()
+		totalCPU := current[metricTotalCPU].Float64()
+		if base[metricGCCPU].Kind() == metrics.KindFloat64 && base[metricTotalCPU].Kind() == metrics.KindFloat64 {
+			gcCPU -= base[metricGCCPU].Float64()
+			totalCPU -= base[metricTotalCPU].Float64()
+		}
+
+		if totalCPU > 0 {
+			summary.CPUFraction = gcCPU / totalCPU
+		}
+	}
+
+	if current[metricGCPauses].Kind() == metrics.KindFloat64Histogram {
+		h := current[metricGCPauses].Float64Histogram()
+
+		var baseCounts []uint64
+		if base[metricGCPauses].Kind() == metrics.KindFloat64Histogram {
+			baseCounts = base[metricGCPauses].Float64Histogram().Counts
+		}
+
+		// バケットの精度しかわからないため、停止時間が含まれる最大のバケットの上限を最大値とする
+		for i := len(h.Counts) - 1; i >= 0; i-- {
+			n := h.Counts[i]
+			if i < len(baseCounts) {
+				n -= baseCounts[i]
+			}
+			if n == 0 {
+				continue
+			}
+
+			summary.MaxPause = h.Buckets[i+1]
+			if math.IsInf(summary.MaxPause, 1) {
+				summary.MaxPause = h.Buckets[i]
+			}
+			break
+		}
+	}
+
+	if current[metricGOGC].Kind() == metrics.KindUint64 {
+		summary.GOGC = current[metricGOGC].Uint64()
+	}
+	if current[metricMemoryLimit].Kind() == metrics.KindUint64 {
+		summary.MemoryLimit = current[metricMemoryLimit].Uint64()
+	}
+
+	return summary
+}
@@ -0,0 +1,57 @@
+package profiler
+
+import (
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"testing"
+)
+
+func TestConvertHistogram(t *testing.T) {
+	t.Parallel()
+
+	h := &metrics.Float64Histogram{
+		Counts:  []uint64{1, 2, 0, 3},
+		Buckets: []float64{math.Inf(-1), 1, 2, 4, math.Inf(1)},
+	}
+
+	count, sum, buckets := convertHistogram(h, []float64{1, 3, 10})
+	if count != 6 {
+		t.Errorf("count: expected 6, got %d", count)
+	}
+	// 1*1 + 2*1.5 + 3*4
+	if sum != 16 {
+		t.Errorf("sum: expected 16, got %f", sum)
+	}
+
+	expected := map[float64]uint64{1: 1, 3: 3, 10: 3}
+	for bound, n := range expected {
+		if buckets[bound] != n {
+			t.Errorf("bucket %f: expected %d, got %d", bound, n, buckets[bound])
+		}
+	}
+}
+
+func TestGCSummary(t *testing.T) {
+	base := readRuntimeMetrics()
+	for _, name := range runtimeMetricNames {
+		if base[name].Kind() == metrics.KindBad {
+			t.Errorf("unsupported runtime metric: %s", name)
+		}
+	}
+
+	for range 3 {
+		runtime.GC()
+	}
+
+	summary := gcSummary(base, readRuntimeMetrics())
+	if summary.Cycles < 3 {
+		t.Errorf("cycles: expected at least 3, got %d", summary.Cycles)
+	}
+	if summary.MaxPause <= 0 {
+		t.Errorf("max pause: expected positive, got %f", summary.MaxPause)
+	}
+	if summary.CPUFraction < 0 || summary.CPUFraction > 1 {
+		t.Errorf("cpu fraction: expected in [0, 1], got %f", summary.CPUFraction)
+	}
+}
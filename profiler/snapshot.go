@@ -0,0 +1,393 @@
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+const (
+	ProfileCPU       = "cpu"
+	ProfileHeap      = "heap"
+	ProfileMutex     = "mutex"
+	ProfileBlock     = "block"
+	ProfileGoroutine = "goroutine"
+
+	profileExt = ".pb.gz"
+	// goroutineInterval goroutineの数を確認する間隔
+	// ベンチマーク終了時にはgoroutineが減っているため、走行中で最も多かった時点のプロファイルを残す
+	goroutineInterval = 5 * time.Second
+)
+
+var (
+	profileTypes = []string{ProfileCPU, ProfileHeap, ProfileMutex, ProfileBlock, ProfileGoroutine}
+	// cumulativeProfiles プロセス開始からの累積値なので、開始時点との差分を取る
+	cumulativeProfiles = map[string]string{
+		ProfileHeap:  "allocs",
+		ProfileMutex: "mutex",
+		ProfileBlock: "block",
+	}
+	profileDir     string
+	currentProfile = atomic.Pointer[runProfile]{}
+)
+
+// runProfile ベンチマーク1回分のプロファイルの取得状況
+type runProfile struct {
+	id     int
+	base   map[string]*profile.Profile
+	locker sync.Mutex
+	// end Endの時点で取得した累積プロファイルの差分
+	end            map[string]*profile.Profile
+	goroutine      *profile.Profile
+	goroutineCount int
+}
+
+func setupProfileSnapshot() {
+	var ok bool
+	profileDir, ok = os.LookupEnv("PROFILE_DIR")
+	if !ok {
+		profileDir = filepath.Join(filepath.Dir(benchmark.HistoryFile()), "profiles")
+	}
+
+	benchmark.SetStartHook(startProfiles)
+	benchmark.SetEndSampler(sampleProfiles)
+	benchmark.SetEndHook(finishProfiles)
+}
+
+func startProfiles(ctx context.Context, b *benchmark.Benchmark) {
+	if pgoMode == pgoModeLocal {
+		startCPUProfile(ctx, b)
+	}
+
+	rp := &runProfile{
+		id:   b.ID,
+		base: make(map[string]*profile.Profile, len(cumulativeProfiles)),
+	}
+	for typ, name := range cumulativeProfiles {
+		p, err := lookupProfile(name)
+		if err != nil {
+			slog.Error("failed to take base profile",
+				slog.String("type", typ),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		rp.base[typ] = p
+	}
+
+	// 以降はsetupGoroutineWatchの定期的なサンプリングに合わせて取得する
+	rp.sampleGoroutine(runtime.NumGoroutine())
+	currentProfile.Store(rp)
+}
+
+// sampleGoroutine これまでで最も多い場合のみgoroutineプロファイルを取得する
+func (rp *runProfile) sampleGoroutine(count int) {
+	rp.locker.Lock()
+	defer rp.locker.Unlock()
+
+	if rp.goroutine != nil && count <= rp.goroutineCount {
+		return
+	}
+
+	p, err := lookupProfile("goroutine")
+	if err != nil {
+		slog.Error("failed to take goroutine profile",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rp.goroutine = p
+	rp.goroutineCount = count
+}
+
+// sampleRunGoroutine ベンチマーク中の場合、そのベンチマークのgoroutineプロファイルを更新する
+func sampleRunGoroutine(count int) {
+	rp := currentProfile.Load()
+	if rp == nil {
+		return
+	}
+
+	rp.sampleGoroutine(count)
+}
+
+// sampleProfiles Endの時点で累積プロファイルの差分を取り、ローカルのCPUプロファイルを区切る
+// 終了フックはスコアの送信時などEndより後に呼ばれるため、そこで取得するとEnd以降の値が混ざる
+func sampleProfiles(_ context.Context, b *benchmark.Benchmark) {
+	if pgoMode == pgoModeLocal {
+		sampleCPUProfile(b.ID)
+	}
+
+	rp := currentProfile.Load()
+	if rp == nil || rp.id != b.ID {
+		return
+	}
+
+	deltas := make(map[string]*profile.Profile, len(rp.base))
+	for typ, name := range cumulativeProfiles {
+		base, ok := rp.base[typ]
+		if !ok {
+			continue
+		}
+
+		p, err := lookupProfile(name)
+		if err != nil {
+			slog.Error("failed to take profile",
+				slog.String("type", typ),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		delta, err := deltaProfile(base, p)
+		if err != nil {
+			slog.Error("failed to compute delta profile",
+				slog.String("type", typ),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		delta.DurationNanos = b.End.Sub(b.Start).Nanoseconds()
+
+		deltas[typ] = delta
+	}
+
+	rp.locker.Lock()
+	defer rp.locker.Unlock()
+
+	rp.end = deltas
+}
+
+// finishProfiles sampleProfilesでEndの時点に取得したプロファイルを保存する
+func finishProfiles(ctx context.Context, b *benchmark.Benchmark) {
+	profiles := map[string]*profile.Profile{}
+
+	cpu, err := cpuProfile(ctx, b)
+	if err != nil {
+		slog.Error("failed to get cpu profile",
+			slog.Int("benchmark", b.ID),
+			slog.String("mode", pgoMode),
+			slog.String("error", err.Error()),
+		)
+	} else {
+		profiles[ProfileCPU] = cpu
+	}
+
+	rp := currentProfile.Load()
+	if rp != nil && rp.id == b.ID && currentProfile.CompareAndSwap(rp, nil) {
+		rp.locker.Lock()
+		for typ, p := range rp.end {
+			profiles[typ] = p
+		}
+		if rp.goroutine != nil {
+			profiles[ProfileGoroutine] = rp.goroutine
+		}
+		rp.locker.Unlock()
+	}
+
+	for typ, p := range profiles {
+		err := saveProfile(b.ID, typ, p)
+		if err != nil {
+			slog.Error("failed to save profile",
+				slog.Int("benchmark", b.ID),
+				slog.String("type", typ),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	if cpu != nil {
+		err = updatePGO(ctx, b, cpu)
+		if err != nil {
+			slog.Error("failed to update pgo file",
+				slog.String("file", pgoFile),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+func lookupProfile(name string) (*profile.Profile, error) {
+	buf := &bytes.Buffer{}
+	err := pprof.Lookup(name).WriteTo(buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s profile: %w", name, err)
+	}
+
+	p, err := profile.Parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s profile: %w", name, err)
+	}
+
+	return p, nil
+}
+
+// deltaProfile net/http/pprofの?seconds=と同様に、baseを負にしてマージすることで差分を取る
+func deltaProfile(base, p *profile.Profile) (*profile.Profile, error) {
+	base = base.Copy()
+	base.Scale(-1)
+
+	delta, err := profile.Merge([]*profile.Profile{base, p})
+	if err != nil {
+		return nil, err
+	}
+	delta.TimeNanos = p.TimeNanos
+
+	return delta, nil
+}
+
+func runDir(id int) string {
+	return filepath.Join(profileDir, strconv.Itoa(id))
+}
+
+func profilePath(id int, typ string) string {
+	return filepath.Join(runDir(id), typ+profileExt)
+}
+
+func saveProfile(id int, typ string, p *profile.Profile) error {
+	err := os.MkdirAll(runDir(id), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create profile directory: %w", err)
+	}
+
+	f, err := os.Create(profilePath(id, typ))
+	if err != nil {
+		return fmt.Errorf("failed to create profile file: %w", err)
+	}
+	defer f.Close()
+
+	err = p.Write(f)
+	if err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+
+	return nil
+}
+
+// storedTypes 保存済みのプロファイルの種類
+func storedTypes(id int) []string {
+	types := []string{}
+	for _, typ := range profileTypes {
+		_, err := os.Stat(profilePath(id, typ))
+		if err == nil {
+			types = append(types, typ)
+		}
+	}
+
+	return types
+}
+
+type runInfo struct {
+	ID       int       `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Score    int64     `json:"score"`
+	Unscored bool      `json:"unscored,omitempty"`
+	Types    []string  `json:"types"`
+}
+
+func profileListHandler(w http.ResponseWriter, r *http.Request) {
+	infos := []runInfo{}
+	for _, b := range benchmark.History() {
+		types := storedTypes(b.ID)
+		if len(types) == 0 {
+			continue
+		}
+
+		infos = append(infos, runInfo{
+			ID:       b.ID,
+			Start:    b.Start,
+			End:      b.End,
+			Score:    b.Score,
+			Unscored: b.Unscored,
+			Types:    types,
+		})
+	}
+
+	response.JSON(w, infos)
+}
+
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("run"))
+	if err != nil {
+		http.Error(w, "invalid run", http.StatusBadRequest)
+		return
+	}
+
+	typ := r.PathValue("type")
+	if !slices.Contains(profileTypes, typ) {
+		http.Error(w, fmt.Sprintf("unknown profile type: %s", typ), http.StatusBadRequest)
+		return
+	}
+
+	method, route := r.URL.Query().Get("method"), r.URL.Query().Get("route")
+	if method != "" || route != "" {
+		filteredProfileHandler(w, id, typ, method, route)
+		return
+	}
+
+	f, err := os.Open(profilePath(id, typ))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("failed to open profile: %s", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to stat profile: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d-%s%s"`, id, typ, profileExt))
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
+
+// filteredProfileHandler ミドルウェアで付与したpprofのラベルで、特定のエンドポイントのサンプルのみに絞り込む
+func filteredProfileHandler(w http.ResponseWriter, id int, typ, method, route string) {
+	p, err := loadProfile(id, typ)
+	if errors.Is(err, errNoProfile) {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load profile: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	p.Sample = slices.DeleteFunc(p.Sample, func(s *profile.Sample) bool {
+		return (method != "" && !slices.Contains(s.Label["method"], method)) ||
+			(route != "" && !slices.Contains(s.Label["route"], route))
+	})
+	p = p.Compact()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d-%s%s"`, id, typ, profileExt))
+	err = p.Write(w)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to write profile: %s", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,288 @@
+package profiler
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/trace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/hooks"
+	"github.com/mazrean/isucon-go-tools/v2/internal/response"
+)
+
+/*
+	遅いリクエストの直前の実行トレースを保存する
+	TRACE_THRESHOLD: このレイテンシ以上のリクエストがあった場合にトレースを保存する(未設定の場合は無効)
+	TRACE_WINDOW: 保存するトレースの長さ(デフォルト5s)
+	TRACE_DIR: 保存先のディレクトリ
+	TRACE_MAX_FILES: 保存するトレースの最大数で、古いものから削除する(デフォルト20)
+*/
+
+const traceExt = ".trace"
+
+var (
+	flightRecorder *trace.FlightRecorder
+	traceDir       string
+	traceWindow    = 5 * time.Second
+	maxTraceFiles  = 20
+	// traceWriting FlightRecorder.WriteToは同時に1つしか実行できない
+	traceWriting = atomic.Bool{}
+	lastTrace    = atomic.Int64{}
+	traceLocker  = &sync.RWMutex{}
+	traceInfos   = map[string]TraceInfo{}
+	unsafeChars  = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+type TraceInfo struct {
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+	Method   string    `json:"method,omitempty"`
+	Route    string    `json:"route,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+}
+
+func setupFlightRecorder() error {
+	strThreshold, ok := os.LookupEnv("TRACE_THRESHOLD")
+	if !ok {
+		return nil
+	}
+
+	threshold, err := time.ParseDuration(strThreshold)
+	if err != nil {
+		return fmt.Errorf("failed to parse TRACE_THRESHOLD(%s): %w", strThreshold, err)
+	}
+
+	strWindow, ok := os.LookupEnv("TRACE_WINDOW")
+	if ok {
+		traceWindow, err = time.ParseDuration(strWindow)
+		if err != nil {
+			return fmt.Errorf("failed to parse TRACE_WINDOW(%s): %w", strWindow, err)
+		}
+	}
+
+	strMaxFiles, ok := os.LookupEnv("TRACE_MAX_FILES")
+	if ok {
+		maxTraceFiles, err = strconv.Atoi(strMaxFiles)
+		if err != nil {
+			return fmt.Errorf("failed to parse TRACE_MAX_FILES(%s): %w", strMaxFiles, err)
+		}
+		if maxTraceFiles <= 0 {
+			return fmt.Errorf("invalid TRACE_MAX_FILES(%s): must be positive", strMaxFiles)
+		}
+	}
+
+	traceDir, ok = os.LookupEnv("TRACE_DIR")
+	if !ok {
+		traceDir = filepath.Join(filepath.Dir(benchmark.HistoryFile()), "traces")
+	}
+
+	err = os.MkdirAll(traceDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create trace directory: %w", err)
+	}
+
+	flightRecorder = trace.NewFlightRecorder(trace.FlightRecorderConfig{
+		MinAge: traceWindow,
+	})
+	err = flightRecorder.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start flight recorder: %w", err)
+	}
+
+	hooks.SetSlowRequest(threshold, onSlowRequest)
+
+	return nil
+}
+
+// onSlowRequest 遅いリクエストが続いた場合に同じ区間のトレースを何度も保存しないよう、
+// 前回の保存からTRACE_WINDOW以上経過している場合のみ保存する
+func onSlowRequest(method, route string, d time.Duration) {
+	now := time.Now()
+	if now.Sub(time.Unix(0, lastTrace.Load())) < traceWindow {
+		return
+	}
+
+	// 書き込み中で保存できなかったリクエストの後も保存できるよう、書き込みを始められた場合のみ更新する
+	if !traceWriting.CompareAndSwap(false, true) {
+		return
+	}
+	if now.Sub(time.Unix(0, lastTrace.Load())) < traceWindow {
+		traceWriting.Store(false)
+		return
+	}
+	lastTrace.Store(now.UnixNano())
+
+	go func() {
+		defer traceWriting.Store(false)
+
+		info, err := saveTrace(now, method, route, d)
+		if err != nil {
+			slog.Error("failed to save trace",
+				slog.String("method", method),
+				slog.String("route", route),
+				slog.Duration("duration", d),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+
+		slog.Info("saved trace of slow request",
+			slog.String("name", info.Name),
+			slog.String("method", method),
+			slog.String("route", route),
+			slog.Duration("duration", d),
+		)
+
+		rotateTraces()
+	}()
+}
+
+func saveTrace(now time.Time, method, route string, d time.Duration) (TraceInfo, error) {
+	name := fmt.Sprintf("%d-%s-%s%s",
+		now.UnixMilli(),
+		method,
+		strings.Trim(unsafeChars.ReplaceAllString(route, "_"), "_"),
+		traceExt,
+	)
+
+	f, err := os.Create(filepath.Join(traceDir, name))
+	if err != nil {
+		return TraceInfo{}, fmt.Errorf("failed to create trace file: %w", err)
+	}
+	defer f.Close()
+
+	size, err := flightRecorder.WriteTo(f)
+	if err != nil {
+		return TraceInfo{}, fmt.Errorf("failed to write trace: %w", err)
+	}
+
+	info := TraceInfo{
+		Name:     name,
+		Time:     now,
+		Size:     size,
+		Method:   method,
+		Route:    route,
+		Duration: d.Seconds(),
+	}
+
+	traceLocker.Lock()
+	defer traceLocker.Unlock()
+
+	traceInfos[name] = info
+
+	return info, nil
+}
+
+// listTraces 保存済みのトレースを新しい順に返す
+// プロセスの再起動前に保存したものは、リクエストの情報を持たない
+func listTraces() ([]TraceInfo, error) {
+	entries, err := os.ReadDir(traceDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trace directory: %w", err)
+	}
+
+	traceLocker.RLock()
+	defer traceLocker.RUnlock()
+
+	infos := make([]TraceInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != traceExt {
+			continue
+		}
+
+		info, ok := traceInfos[entry.Name()]
+		if !ok {
+			stat, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			info = TraceInfo{
+				Name: entry.Name(),
+				Time: stat.ModTime(),
+				Size: stat.Size(),
+			}
+		}
+
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b TraceInfo) int {
+		return cmp.Or(b.Time.Compare(a.Time), cmp.Compare(a.Name, b.Name))
+	})
+
+	return infos, nil
+}
+
+func rotateTraces() {
+	infos, err := listTraces()
+	if err != nil {
+		slog.Error("failed to list traces",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if len(infos) <= maxTraceFiles {
+		return
+	}
+
+	traceLocker.Lock()
+	defer traceLocker.Unlock()
+
+	for _, info := range infos[maxTraceFiles:] {
+		err := os.Remove(filepath.Join(traceDir, info.Name))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("failed to remove trace",
+				slog.String("name", info.Name),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		delete(traceInfos, info.Name)
+	}
+}
+
+func traceListHandler(w http.ResponseWriter, r *http.Request) {
+	if flightRecorder == nil {
+		http.Error(w, "flight recorder is disabled (set TRACE_THRESHOLD)", http.StatusNotFound)
+		return
+	}
+
+	infos, err := listTraces()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.JSON(w, infos)
+}
+
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	if flightRecorder == nil {
+		http.Error(w, "flight recorder is disabled (set TRACE_THRESHOLD)", http.StatusNotFound)
+		return
+	}
+
+	name := r.PathValue("name")
+	if filepath.Base(name) != name || filepath.Ext(name) != traceExt {
+		http.Error(w, "invalid trace name", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	http.ServeFile(w, r, filepath.Join(traceDir, name))
+}
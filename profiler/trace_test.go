@@ -0,0 +1,54 @@
+package profiler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestSetupFlightRecorderMaxFiles 環境変数を書き換えるので、並行に実行しない
+func TestSetupFlightRecorderMaxFiles(t *testing.T) {
+	prev := maxTraceFiles
+	t.Cleanup(func() {
+		maxTraceFiles = prev
+	})
+
+	tests := []struct {
+		description string
+		maxFiles    string
+	}{
+		{description: "zero", maxFiles: "0"},
+		{description: "negative", maxFiles: "-1"},
+		{description: "not a number", maxFiles: "many"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Setenv("TRACE_THRESHOLD", "1s")
+			t.Setenv("TRACE_MAX_FILES", test.maxFiles)
+			t.Setenv("TRACE_DIR", t.TempDir())
+
+			err := setupFlightRecorder()
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+// TestOnSlowRequestWhileWriting グローバルな状態を書き換えるので、並行に実行しない
+func TestOnSlowRequestWhileWriting(t *testing.T) {
+	traceWriting.Store(true)
+	lastTrace.Store(0)
+	t.Cleanup(func() {
+		traceWriting.Store(false)
+		lastTrace.Store(0)
+	})
+
+	onSlowRequest(http.MethodGet, "/api/users", time.Second)
+
+	// 保存しなかったリクエストで更新すると、書き込み後の次の遅いリクエストも保存されなくなる
+	if last := lastTrace.Load(); last != 0 {
+		t.Errorf("expected last trace not to be updated, got %d", last)
+	}
+}
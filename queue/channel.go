@@ -1,6 +1,8 @@
 package isuqueue
 
 import (
+	"sync/atomic"
+
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -12,14 +14,21 @@ const (
 )
 
 var (
-	enableMetrics = true
+	enableMetrics = atomic.Bool{}
 	queueMap      = make(map[string]interface {
 		Reset()
 	}, 0)
 )
 
+func init() {
+	enableMetrics.Store(true)
+
+	// NewChannelでのみ参照されるため、実行中には変更できない
+	config.RegisterReadOnly("queue.metrics", enableMetrics.Load)
+}
+
 func SetEnableMetrics(enable bool) {
-	enableMetrics = enable
+	enableMetrics.Store(enable)
 }
 
 type Channel[T any] struct {
@@ -33,7 +42,7 @@ type Channel[T any] struct {
 
 func NewChannel[T any](name string, len int) *Channel[T] {
 	var metrics *prometheus.GaugeVec
-	if config.Enable && enableMetrics {
+	if config.Enable && enableMetrics.Load() {
 		metrics = promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: prometheusNamespace,
 			Subsystem: prometheusSubsystem,
@@ -61,14 +70,18 @@ func newChannel[T any](channel *Channel[T]) {
 
 		go func() {
 			for t := range sender {
-				channel.metrics.WithLabelValues(channel.name, "in").Inc()
+				if config.Measuring() {
+					channel.metrics.WithLabelValues(channel.name, "in").Inc()
+				}
 				ch <- t
 			}
 		}()
 
 		go func() {
 			for t := range ch {
-				channel.metrics.WithLabelValues(channel.name, "out").Inc()
+				if config.Measuring() {
+					channel.metrics.WithLabelValues(channel.name, "out").Inc()
+				}
 				receiver <- t
 			}
 		}()
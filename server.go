@@ -7,9 +7,14 @@ import (
 	_ "net/http/pprof"
 
 	isudb "github.com/mazrean/isucon-go-tools/v2/db"
+	"github.com/mazrean/isucon-go-tools/v2/internal/admin"
 	"github.com/mazrean/isucon-go-tools/v2/internal/benchmark"
+	"github.com/mazrean/isucon-go-tools/v2/internal/cluster"
 	"github.com/mazrean/isucon-go-tools/v2/internal/config"
+	"github.com/mazrean/isucon-go-tools/v2/internal/dashboard"
 	_ "github.com/mazrean/isucon-go-tools/v2/internal/log"
+	"github.com/mazrean/isucon-go-tools/v2/internal/ranking"
+	"github.com/mazrean/isucon-go-tools/v2/internal/reqstat"
 	"github.com/mazrean/isucon-go-tools/v2/profiler"
 )
 
@@ -19,14 +24,20 @@ func init() {
 	}
 
 	mux := http.NewServeMux()
+	config.Register(mux)
 	profiler.Register(mux)
 	benchmark.Register(mux)
 	isudb.Register(mux)
+	dashboard.Register(mux)
+	ranking.Register(mux)
+	reqstat.Register(mux)
+	// 自ホストの結果はmuxを直接呼び出して取得するため、最後に登録する
+	cluster.Register(mux)
 
 	go func() {
 		server := http.Server{
 			Addr:    config.Addr,
-			Handler: mux,
+			Handler: admin.Middleware(mux),
 		}
 		err := server.ListenAndServe()
 		if err != nil {